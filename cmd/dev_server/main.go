@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+	diffserve "roci.dev/diff-server/serve"
+	"roci.dev/diff-server/util/log"
+
+	"roci.dev/replicache-client/datalayer"
+)
+
+func main() {
+	impl(os.Args[1:], os.Stdout, os.Stderr, os.Exit)
+}
+
+func impl(args []string, out, errs io.Writer, exit func(int)) {
+	app := kingpin.New("dev-server", "Runs a fake data layer and a diff-server to sync clients against during development.")
+	app.ErrorWriter(errs)
+	app.UsageWriter(errs)
+	app.Terminate(exit)
+
+	configFile := app.Flag("config", "JSON file configuring the mutations and initial data of the data layer. By default the data layer implements .putValue, .delValue and .putMany, the mutations of repl.").File()
+	dataLayerPort := app.Flag("data-layer-port", "The port to run the data layer on").Default("7000").Int()
+	diffServerPort := app.Flag("diff-server-port", "The port to run the diff-server on").Default("7001").Int()
+	account := app.Flag("account", "The diff-server account, ie the diff-server auth to sync with").Default("dev").String()
+	storageDir := app.Flag("storage-dir", "The directory the diff-server stores its data in. A temporary directory by default.").String()
+	logLevel := app.Flag("log-level", "Log verbosity level").Default("info").Enum("error", "info", "debug")
+
+	_, err := app.Parse(args)
+	if err != nil {
+		fmt.Fprintln(errs, err.Error())
+		exit(1)
+		return
+	}
+
+	if err := run(*configFile, *dataLayerPort, *diffServerPort, *account, *storageDir, *logLevel, out); err != nil {
+		fmt.Fprintln(errs, err.Error())
+		exit(1)
+	}
+}
+
+func run(configFile *os.File, dataLayerPort, diffServerPort int, account, storageDir, logLevel string, out io.Writer) error {
+	c := datalayer.DefaultConfig
+	if configFile != nil {
+		var err error
+		c, err = datalayer.ReadConfig(configFile)
+		configFile.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := log.SetGlobalLevelFromString(logLevel); err != nil {
+		return err
+	}
+	if storageDir == "" {
+		var err error
+		if storageDir, err = ioutil.TempDir("", ""); err != nil {
+			return err
+		}
+	}
+
+	dl, err := net.Listen("tcp", fmt.Sprintf(":%d", dataLayerPort))
+	if err != nil {
+		return err
+	}
+	ds, err := net.Listen("tcp", fmt.Sprintf(":%d", diffServerPort))
+	if err != nil {
+		dl.Close()
+		return err
+	}
+
+	dataLayerURL := fmt.Sprintf("http://localhost:%d", dataLayerPort)
+	accounts := []diffserve.Account{{ID: account, Name: "Development", ClientViewURL: dataLayerURL + "/client-view"}}
+	diffService := diffserve.NewService(storageDir, accounts, "", diffserve.ClientViewGetter{}, false)
+
+	fmt.Fprintf(out, "Batch push URL:   %s/batch-push\n", dataLayerURL)
+	fmt.Fprintf(out, "Diff-server URL:  http://localhost:%d/pull\n", diffServerPort)
+	fmt.Fprintf(out, "Diff-server auth: %s\n", account)
+	if c.AuthToken != "" {
+		fmt.Fprintf(out, "Data layer auth:  %s\n", c.AuthToken)
+	}
+	fmt.Fprintf(out, "Mutations:        %s\n", strings.Join(c.MutationNames(), ", "))
+
+	errc := make(chan error, 2)
+	go func() {
+		errc <- http.Serve(dl, datalayer.New(c, out))
+	}()
+	go func() {
+		errc <- http.Serve(ds, diffService)
+	}()
+	err = <-errc
+	dl.Close()
+	ds.Close()
+	return err
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBadConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	f, err := ioutil.TempFile("", "")
+	assert.NoError(err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`{"mutations": {"a": {"op": "put"}}}`)
+	assert.NoError(err)
+	assert.NoError(f.Close())
+
+	tc := []struct {
+		args string
+		err  string
+	}{
+		{"--config=" + f.Name(), "invalid config: mutation a: no key\n"},
+		{"--log-level=verbose", "enum value must be one of error,info,debug, got 'verbose'\n"},
+	}
+	for _, c := range tc {
+		out := &strings.Builder{}
+		errs := &strings.Builder{}
+		code := 0
+		impl(strings.Split(c.args, " "), out, errs, func(c int) { code = c })
+		assert.Equal(1, code, c.args)
+		assert.Equal("", out.String(), c.args)
+		assert.Equal(c.err, errs.String(), c.args)
+	}
+}
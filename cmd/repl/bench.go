@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/attic-labs/noms/go/spec"
+	"github.com/attic-labs/noms/go/types"
+	zl "github.com/rs/zerolog"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+
+	diffserve "roci.dev/diff-server/serve"
+	"roci.dev/replicache-client/datalayer"
+	"roci.dev/replicache-client/db"
+)
+
+// benchOptions describes the workload of bench.
+type benchOptions struct {
+	Keys       int
+	ValueSize  int
+	Ops        int
+	Writes     float64 // fraction of ops that are puts
+	Scans      float64 // fraction of ops that are scans, the rest are gets
+	ScanSize   int
+	SyncRounds int
+	Seed       int64
+}
+
+// benchResult is the latencies of one kind of operation.
+type benchResult struct {
+	Op    string        `json:"op"`
+	Count int           `json:"count"`
+	Total time.Duration `json:"totalNs"`
+	P50   time.Duration `json:"p50Ns"`
+	P90   time.Duration `json:"p90Ns"`
+	P99   time.Duration `json:"p99Ns"`
+	Max   time.Duration `json:"maxNs"`
+}
+
+// OpsPerSec returns the throughput of the operation, ie how many ran per second
+// spent running them.
+func (r benchResult) OpsPerSec() float64 {
+	if r.Total == 0 {
+		return 0
+	}
+	return float64(r.Count) / r.Total.Seconds()
+}
+
+func bench(parent *kingpin.Application, gdb gdb, format *string, out io.Writer, l zl.Logger) {
+	kc := parent.Command("bench", "Runs a workload of gets, scans, puts and syncs on a new temporary database and reports throughput and latency percentiles. "+
+		"Syncs are against a fake data layer and diff-server in the same process.")
+	var opts benchOptions
+	useDB := kc.Flag("use-db", "run the workload on the database given by --db, which must be new, instead of a temporary one").Bool()
+	kc.Flag("keys", "number of keys to fill the database with before the workload").Default("1000").IntVar(&opts.Keys)
+	kc.Flag("value-size", "size of the values in bytes").Default("100").IntVar(&opts.ValueSize)
+	kc.Flag("ops", "number of gets, scans and puts to run").Default("1000").IntVar(&opts.Ops)
+	kc.Flag("writes", "fraction of the operations that are puts").Default("0.2").Float64Var(&opts.Writes)
+	kc.Flag("scans", "fraction of the operations that are scans").Default("0.1").Float64Var(&opts.Scans)
+	kc.Flag("scan-size", "maximum number of items each scan returns").Default("100").IntVar(&opts.ScanSize)
+	kc.Flag("sync-rounds", "number of syncs, evenly spread over the operations").Default("0").IntVar(&opts.SyncRounds)
+	kc.Flag("seed", "seed of the random choice of operations and keys").Default("1").Int64Var(&opts.Seed)
+	kc.Action(func(_ *kingpin.ParseContext) error {
+		if opts.Keys < 1 {
+			return errors.New("--keys must be at least 1")
+		}
+		if opts.ValueSize < 1 {
+			return errors.New("--value-size must be at least 1")
+		}
+		if opts.Writes < 0 || opts.Scans < 0 || opts.Writes+opts.Scans > 1 {
+			return errors.New("--writes and --scans must be fractions that add up to at most 1")
+		}
+		var d *db.DB
+		if *useDB {
+			var err error
+			if d, err = gdb(); err != nil {
+				return err
+			}
+		} else {
+			dir, err := ioutil.TempDir("", "repl-bench")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(dir)
+			sp, err := spec.ForDatabase(dir)
+			if err != nil {
+				return err
+			}
+			if d, err = db.Load(sp); err != nil {
+				return err
+			}
+			defer d.Close()
+		}
+		start := time.Now()
+		results, err := runBench(d, opts, l)
+		if err != nil {
+			return err
+		}
+		elapsed := time.Since(start)
+
+		switch *format {
+		case formatJSON:
+			return writeJSON(out, results)
+		case formatJSONL:
+			for _, r := range results {
+				if err := writeJSON(out, r); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		fmt.Fprintf(out, "%d operations on %d keys of %d bytes in %s\n\n", opts.Ops, opts.Keys, opts.ValueSize, elapsed.Round(time.Millisecond))
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "Op\tCount\tOps/s\tp50\tp90\tp99\tMax")
+		for _, r := range results {
+			fmt.Fprintf(w, "%s\t%d\t%.1f\t%s\t%s\t%s\t%s\n", r.Op, r.Count, r.OpsPerSec(),
+				r.P50.Round(time.Microsecond), r.P90.Round(time.Microsecond), r.P99.Round(time.Microsecond), r.Max.Round(time.Microsecond))
+		}
+		return w.Flush()
+	})
+}
+
+// runBench runs the workload described by opts on d, which must be new, and
+// returns the results per operation, in the order get, scan, put and sync.
+func runBench(d *db.DB, opts benchOptions, l zl.Logger) ([]benchResult, error) {
+	s, err := d.Stats(true)
+	if err != nil {
+		return nil, err
+	}
+	if s.CommitChainLength > 1 {
+		return nil, errors.New("bench writes to the database, use a new one")
+	}
+
+	rng := rand.New(rand.NewSource(opts.Seed))
+	key := func(i int) string {
+		return fmt.Sprintf("bench/%08d", i)
+	}
+	// value returns a random string value as noms value and as JSON.
+	value := func() (types.String, json.RawMessage) {
+		const letters = "abcdefghijklmnopqrstuvwxyz"
+		b := make([]byte, opts.ValueSize)
+		for i := range b {
+			b[i] = letters[rng.Intn(len(letters))]
+		}
+		return types.String(b), json.RawMessage(`"` + string(b) + `"`)
+	}
+
+	// The keys are filled in with a single .putMany commit that isn't measured.
+	ops := make([]putManyOp, 0, opts.Keys)
+	for i := 0; i < opts.Keys; i++ {
+		k := key(i)
+		_, v := value()
+		ops = append(ops, putManyOp{Key: &k, Value: v})
+	}
+	args, err := putManyArgs(d.Noms(), ops)
+	if err != nil {
+		return nil, err
+	}
+	tx := d.NewTransactionWithArgs(".putMany", args, nil, nil)
+	if err := putOps(tx, ops); err != nil {
+		tx.Close()
+		return nil, err
+	}
+	if _, err := tx.Commit(l); err != nil {
+		return nil, err
+	}
+
+	latencies := map[string][]time.Duration{}
+	measure := func(op string, f func() error) error {
+		start := time.Now()
+		if err := f(); err != nil {
+			return fmt.Errorf("%s failed: %s", op, err)
+		}
+		latencies[op] = append(latencies[op], time.Since(start))
+		return nil
+	}
+	get := func() error {
+		tx := d.NewTransaction()
+		defer tx.Close()
+		_, err := tx.Get(key(rng.Intn(opts.Keys)))
+		return err
+	}
+	scan := func() error {
+		tx := d.NewTransaction()
+		defer tx.Close()
+		_, err := tx.Scan(db.ScanOptions{
+			Start: &db.ScanBound{ID: &db.ScanID{Value: key(rng.Intn(opts.Keys))}},
+			Limit: opts.ScanSize,
+		})
+		return err
+	}
+	put := func() error {
+		k := key(rng.Intn(opts.Keys))
+		nv, v := value()
+		tx := d.NewTransactionWithArgs(".putValue", types.NewList(d.Noms(), types.String(k), nv), nil, nil)
+		if err := tx.Put(k, v); err != nil {
+			tx.Close()
+			return err
+		}
+		_, err := tx.Commit(l)
+		return err
+	}
+
+	sync := func() error { return nil }
+	if opts.SyncRounds > 0 {
+		dataLayer := httptest.NewServer(datalayer.New(datalayer.DefaultConfig, ioutil.Discard))
+		defer dataLayer.Close()
+		diffDir, err := ioutil.TempDir("", "")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(diffDir)
+		accounts := []diffserve.Account{{ID: "bench", Name: "Benchmark", ClientViewURL: dataLayer.URL + "/client-view"}}
+		diffServer := httptest.NewServer(diffserve.NewService(diffDir, accounts, "", diffserve.ClientViewGetter{}, false))
+		defer diffServer.Close()
+		sync = func() error {
+			syncHead, info, err := d.BeginSync(dataLayer.URL+"/batch-push", diffServer.URL+"/pull", "bench", "", l)
+			if err != nil {
+				return err
+			}
+			if info.ClientViewInfo.ErrorMessage != "" {
+				return errors.New(info.ClientViewInfo.ErrorMessage)
+			}
+			for !syncHead.IsEmpty() {
+				replay, err := d.MaybeEndSync(syncHead)
+				if err != nil || len(replay) == 0 {
+					return err
+				}
+				if syncHead, err = replayMutations(d, syncHead, replay, l); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		// The fill is pushed to the data layer by a sync that isn't measured either.
+		if err := sync(); err != nil {
+			return nil, fmt.Errorf("sync failed: %s", err)
+		}
+	}
+
+	// The operations are split into rounds that each end with a sync.
+	rounds := opts.SyncRounds
+	if rounds == 0 {
+		rounds = 1
+	}
+	for r := 0; r < rounds; r++ {
+		n := opts.Ops / rounds
+		if r == rounds-1 {
+			n += opts.Ops % rounds
+		}
+		for i := 0; i < n; i++ {
+			var err error
+			switch p := rng.Float64(); {
+			case p < opts.Writes:
+				err = measure("put", put)
+			case p < opts.Writes+opts.Scans:
+				err = measure("scan", scan)
+			default:
+				err = measure("get", get)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		if opts.SyncRounds > 0 {
+			if err := measure("sync", sync); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	results := []benchResult{}
+	for _, op := range []string{"get", "scan", "put", "sync"} {
+		lat := latencies[op]
+		if len(lat) == 0 {
+			continue
+		}
+		sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+		r := benchResult{
+			Op:    op,
+			Count: len(lat),
+			P50:   percentile(lat, 0.5),
+			P90:   percentile(lat, 0.9),
+			P99:   percentile(lat, 0.99),
+			Max:   lat[len(lat)-1],
+		}
+		for _, t := range lat {
+			r.Total += t
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// percentile returns the q-th quantile of the sorted durations by the nearest
+// rank method.
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
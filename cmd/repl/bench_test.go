@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	gotime "time"
+
+	"github.com/attic-labs/noms/go/spec"
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/replicache-client/db"
+)
+
+func TestBench(t *testing.T) {
+	assert := assert.New(t)
+
+	td, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	run := func(args ...string) (int, string, string) {
+		ob := &strings.Builder{}
+		eb := &strings.Builder{}
+		code := 0
+		impl(append([]string{"--db=" + td}, args...), strings.NewReader(""), ob, eb, func(c int) { code = c })
+		return code, ob.String(), eb.String()
+	}
+
+	code, _, errs := run("bench", "--writes=0.8", "--scans=0.5")
+	assert.Equal(1, code)
+	assert.Equal("--writes and --scans must be fractions that add up to at most 1\n", errs)
+
+	code, _, errs = run("bench", "--value-size=0")
+	assert.Equal(1, code)
+	assert.Equal("--value-size must be at least 1\n", errs)
+
+	// By default bench runs on a temporary database and leaves --db alone.
+	code, out, errs := run("bench", "--keys=5", "--ops=5", "--sync-rounds=1", "--format=json")
+	assert.Equal(0, code)
+	assert.Equal("", errs)
+
+	code, out, errs = run("bench", "--use-db", "--keys=20", "--ops=50", "--writes=0.5", "--scans=0.2", "--scan-size=5", "--sync-rounds=2", "--format=json")
+	assert.Equal(0, code)
+	assert.Equal("", errs)
+	var results []benchResult
+	assert.NoError(json.Unmarshal([]byte(out), &results))
+	counts := map[string]int{}
+	for _, r := range results {
+		counts[r.Op] = r.Count
+		assert.True(r.P50 <= r.P90 && r.P90 <= r.P99 && r.P99 <= r.Max, r.Op)
+	}
+	assert.Equal(50, counts["get"]+counts["scan"]+counts["put"])
+	assert.True(counts["put"] > 0)
+	assert.Equal(2, counts["sync"])
+
+	sp, err := spec.ForDatabase(td)
+	assert.NoError(err)
+	d, err := db.Load(sp)
+	assert.NoError(err)
+	s, err := d.Stats(false)
+	assert.NoError(err)
+	assert.Equal(uint64(20), s.Keys)
+	assert.Equal(0, s.PendingMutations)
+	assert.NoError(d.Close())
+
+	code, _, errs = run("bench", "--use-db")
+	assert.Equal(1, code)
+	assert.Equal("bench writes to the database, use a new one\n", errs)
+}
+
+func TestPercentile(t *testing.T) {
+	assert := assert.New(t)
+	var d []gotime.Duration
+	for i := 1; i <= 100; i++ {
+		d = append(d, gotime.Duration(i))
+	}
+	tc := []struct {
+		sorted []gotime.Duration
+		q      float64
+		exp    gotime.Duration
+	}{
+		{nil, 0.5, 0},
+		{d[:1], 0.5, 1},
+		{d[:1], 0.99, 1},
+		{d[:2], 0.5, 1},
+		{d[:3], 0.5, 2},
+		{d, 0.5, 50},
+		{d, 0.9, 90},
+		{d, 0.99, 99},
+		{d, 1, 100},
+		{d, 0, 1},
+	}
+	for _, c := range tc {
+		assert.Equal(c.exp, percentile(c.sorted, c.q), "%v %v", c.sorted, c.q)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/attic-labs/noms/go/hash"
+	"github.com/attic-labs/noms/go/types"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+
+	"roci.dev/replicache-client/db"
+)
+
+// resolveCommit returns the commit named by ref, which is either a commit hash
+// or one of the aliases "head" and "snapshot" (the most recent snapshot), each
+// optionally followed by "~N" to go back N commits.
+func resolveCommit(d *db.DB, ref string) (db.Commit, error) {
+	name, back := ref, 0
+	if i := strings.LastIndex(ref, "~"); i >= 0 {
+		n, err := strconv.Atoi(ref[i+1:])
+		if err != nil || n < 0 {
+			return db.Commit{}, fmt.Errorf("invalid commit %s: ~ must be followed by a number", ref)
+		}
+		name, back = ref[:i], n
+	}
+
+	var c db.Commit
+	var err error
+	switch name {
+	case "head":
+		c = d.Head()
+	case "snapshot":
+		c = d.Head()
+		for c.Type() != db.CommitTypeSnapshot {
+			if c, err = c.Basis(d.Noms()); err != nil {
+				return db.Commit{}, err
+			}
+		}
+	default:
+		h, ok := hash.MaybeParse(name)
+		if !ok {
+			return db.Commit{}, fmt.Errorf("invalid commit %s: not a hash, head or snapshot", ref)
+		}
+		if c, err = db.ReadCommit(d.Noms(), h); err != nil {
+			return db.Commit{}, err
+		}
+	}
+
+	for i := 0; i < back; i++ {
+		if len(c.Parents) == 0 {
+			return db.Commit{}, fmt.Errorf("invalid commit %s: history is only %d commits long", ref, i+1)
+		}
+		if c, err = c.Basis(d.Noms()); err != nil {
+			return db.Commit{}, err
+		}
+	}
+	return c, nil
+}
+
+// keyChange is a change of the value of one key between two commits.
+type keyChange struct {
+	Op  string          `json:"op"` // "add", "remove" or "change"
+	Key string          `json:"key"`
+	Old json.RawMessage `json:"old,omitempty"`
+	New json.RawMessage `json:"new,omitempty"`
+}
+
+// diffData returns the changes from the data of commit from to the data of commit
+// to, in key order, limited to keys starting with prefix.
+func diffData(noms types.ValueReadWriter, from, to db.Commit, prefix string) ([]keyChange, error) {
+	return diffMaps(from.Data(noms).NomsMap(), to.Data(noms).NomsMap(), prefix)
+}
+
+// diffMaps returns the changes from from to to, in key order, limited to keys
+// starting with prefix.
+func diffMaps(from, to types.Map, prefix string) ([]keyChange, error) {
+	changes := make(chan types.ValueChanged)
+	closeChan := make(chan struct{})
+	defer close(closeChan)
+	go func() {
+		to.Diff(from, changes, closeChan)
+		close(changes)
+	}()
+
+	r := []keyChange{}
+	for c := range changes {
+		key := string(c.Key.(types.String))
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		kc := keyChange{Key: key}
+		switch c.ChangeType {
+		case types.DiffChangeAdded:
+			kc.Op = "add"
+		case types.DiffChangeRemoved:
+			kc.Op = "remove"
+		case types.DiffChangeModified:
+			kc.Op = "change"
+		}
+		var err error
+		if kc.Old, err = valueJSON(c.OldValue); err != nil {
+			return nil, err
+		}
+		if kc.New, err = valueJSON(c.NewValue); err != nil {
+			return nil, err
+		}
+		r = append(r, kc)
+	}
+	return r, nil
+}
+
+func diffCmd(parent *kingpin.Application, gdb gdb, format *string, out io.Writer) {
+	kc := parent.Command("diff", "Displays the changes to the data between two commits. Commits are given by hash or as head, snapshot (the latest snapshot), head~N or snapshot~N.")
+	from := kc.Arg("from", "commit to diff from").Required().String()
+	to := kc.Arg("to", "commit to diff to").Required().String()
+	prefix := kc.Flag("prefix", "only show keys starting with prefix").String()
+	kc.Action(func(_ *kingpin.ParseContext) error {
+		d, err := gdb()
+		if err != nil {
+			return err
+		}
+		a, err := resolveCommit(d, *from)
+		if err != nil {
+			return err
+		}
+		b, err := resolveCommit(d, *to)
+		if err != nil {
+			return err
+		}
+		changes, err := diffData(d.Noms(), a, b, *prefix)
+		if err != nil {
+			return err
+		}
+
+		switch *format {
+		case formatJSON:
+			return writeJSON(out, changes)
+		case formatJSONL:
+			for _, c := range changes {
+				if err := writeJSON(out, c); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		printChanges(out, changes)
+		return nil
+	})
+}
+
+// printChanges prints one line per change, prefixed with + for added keys, - for
+// removed keys and ~ for changed values.
+func printChanges(out io.Writer, changes []keyChange) {
+	for _, c := range changes {
+		switch c.Op {
+		case "add":
+			fmt.Fprintf(out, "+ %s: %s\n", c.Key, c.New)
+		case "remove":
+			fmt.Fprintf(out, "- %s: %s\n", c.Key, c.Old)
+		case "change":
+			fmt.Fprintf(out, "~ %s: %s -> %s\n", c.Key, c.Old, c.New)
+		}
+	}
+}
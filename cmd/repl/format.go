@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/attic-labs/noms/go/types"
+
+	nomsjson "roci.dev/diff-server/util/noms/json"
+)
+
+// Output formats that can be chosen with the --format flag. Commands that don't
+// support a format fall back to their default output, which is used if no format
+// is given.
+const (
+	formatJSON  = "json"  // a single JSON document
+	formatJSONL = "jsonl" // one JSON document per line, eg per item of scan
+	formatNoms  = "noms"  // values in noms syntax
+	formatTable = "table" // aligned labels and values
+)
+
+// valueJSON returns v as compact JSON, as rendered for transactions.
+func valueJSON(v types.Value) (json.RawMessage, error) {
+	if v == nil {
+		return nil, nil
+	}
+	var b bytes.Buffer
+	if err := nomsjson.ToJSON(v, &b); err != nil {
+		return nil, err
+	}
+	return compactJSON(b.Bytes())
+}
+
+func compactJSON(data []byte) (json.RawMessage, error) {
+	var b bytes.Buffer
+	if err := json.Compact(&b, data); err != nil {
+		return nil, err
+	}
+	return json.RawMessage(b.Bytes()), nil
+}
+
+// writeJSON writes v as a single line of JSON.
+func writeJSON(out io.Writer, v interface{}) error {
+	return json.NewEncoder(out).Encode(v)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/attic-labs/noms/go/types"
+	"github.com/stretchr/testify/assert"
+
+	nomsjson "roci.dev/diff-server/util/noms/json"
+	"roci.dev/diff-server/util/time"
+	"roci.dev/replicache-client/db"
+)
+
+func TestFormat(t *testing.T) {
+	assert := assert.New(t)
+	defer time.SetFake()()
+
+	d, dir := db.LoadTempDB(assert)
+	v, err := nomsjson.FromJSON([]byte(`{"a":[1,true]}`), d.Noms())
+	assert.NoError(err)
+	assert.NoError(d.Close())
+
+	run := func(in string, args ...string) string {
+		ob := &strings.Builder{}
+		eb := &strings.Builder{}
+		code := 0
+		impl(append([]string{"--db=" + dir}, args...), strings.NewReader(in), ob, eb, func(c int) { code = c })
+		assert.Equal(0, code, "%v", args)
+		assert.Equal("", eb.String(), "%v", args)
+		return ob.String()
+	}
+	run("", "put", "foo", `{"a": [1, true]}`)
+	run("", "put", "bar", `"baz"`)
+
+	tc := []struct {
+		args string
+		out  string
+	}{
+		{"has foo --format=json", "true\n"},
+		{"has qux --format=jsonl", "false\n"},
+		{"has foo --format=noms", "true\n"},
+		{"has qux --format=table", "qux: false\n"},
+		{"--format=json get foo", `{"a":[1,true]}` + "\n"},
+		{"get foo --format=noms", types.EncodedValue(v) + "\n"},
+		{"get foo --format=table", `foo: {"a":[1,true]}` + "\n"},
+		{"get qux --format=json", ""},
+		{"scan --format=json", `[{"key":"bar","value":"baz"},{"key":"foo","value":{"a":[1,true]}}]` + "\n"},
+		{"scan --format=json --prefix=qux", "[]\n"},
+		{"scan --format=jsonl", `{"key":"bar","value":"baz"}` + "\n" + `{"key":"foo","value":{"a":[1,true]}}` + "\n"},
+		{"scan --format=noms --prefix=bar", `bar: "baz"` + "\n"},
+		{"scan --format=table", `bar: "baz"` + "\n" + `foo: {"a":[1,true]}` + "\n"},
+	}
+	for _, c := range tc {
+		assert.Equal(c.out, run("", strings.Split(c.args, " ")...), c.args)
+	}
+
+	lines := strings.Split(strings.TrimSpace(run("", "log", "--format=jsonl")), "\n")
+	if assert.Equal(3, len(lines)) {
+		var e logEntry
+		assert.NoError(json.Unmarshal([]byte(lines[0]), &e))
+		assert.Equal(".putValue", e.Name)
+		assert.Equal(`["bar","baz"]`, string(e.Args))
+	}
+	var entries []logEntry
+	assert.NoError(json.Unmarshal([]byte(run("", "log", "--format=json")), &entries))
+	assert.Equal(3, len(entries))
+
+	var s map[string]interface{}
+	assert.NoError(json.Unmarshal([]byte(run("", "stats", "--format=json")), &s))
+	assert.Equal(float64(2), s["keys"])
+	assert.Equal(float64(2), s["pendingMutations"])
+	assert.Equal(nil, s["lastSync"])
+	assert.Contains(s, "sizeOnDisk")
+	assert.True(strings.HasPrefix(run("", "stats", "--format=noms"), "struct Stats {"))
+}
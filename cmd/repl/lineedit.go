@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// lineReader reads the shell's input line by line. On a terminal it supports
+// basic line editing, history and tab completion. Otherwise, eg when input is
+// piped in, it just reads lines and doesn't print prompts.
+type lineReader struct {
+	in       *bufio.Reader
+	out      io.Writer
+	fd       int  // -1 if in is not a terminal
+	terminal bool // edit lines, even if fd is not a terminal (for testing)
+	history  []string
+	// complete returns the candidates to complete the last word of line with.
+	complete func(line string) []string
+}
+
+func newLineReader(in io.Reader, out io.Writer, complete func(line string) []string) *lineReader {
+	lr := &lineReader{
+		in:       bufio.NewReader(in),
+		out:      out,
+		fd:       -1,
+		complete: complete,
+	}
+	if f, ok := in.(*os.File); ok && isTerminal(int(f.Fd())) {
+		lr.fd = int(f.Fd())
+		lr.terminal = true
+	}
+	return lr
+}
+
+// readLine returns the next line of input, without the line ending. It returns
+// io.EOF at the end of input or when ctrl-D is pressed on an empty line.
+func (lr *lineReader) readLine(prompt string) (string, error) {
+	if !lr.terminal {
+		line, err := lr.in.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	if lr.fd >= 0 {
+		restore, err := makeRaw(lr.fd)
+		if err != nil {
+			return "", err
+		}
+		defer restore()
+	}
+
+	e := lineEdit{lr: lr, prompt: prompt, histIdx: len(lr.history)}
+	e.refresh()
+	for {
+		r, _, err := lr.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(lr.out, "\r\n")
+			line := string(e.buf)
+			if strings.TrimSpace(line) != "" && (len(lr.history) == 0 || lr.history[len(lr.history)-1] != line) {
+				lr.history = append(lr.history, line)
+			}
+			return line, nil
+		case 3: // ctrl-C discards the line.
+			fmt.Fprint(lr.out, "^C\r\n")
+			return "", nil
+		case 4: // ctrl-D
+			if len(e.buf) == 0 {
+				fmt.Fprint(lr.out, "\r\n")
+				return "", io.EOF
+			}
+			e.delete()
+		case 1: // ctrl-A
+			e.pos = 0
+		case 5: // ctrl-E
+			e.pos = len(e.buf)
+		case 11: // ctrl-K
+			e.buf = e.buf[:e.pos]
+		case 21: // ctrl-U
+			e.buf = e.buf[e.pos:]
+			e.pos = 0
+		case 8, 127: // backspace
+			if e.pos > 0 {
+				e.pos--
+				e.delete()
+			}
+		case '\t':
+			e.completeWord()
+		case 27: // escape sequence
+			e.escape()
+		default:
+			if r >= ' ' {
+				e.insert(r)
+			}
+		}
+		e.refresh()
+	}
+}
+
+// lineEdit is the state of the line being edited.
+type lineEdit struct {
+	lr      *lineReader
+	prompt  string
+	buf     []rune
+	pos     int
+	histIdx int
+	// saved is the line that was being edited before moving through history.
+	saved []rune
+}
+
+func (e *lineEdit) insert(r ...rune) {
+	buf := make([]rune, 0, len(e.buf)+len(r))
+	buf = append(buf, e.buf[:e.pos]...)
+	buf = append(buf, r...)
+	e.buf = append(buf, e.buf[e.pos:]...)
+	e.pos += len(r)
+}
+
+// delete deletes the rune under the cursor.
+func (e *lineEdit) delete() {
+	if e.pos < len(e.buf) {
+		e.buf = append(e.buf[:e.pos], e.buf[e.pos+1:]...)
+	}
+}
+
+func (e *lineEdit) escape() {
+	r, _, err := e.lr.in.ReadRune()
+	if err != nil || (r != '[' && r != 'O') {
+		return
+	}
+	r, _, err = e.lr.in.ReadRune()
+	if err != nil {
+		return
+	}
+	switch r {
+	case 'A':
+		e.historyMove(-1)
+	case 'B':
+		e.historyMove(1)
+	case 'C':
+		if e.pos < len(e.buf) {
+			e.pos++
+		}
+	case 'D':
+		if e.pos > 0 {
+			e.pos--
+		}
+	case 'H':
+		e.pos = 0
+	case 'F':
+		e.pos = len(e.buf)
+	case '3':
+		if r, _, _ := e.lr.in.ReadRune(); r == '~' {
+			e.delete()
+		}
+	}
+}
+
+func (e *lineEdit) historyMove(d int) {
+	i := e.histIdx + d
+	if i < 0 || i > len(e.lr.history) {
+		return
+	}
+	if e.histIdx == len(e.lr.history) {
+		e.saved = e.buf
+	}
+	e.histIdx = i
+	if i == len(e.lr.history) {
+		e.buf = e.saved
+	} else {
+		e.buf = []rune(e.lr.history[i])
+	}
+	e.pos = len(e.buf)
+}
+
+// completeWord completes the word before the cursor as far as all candidates
+// agree, and lists the candidates if that doesn't get any further.
+func (e *lineEdit) completeWord() {
+	if e.lr.complete == nil {
+		return
+	}
+	line := string(e.buf[:e.pos])
+	word := []rune(line[strings.LastIndex(line, " ")+1:])
+	cands := e.lr.complete(line)
+	if len(cands) == 0 {
+		return
+	}
+	// The common prefix is computed on runes, so that it never ends in the
+	// middle of a multi-byte character.
+	prefix := []rune(cands[0])
+	for _, c := range cands[1:] {
+		cr := []rune(c)
+		n := 0
+		for n < len(prefix) && n < len(cr) && prefix[n] == cr[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	if len(prefix) > len(word) && string(prefix[:len(word)]) == string(word) {
+		e.insert(prefix[len(word):]...)
+	}
+	if len(cands) == 1 {
+		e.insert(' ')
+	} else if len(prefix) <= len(word) {
+		fmt.Fprintf(e.lr.out, "\r\n%s\r\n", strings.Join(cands, "  "))
+	}
+}
+
+func (e *lineEdit) refresh() {
+	fmt.Fprintf(e.lr.out, "\r%s%s\x1b[K\r", e.prompt, string(e.buf))
+	if n := len([]rune(e.prompt)) + e.pos; n > 0 {
+		fmt.Fprintf(e.lr.out, "\x1b[%dC", n)
+	}
+}
+
+// lineReaderInput adapts a lineReader to an io.Reader, for commands that read
+// from stdin, eg the confirmation prompt of drop or put without a value. It reads
+// a single line, after which it returns io.EOF, so that commands reading until
+// the end of their input don't consume the rest of the shell session.
+type lineReaderInput struct {
+	lr      *lineReader
+	pending []byte
+	read    bool
+}
+
+func (in *lineReaderInput) Read(p []byte) (int, error) {
+	if len(in.pending) == 0 {
+		if in.read {
+			return 0, io.EOF
+		}
+		in.read = true
+		line, err := in.lr.readLine("")
+		if err != nil {
+			return 0, err
+		}
+		in.pending = []byte(line + "\n")
+	}
+	n := copy(p, in.pending)
+	in.pending = in.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/attic-labs/noms/go/diff"
+	"github.com/attic-labs/noms/go/hash"
+	"github.com/attic-labs/noms/go/types"
+	"github.com/attic-labs/noms/go/util/outputpager"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+
+	nomsjson "roci.dev/diff-server/util/noms/json"
+	"roci.dev/diff-server/util/tbl"
+	rtime "roci.dev/diff-server/util/time"
+	"roci.dev/replicache-client/db"
+)
+
+// logEntry is the JSON form of a commit in the output of log --format=json.
+type logEntry struct {
+	Hash string `json:"hash"`
+	Type string `json:"type"` // "local" or "snapshot"
+
+	// Local commits only.
+	MutationID  uint64          `json:"mutationId,omitempty"`
+	Name        string          `json:"name,omitempty"`
+	Args        json.RawMessage `json:"args,omitempty"`
+	Date        *time.Time      `json:"date,omitempty"`
+	Original    string          `json:"original,omitempty"` // set for replayed commits
+	Status      string          `json:"status,omitempty"`   // "pending" or "confirmed"
+	ConfirmedBy string          `json:"confirmedBy,omitempty"`
+
+	// Snapshots only.
+	ServerStateID  string  `json:"serverStateId,omitempty"`
+	LastMutationID *uint64 `json:"lastMutationId,omitempty"`
+
+	Changes []keyChange `json:"changes"`
+}
+
+func logCmd(parent *kingpin.Application, gdb gdb, format *string, out io.Writer) {
+	kc := parent.Command("log", "Displays the history of the cache.")
+	np := kc.Flag("no-pager", "supress paging functionality").Bool()
+	limit := kc.Flag("limit", "maximum number of commits to show").Int()
+	key := kc.Flag("key", "only show commits that change the value of key").String()
+	graph := kc.Flag("graph", "show one line per commit, local commits as * and snapshots as o").Bool()
+
+	kc.Action(func(_ *kingpin.ParseContext) error {
+		d, err := gdb()
+		if err != nil {
+			return err
+		}
+		noms := d.Noms()
+		jsonFormat := *format == formatJSON || *format == formatJSONL
+
+		if !*np && !jsonFormat {
+			pgr := outputpager.Start()
+			defer pgr.Stop()
+			out = pgr.Writer
+		}
+
+		entries := []logEntry{}
+		shown := 0
+		show := func(c db.Commit, basis *db.Commit, confirmedBy *db.Commit) error {
+			if *key != "" && !touchesKey(noms, c, basis, *key) {
+				return nil
+			}
+			var err error
+			switch {
+			case jsonFormat:
+				var e logEntry
+				e, err = newLogEntry(noms, c, basis, confirmedBy)
+				if err == nil && *format == formatJSONL {
+					err = writeJSON(out, e)
+				} else if err == nil {
+					entries = append(entries, e)
+				}
+			case *graph:
+				err = printGraphLine(out, c, confirmedBy)
+			default:
+				err = printCommit(out, noms, c, basis, confirmedBy)
+			}
+			shown++
+			return err
+		}
+		done := func() bool {
+			return *limit > 0 && shown >= *limit
+		}
+
+		// The local commits on the history of head are all pending: sync replaces
+		// the confirmed ones with the snapshot that confirmed them. The reflog keeps
+		// the head from before such a sync, and the commits in its history that the
+		// snapshot's last mutation ID covers are shown right before the snapshot.
+		synced, err := syncedFrom(d)
+		if err != nil {
+			return err
+		}
+	walk:
+		for c := d.Head(); ; {
+			var basis *db.Commit
+			if len(c.Parents) > 0 {
+				b, err := c.Basis(noms)
+				if err != nil {
+					return err
+				}
+				basis = &b
+			}
+
+			if from, ok := synced[c.NomsStruct.Hash()]; ok {
+				confirmed, err := confirmedLocals(noms, from, c)
+				if err != nil {
+					return err
+				}
+				for _, o := range confirmed {
+					ob, err := o.Basis(noms)
+					if err != nil {
+						return err
+					}
+					if err := show(o, &ob, &c); err != nil {
+						return err
+					}
+					if done() {
+						break walk
+					}
+				}
+			}
+			if err := show(c, basis, nil); err != nil {
+				return err
+			}
+			if basis == nil || done() {
+				break
+			}
+			c = *basis
+		}
+
+		if *format == formatJSON {
+			return writeJSON(out, entries)
+		}
+		return nil
+	})
+}
+
+// syncedFrom returns the heads from before the syncs recorded in the reflog of
+// d, keyed by the snapshot each sync landed.
+func syncedFrom(d *db.DB) (map[hash.Hash]db.Commit, error) {
+	noms := d.Noms()
+	entries, err := d.Reflog()
+	if err != nil {
+		return nil, err
+	}
+	r := map[hash.Hash]db.Commit{}
+	for _, e := range entries {
+		if !e.Sync {
+			continue
+		}
+		s, err := db.ReadCommit(noms, e.To.TargetHash())
+		for err == nil && s.Type() == db.CommitTypeLocal {
+			s, err = s.Basis(noms)
+		}
+		if err != nil {
+			return nil, err
+		}
+		from, err := db.ReadCommit(noms, e.From.TargetHash())
+		if err != nil {
+			return nil, err
+		}
+		r[s.NomsStruct.Hash()] = from
+	}
+	return r, nil
+}
+
+// confirmedLocals returns the local commits in the history of from, up to its
+// snapshot, that snapshot confirmed, newest first.
+func confirmedLocals(noms types.ValueReadWriter, from db.Commit, snapshot db.Commit) ([]db.Commit, error) {
+	var r []db.Commit
+	for c := from; c.Type() == db.CommitTypeLocal; {
+		if !c.IsMigration() && c.Meta.Local.MutationID <= snapshot.Meta.Snapshot.LastMutationID {
+			r = append(r, c)
+		}
+		var err error
+		if c, err = c.Basis(noms); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// touchesKey returns true if commit c changed the value of key relative to basis.
+func touchesKey(noms types.ValueReadWriter, c db.Commit, basis *db.Commit, key string) bool {
+	k := types.String(key)
+	v, _ := c.Data(noms).NomsMap().MaybeGet(k)
+	var old types.Value
+	if basis != nil {
+		old, _ = basis.Data(noms).NomsMap().MaybeGet(k)
+	}
+	if v == nil || old == nil {
+		return (v == nil) != (old == nil)
+	}
+	return !v.Equals(old)
+}
+
+func printCommit(out io.Writer, noms types.ValueReadWriter, c db.Commit, basis *db.Commit, confirmedBy *db.Commit) error {
+	fmt.Fprintln(out, color("commit "+c.NomsStruct.Hash().String(), "red+h"))
+
+	table := &tbl.Table{}
+	if c.Type() == db.CommitTypeLocal {
+		table.Add("Created: ", rtime.String(c.Meta.Local.Date.Time))
+		if confirmedBy == nil {
+			table.Add("Status: ", "PENDING")
+		} else {
+			table.Add("Status: ", "CONFIRMED")
+			table.Add("Confirmed by: ", confirmedBy.NomsStruct.Hash().String())
+		}
+		table.Add("Transaction: ", fmt.Sprintf("%s(%s)", c.Meta.Local.Name, types.EncodedValue(c.Meta.Local.Args)))
+		if !c.Meta.Local.Original.IsZeroValue() {
+			table.Add("Replay of: ", c.Meta.Local.Original.TargetHash().String())
+		}
+	} else {
+		table.Add("Status: ", "SNAPSHOT")
+		table.Add("Server state: ", serverStateID(c))
+		table.Add("Last mutation: ", fmt.Sprintf("%d", c.Meta.Snapshot.LastMutationID))
+	}
+	if _, err := table.WriteTo(out); err != nil {
+		return err
+	}
+
+	if basis != nil {
+		if err := diff.PrintDiff(out, basis.Data(noms).NomsMap(), c.Data(noms).NomsMap(), false); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(out, "")
+	return nil
+}
+
+// serverStateID returns the server state ID of snapshot c, "none" for genesis.
+func serverStateID(c db.Commit) string {
+	if c.Meta.Snapshot.ServerStateID == "" {
+		return "none"
+	}
+	return c.Meta.Snapshot.ServerStateID
+}
+
+func printGraphLine(out io.Writer, c db.Commit, confirmedBy *db.Commit) error {
+	h := c.NomsStruct.Hash().String()
+	if c.Type() == db.CommitTypeSnapshot {
+		_, err := fmt.Fprintf(out, "o %s snapshot %s (last mutation %d)\n", color(h, "red+h"), serverStateID(c), c.Meta.Snapshot.LastMutationID)
+		return err
+	}
+	var args bytes.Buffer
+	if err := nomsjson.ToJSON(c.Meta.Local.Args, &args); err != nil {
+		return err
+	}
+	status := "pending"
+	if confirmedBy != nil {
+		status = "confirmed"
+	}
+	_, err := fmt.Fprintf(out, "* %s %d %s(%s) %s\n", color(h, "red+h"), c.Meta.Local.MutationID, c.Meta.Local.Name, bytes.TrimSpace(args.Bytes()), status)
+	return err
+}
+
+func newLogEntry(noms types.ValueReadWriter, c db.Commit, basis *db.Commit, confirmedBy *db.Commit) (logEntry, error) {
+	e := logEntry{
+		Hash:    c.NomsStruct.Hash().String(),
+		Changes: []keyChange{},
+	}
+	if c.Type() == db.CommitTypeLocal {
+		var args bytes.Buffer
+		if err := nomsjson.ToJSON(c.Meta.Local.Args, &args); err != nil {
+			return logEntry{}, err
+		}
+		date := c.Meta.Local.Date.Time
+		e.Type = "local"
+		e.MutationID = c.Meta.Local.MutationID
+		e.Name = c.Meta.Local.Name
+		e.Args = bytes.TrimSpace(args.Bytes())
+		e.Date = &date
+		if !c.Meta.Local.Original.IsZeroValue() {
+			e.Original = c.Meta.Local.Original.TargetHash().String()
+		}
+		e.Status = "pending"
+		if confirmedBy != nil {
+			e.Status = "confirmed"
+			e.ConfirmedBy = confirmedBy.NomsStruct.Hash().String()
+		}
+	} else {
+		lmid := c.Meta.Snapshot.LastMutationID
+		e.Type = "snapshot"
+		e.ServerStateID = c.Meta.Snapshot.ServerStateID
+		e.LastMutationID = &lmid
+	}
+	if basis != nil {
+		changes, err := diffData(noms, *basis, c, "")
+		if err != nil {
+			return logEntry{}, err
+		}
+		e.Changes = changes
+	}
+	return e, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	diffserve "roci.dev/diff-server/serve"
+	"roci.dev/diff-server/util/time"
+	"roci.dev/replicache-client/datalayer"
+	"roci.dev/replicache-client/db"
+)
+
+func TestLogJSON(t *testing.T) {
+	assert := assert.New(t)
+	defer time.SetFake()()
+
+	d, dir := db.LoadTempDB(assert)
+	genesis := d.Head().NomsStruct.Hash().String()
+	assert.NoError(d.Close())
+
+	run := func(args ...string) string {
+		ob := &strings.Builder{}
+		code := 0
+		impl(append([]string{"--db=" + dir}, args...), strings.NewReader(""), ob, ob, func(c int) { code = c })
+		assert.Equal(0, code)
+		return ob.String()
+	}
+	run("put", "foo", `"bar"`)
+	run("put", "foo", `"baz"`)
+
+	var entries []logEntry
+	assert.NoError(json.Unmarshal([]byte(run("log", "--format=json")), &entries))
+	if !assert.Equal(3, len(entries)) {
+		return
+	}
+
+	assert.Equal("local", entries[0].Type)
+	assert.Equal(uint64(2), entries[0].MutationID)
+	assert.Equal(".putValue", entries[0].Name)
+	assert.Equal(`["foo","baz"]`, string(entries[0].Args))
+	assert.Equal("pending", entries[0].Status)
+	assert.NotNil(entries[0].Date)
+	assert.Equal([]keyChange{{Op: "change", Key: "foo", Old: json.RawMessage(`"bar"`), New: json.RawMessage(`"baz"`)}}, entries[0].Changes)
+
+	assert.Equal([]keyChange{{Op: "add", Key: "foo", New: json.RawMessage(`"bar"`)}}, entries[1].Changes)
+
+	assert.Equal(genesis, entries[2].Hash)
+	assert.Equal("snapshot", entries[2].Type)
+	assert.Equal(uint64(0), *entries[2].LastMutationID)
+	assert.Equal([]keyChange{}, entries[2].Changes)
+
+	entries = nil
+	assert.NoError(json.Unmarshal([]byte(run("log", "--format=json", "--limit=2", "--key=foo")), &entries))
+	assert.Equal(2, len(entries))
+}
+
+func TestLogConfirmed(t *testing.T) {
+	assert := assert.New(t)
+
+	// While truncate is set, only the first mutation of each push reaches the data
+	// layer, so the rest are replayed.
+	truncate := true
+	dl := datalayer.New(datalayer.DefaultConfig, ioutil.Discard)
+	dataLayer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if truncate && r.URL.Path == "/batch-push" {
+			var req db.BatchPushRequest
+			assert.NoError(json.NewDecoder(r.Body).Decode(&req))
+			req.Mutations = req.Mutations[:1]
+			b, err := json.Marshal(req)
+			assert.NoError(err)
+			r.Body = ioutil.NopCloser(bytes.NewReader(b))
+		}
+		dl.ServeHTTP(w, r)
+	}))
+	defer dataLayer.Close()
+	diffDir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	accounts := []diffserve.Account{{ID: "accountid", Name: "Test", ClientViewURL: dataLayer.URL + "/client-view"}}
+	diffServer := httptest.NewServer(diffserve.NewService(diffDir, accounts, "", diffserve.ClientViewGetter{}, false))
+	defer diffServer.Close()
+
+	td, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	run := func(args ...string) string {
+		ob := &strings.Builder{}
+		code := 0
+		impl(append([]string{"--db=" + td}, args...), strings.NewReader(""), ob, ob, func(c int) { code = c })
+		assert.Equal(0, code, ob.String())
+		return ob.String()
+	}
+	sync := func() string {
+		return run("sync", "--batch-push-url="+dataLayer.URL+"/batch-push", "--diff-server-url="+diffServer.URL+"/pull", "--diff-server-auth=accountid")
+	}
+	run("put", "foo", `"bar"`)
+	run("put", "baz", `1`)
+	assert.Regexp(`\nReplayed:\s+1\nPending:\s+1\n$`, sync())
+
+	var entries []logEntry
+	assert.NoError(json.Unmarshal([]byte(run("log", "--format=json")), &entries))
+	if !assert.Equal(4, len(entries)) {
+		return
+	}
+	assert.Equal(uint64(2), entries[0].MutationID)
+	assert.Equal("pending", entries[0].Status)
+	assert.NotEqual("", entries[0].Original)
+	assert.Equal(uint64(1), entries[1].MutationID)
+	assert.Equal("confirmed", entries[1].Status)
+	assert.Equal(entries[2].Hash, entries[1].ConfirmedBy)
+	assert.Equal([]keyChange{{Op: "add", Key: "foo", New: json.RawMessage(`"bar"`)}}, entries[1].Changes)
+	assert.Equal("snapshot", entries[2].Type)
+	assert.Equal(uint64(1), *entries[2].LastMutationID)
+	assert.Equal("snapshot", entries[3].Type)
+
+	out := run("log", "--no-pager")
+	assert.Contains(out, "Confirmed by: "+entries[2].Hash)
+	assert.NotContains(out, "Merged:")
+	assert.Equal(2, len(strings.Split(run("log", "--graph", "--no-pager", "--limit=2"), "\n"))-1)
+
+	// A sync that confirms all pending commits replays nothing. The confirmed
+	// commits are still shown, newest first, before the snapshot.
+	truncate = false
+	run("put", "qux", `true`)
+	assert.Regexp(`\nReplayed:\s+0\nPending:\s+0\n$`, sync())
+	entries = nil
+	assert.NoError(json.Unmarshal([]byte(run("log", "--format=json")), &entries))
+	if !assert.Equal(6, len(entries)) {
+		return
+	}
+	for i, id := range []uint64{3, 2} {
+		assert.Equal("local", entries[i].Type)
+		assert.Equal(id, entries[i].MutationID)
+		assert.Equal("confirmed", entries[i].Status)
+		assert.Equal(entries[2].Hash, entries[i].ConfirmedBy)
+	}
+	assert.Equal([]keyChange{{Op: "add", Key: "qux", New: json.RawMessage(`true`)}}, entries[0].Changes)
+	assert.Equal("snapshot", entries[2].Type)
+	assert.Equal(uint64(3), *entries[2].LastMutationID)
+	assert.Equal(uint64(1), entries[3].MutationID)
+	assert.Equal(entries[4].Hash, entries[3].ConfirmedBy)
+	assert.Contains(run("reflog"), entries[2].Hash+" synced from ")
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -13,7 +14,6 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/attic-labs/noms/go/diff"
 	"github.com/attic-labs/noms/go/spec"
 	"github.com/attic-labs/noms/go/types"
 	"github.com/attic-labs/noms/go/util/outputpager"
@@ -22,9 +22,8 @@ import (
 	zlog "github.com/rs/zerolog/log"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 
-	"roci.dev/diff-server/util/chk"
 	"roci.dev/diff-server/util/log"
-	"roci.dev/diff-server/util/noms/json"
+	nomsjson "roci.dev/diff-server/util/noms/json"
 	"roci.dev/diff-server/util/tbl"
 	rtime "roci.dev/diff-server/util/time"
 	"roci.dev/diff-server/util/version"
@@ -73,20 +72,20 @@ func impl(args []string, in io.Reader, out, errs io.Writer, exit func(int)) {
 	}
 
 	var rdb *db.DB
-	getDB := func() (db.DB, error) {
+	getDB := func() (*db.DB, error) {
 		if rdb != nil {
-			return *rdb, nil
+			return rdb, nil
 		}
 		sp, err := getSpec()
 		if err != nil {
-			return db.DB{}, err
+			return nil, err
 		}
 		r, err := db.Load(sp)
 		if err != nil {
-			return db.DB{}, err
+			return nil, err
 		}
 		rdb = r
-		return *r, nil
+		return r, nil
 	}
 	app.PreAction(func(pc *kingpin.ParseContext) error {
 		if *v {
@@ -138,13 +137,8 @@ func impl(args []string, in io.Reader, out, errs io.Writer, exit func(int)) {
 		return nil
 	})
 
-	has(app, getDB, out)
-	get(app, getDB, out)
-	scan(app, getDB, out, errs)
-	put(app, getDB, in, l)
-	del(app, getDB, out, l)
-	drop(app, getSpec, in, out)
-	logCmd(app, getDB, out)
+	registerCommands(app, getSpec, getDB, noTx, in, out, errs, l)
+	shell(app, getSpec, getDB, in, out, errs, l)
 
 	if len(args) == 0 {
 		app.Usage(args)
@@ -158,55 +152,126 @@ func impl(args []string, in io.Reader, out, errs io.Writer, exit func(int)) {
 	}
 }
 
-type gdb func() (db.DB, error)
+type gdb func() (*db.DB, error)
 type gsp func() (spec.Spec, error)
 
-func has(parent *kingpin.Application, gdb gdb, out io.Writer) {
+// gtx returns the transaction commands should run in, or nil if they should
+// run in a transaction of their own. Only the shell has open transactions.
+type gtx func() *db.Transaction
+
+func noTx() *db.Transaction {
+	return nil
+}
+
+// registerCommands registers the commands that operate on the database. They are
+// available both from the command line and in the shell.
+func registerCommands(app *kingpin.Application, gsp gsp, gdb gdb, gtx gtx, in io.Reader, out, errs io.Writer, l zl.Logger) {
+	format := app.Flag("format", "Output format of get, has, scan, log, diff, stats, watch and bench.").PlaceHolder("json|jsonl|noms|table").Enum(formatJSON, formatJSONL, formatNoms, formatTable)
+
+	has(app, gdb, gtx, format, out)
+	get(app, gdb, gtx, format, out)
+	scan(app, gdb, gtx, format, out, errs)
+	put(app, gdb, gtx, in, l)
+	putMany(app, gdb, gtx, in, out, l)
+	del(app, gdb, gtx, out, l)
+	drop(app, gsp, in, out)
+	logCmd(app, gdb, format, out)
+	stats(app, gsp, gdb, format, out)
+	syncCmd(app, gdb, out, l)
+	diffCmd(app, gdb, format, out)
+	reset(app, gdb, gtx, in, out)
+	reflog(app, gdb, out)
+	watchCmd(app, gdb, format, out)
+	bench(app, gdb, format, out, l)
+}
+
+// runTx runs f in the transaction returned by gtx if there is one. Otherwise it
+// runs f in a new transaction made by newTx, which is committed afterward if
+// write is true and f succeeds, and closed otherwise.
+func runTx(gtx gtx, newTx func() *db.Transaction, write bool, l zl.Logger, f func(tx *db.Transaction) error) error {
+	if tx := gtx(); tx != nil {
+		return f(tx)
+	}
+	tx := newTx()
+	if err := f(tx); err != nil || !write {
+		tx.Close()
+		return err
+	}
+	_, err := tx.Commit(l)
+	return err
+}
+
+func has(parent *kingpin.Application, gdb gdb, gtx gtx, format *string, out io.Writer) {
 	kc := parent.Command("has", "Check whether a key exists in the database.")
 	id := kc.Arg("key", "key of the value to check for").Required().String()
 	kc.Action(func(_ *kingpin.ParseContext) error {
-		db, err := gdb()
-		if err != nil {
-			return err
-		}
-		tx := db.NewTransaction()
-		defer tx.Close()
-		ok, err := tx.Has(*id)
+		d, err := gdb()
 		if err != nil {
 			return err
 		}
-		if ok {
-			out.Write([]byte("true\n"))
-		} else {
-			out.Write([]byte("false\n"))
-		}
-		return nil
+		return runTx(gtx, d.NewTransaction, false, zl.Nop(), func(tx *db.Transaction) error {
+			ok, err := tx.Has(*id)
+			if err != nil {
+				return err
+			}
+			switch *format {
+			case formatJSON, formatJSONL:
+				return writeJSON(out, ok)
+			case formatTable:
+				_, err = (&tbl.Table{}).Add(*id+": ", fmt.Sprintf("%t", ok)).WriteTo(out)
+				return err
+			}
+			if ok {
+				out.Write([]byte("true\n"))
+			} else {
+				out.Write([]byte("false\n"))
+			}
+			return nil
+		})
 	})
 }
 
-func get(parent *kingpin.Application, gdb gdb, out io.Writer) {
+func get(parent *kingpin.Application, gdb gdb, gtx gtx, format *string, out io.Writer) {
 	kc := parent.Command("get", "Reads a value from the database.")
 	id := kc.Arg("id", "id of the value to get").Required().String()
 	kc.Action(func(_ *kingpin.ParseContext) error {
-		db, err := gdb()
+		d, err := gdb()
 		if err != nil {
 			return err
 		}
-		tx := db.NewTransaction()
-		defer tx.Close()
-		v, err := tx.Get(*id)
-		if err != nil {
+		return runTx(gtx, d.NewTransaction, false, zl.Nop(), func(tx *db.Transaction) error {
+			v, err := tx.Get(*id)
+			if err != nil {
+				return err
+			}
+			if v == nil {
+				return nil
+			}
+			switch *format {
+			case formatJSON, formatJSONL:
+				return writeJSON(out, json.RawMessage(v))
+			case formatNoms:
+				nv, err := nomsjson.FromJSON(v, d.Noms())
+				if err != nil {
+					return err
+				}
+				_, err = fmt.Fprintln(out, types.EncodedValue(nv))
+				return err
+			case formatTable:
+				c, err := compactJSON(v)
+				if err != nil {
+					return err
+				}
+				_, err = (&tbl.Table{}).Add(*id+": ", string(c)).WriteTo(out)
+				return err
+			}
+			_, err = out.Write(v)
 			return err
-		}
-		if v == nil {
-			return nil
-		}
-		_, err = out.Write(v)
-		return err
+		})
 	})
 }
 
-func scan(parent *kingpin.Application, gdb gdb, out, errs io.Writer) {
+func scan(parent *kingpin.Application, gdb gdb, gtx gtx, format *string, out, errs io.Writer) {
 	kc := parent.Command("scan", "Scans values in-order from the database.")
 	opts := db.ScanOptions{
 		Start: &db.ScanBound{
@@ -220,76 +285,105 @@ func scan(parent *kingpin.Application, gdb gdb, out, errs io.Writer) {
 	kc.Flag("start-index", "id of the value to start scanning at").Uint64Var(opts.Start.Index)
 	kc.Flag("limit", "maximum number of items to return").IntVar(&opts.Limit)
 	kc.Action(func(_ *kingpin.ParseContext) error {
-		db, err := gdb()
+		d, err := gdb()
 		if err != nil {
 			return err
 		}
-		tx := db.NewTransaction()
-		defer tx.Close()
-		items, err := tx.Scan(opts)
-		if err != nil {
-			fmt.Fprintln(errs, err)
+		return runTx(gtx, d.NewTransaction, false, zl.Nop(), func(tx *db.Transaction) error {
+			items, err := tx.Scan(opts)
+			if err != nil {
+				fmt.Fprintln(errs, err)
+				return nil
+			}
+
+			// scanEntry is an item in the JSON formats.
+			type scanEntry struct {
+				Key   string          `json:"key"`
+				Value json.RawMessage `json:"value"`
+			}
+			entries := make([]scanEntry, 0, len(items))
+			table := &tbl.Table{}
+			for _, it := range items {
+				switch *format {
+				case formatJSON, formatJSONL, formatTable:
+					v, err := valueJSON(it.Value.Value)
+					if err != nil {
+						return err
+					}
+					entries = append(entries, scanEntry{it.Key, v})
+					table.Add(it.Key+": ", string(v))
+				default:
+					fmt.Fprintf(out, "%s: %s\n", it.Key, types.EncodedValue(it.Value.Value))
+				}
+			}
+			switch *format {
+			case formatJSON:
+				return writeJSON(out, entries)
+			case formatJSONL:
+				for _, e := range entries {
+					if err := writeJSON(out, e); err != nil {
+						return err
+					}
+				}
+			case formatTable:
+				_, err = table.WriteTo(out)
+				return err
+			}
 			return nil
-		}
-		for _, it := range items {
-			fmt.Fprintf(out, "%s: %s\n", it.Key, types.EncodedValue(it.Value.Value))
-		}
-		return nil
+		})
 	})
 }
 
-func put(parent *kingpin.Application, gdb gdb, in io.Reader, l zl.Logger) {
+func put(parent *kingpin.Application, gdb gdb, gtx gtx, in io.Reader, l zl.Logger) {
 	kc := parent.Command("put", "Reads a JSON-formated value from stdin and puts it into the database.")
 	id := kc.Arg("key", "key of the value to put").Required().String()
+	value := kc.Arg("value", "JSON-formatted value to put, instead of reading it from stdin").String()
 	kc.Action(func(_ *kingpin.ParseContext) error {
-		db, err := gdb()
+		d, err := gdb()
 		if err != nil {
 			return err
 		}
 		var v bytes.Buffer
-		if _, err := v.ReadFrom(in); err != nil {
+		if *value != "" {
+			v.WriteString(*value)
+		} else if _, err := v.ReadFrom(in); err != nil {
 			return err
 		}
 
 		data := v.Bytes()
-		val, err := json.FromJSON(data, db.Noms())
+		val, err := nomsjson.FromJSON(data, d.Noms())
 		if err != nil {
 			return fmt.Errorf("could not parse value \"%s\" as json: %s", data, err)
 		}
-		args := types.NewList(db.Noms(), types.String(*id), val)
-		tx := db.NewTransactionWithArgs(".putValue", args, nil, nil)
-
-		err = tx.Put(*id, data)
-		if err == nil {
-			_, err = tx.Commit(l)
-		} else {
-			tx.Close()
+		args := types.NewList(d.Noms(), types.String(*id), val)
+		newTx := func() *db.Transaction {
+			return d.NewTransactionWithArgs(".putValue", args, nil, nil)
 		}
-		return err
+		return runTx(gtx, newTx, true, l, func(tx *db.Transaction) error {
+			return tx.Put(*id, data)
+		})
 	})
 }
 
-func del(parent *kingpin.Application, gdb gdb, out io.Writer, l zl.Logger) {
+func del(parent *kingpin.Application, gdb gdb, gtx gtx, out io.Writer, l zl.Logger) {
 	kc := parent.Command("del", "Deletes an item from the cache.")
 	id := kc.Arg("id", "id of the value to delete").Required().String()
 	kc.Action(func(_ *kingpin.ParseContext) error {
-		db, err := gdb()
+		d, err := gdb()
 		if err != nil {
 			return err
 		}
-		args := types.NewList(db.Noms(), types.String(*id))
-		tx := db.NewTransactionWithArgs(".delValue", args, nil, nil)
-
-		ok, err := tx.Del(*id)
-		if err == nil && !ok {
-			out.Write([]byte("No such id.\n"))
-		}
-		if err == nil {
-			_, err = tx.Commit(l)
-		} else {
-			tx.Close()
+		args := types.NewList(d.Noms(), types.String(*id))
+		newTx := func() *db.Transaction {
+			return d.NewTransactionWithArgs(".delValue", args, nil, nil)
 		}
-		return err
+		return runTx(gtx, newTx, true, l, func(tx *db.Transaction) error {
+			ok, err := tx.Del(*id)
+			if err == nil && !ok {
+				out.Write([]byte("No such id.\n"))
+			}
+			return err
+		})
 	})
 }
 
@@ -319,77 +413,81 @@ func drop(parent *kingpin.Application, gsp gsp, in io.Reader, out io.Writer) {
 	})
 }
 
-func logCmd(parent *kingpin.Application, gdb gdb, out io.Writer) {
-	kc := parent.Command("log", "Displays the recent history of the cache.")
-	np := kc.Flag("no-pager", "supress paging functionality").Bool()
-
+func stats(parent *kingpin.Application, gsp gsp, gdb gdb, format *string, out io.Writer) {
+	kc := parent.Command("stats", "Displays statistics about the database.")
 	kc.Action(func(_ *kingpin.ParseContext) error {
 		d, err := gdb()
 		if err != nil {
 			return err
 		}
-		c := d.Head()
-
-		if !*np {
-			pgr := outputpager.Start()
-			defer pgr.Stop()
-			out = pgr.Writer
+		s, err := d.Stats(true)
+		if err != nil {
+			return err
 		}
 
-		for {
-			if c.Type() == db.CommitTypeSnapshot {
-				break
-			}
-
-			getStatus := func() (r string, mergedTime time.Time) {
-				r = "PENDING"
-
-				switch c.Type() {
-				case db.CommitTypeLocal:
-					mergedTime = c.Meta.Local.Date.Time
-				default:
-					chk.Fail("unexpected commit type")
-				}
-
-				return
-			}
-
-			getTx := func() string {
-				return fmt.Sprintf("%s(%s)", c.Meta.Local.Name, types.EncodedValue(c.Meta.Local.Args))
-			}
-
-			fmt.Fprintln(out, color("commit "+c.NomsStruct.Hash().String(), "red+h"))
-			table := (&tbl.Table{}).
-				Add("Created: ", rtime.String(c.Meta.Local.Date.Time))
-
-			status, t := getStatus()
-			table.Add("Status: ", status)
-			if t != (time.Time{}) {
-				table.Add("Merged: ", rtime.String(t))
-			}
-
-			table.Add("Transaction: ", getTx())
-
-			_, err = table.WriteTo(out)
+		sp, err := gsp()
+		if err != nil {
+			return err
+		}
+		var size *int64
+		if sp.Protocol == "nbs" {
+			n, err := db.DirSize(sp.DatabaseName)
 			if err != nil {
 				return err
 			}
-
-			basis, err := c.Basis(d.Noms())
-			if err != nil {
-				return err
+			size = &n
+		}
+
+		var lastSync *time.Time
+		if !s.LastSync.IsZero() {
+			lastSync = &s.LastSync
+		}
+
+		switch *format {
+		case formatJSON, formatJSONL:
+			return writeJSON(out, struct {
+				Keys              uint64     `json:"keys"`
+				PendingMutations  int        `json:"pendingMutations"`
+				ServerStateID     string     `json:"serverStateId"`
+				LastSync          *time.Time `json:"lastSync"`
+				CommitChainLength int        `json:"commitChainLength"`
+				Chunks            int        `json:"chunks"`
+				SizeOnDisk        *int64     `json:"sizeOnDisk,omitempty"`
+			}{s.Keys, s.PendingMutations, s.ServerStateID, lastSync, s.CommitChainLength, s.Chunks, size})
+		case formatNoms:
+			data := types.StructData{
+				"keys":              types.Number(s.Keys),
+				"pendingMutations":  types.Number(s.PendingMutations),
+				"serverStateID":     types.String(s.ServerStateID),
+				"commitChainLength": types.Number(s.CommitChainLength),
+				"chunks":            types.Number(s.Chunks),
 			}
-
-			err = diff.PrintDiff(out, basis.Data(d.Noms()).NomsMap(), c.Data(d.Noms()).NomsMap(), false)
-			if err != nil {
-				return err
+			if lastSync != nil {
+				data["lastSync"] = types.String(lastSync.Format(time.RFC3339Nano))
 			}
-
-			fmt.Fprintln(out, "")
-			c = basis
+			if size != nil {
+				data["sizeOnDisk"] = types.Number(*size)
+			}
+			_, err = fmt.Fprintln(out, types.EncodedValue(types.NewStruct("Stats", data)))
+			return err
 		}
 
-		return nil
+		lastSyncText := "never"
+		if lastSync != nil {
+			lastSyncText = rtime.String(*lastSync)
+		}
+		table := (&tbl.Table{}).
+			Add("Keys: ", fmt.Sprintf("%d", s.Keys)).
+			Add("Pending mutations: ", fmt.Sprintf("%d", s.PendingMutations)).
+			Add("Server state ID: ", s.ServerStateID).
+			Add("Last sync: ", lastSyncText).
+			Add("Commit chain length: ", fmt.Sprintf("%d", s.CommitChainLength)).
+			Add("Chunks: ", fmt.Sprintf("%d", s.Chunks))
+		if size != nil {
+			table.Add("Size on disk: ", fmt.Sprintf("%d bytes", *size))
+		}
+		_, err = table.WriteTo(out)
+		return err
 	})
 }
 
@@ -22,8 +22,16 @@ func TestCommands(t *testing.T) {
 	fmt.Println("test database:", td)
 	assert.NoError(err)
 
-	commitA := "commit 0edk63ktqf2m2oj9jrsge5mlk7bl39gp\nCreated:     2014-01-24 00:00:00 -1000 HST\nStatus:      PENDING\nMerged:      2014-01-24 00:00:00 -1000 HST\nTransaction: .putValue([\n  \"foo\",\n  \"bar\",\n])\n(root) {\n+   \"foo\": \"bar\"\n  }\n\n"
-	commitB := "commit 4mim1hir8ss5cmq09v886k75h7ru19o9\nCreated:     2014-01-24 00:00:00 -1000 HST\nStatus:      PENDING\nMerged:      2014-01-24 00:00:00 -1000 HST\nTransaction: .delValue([\n  \"foo\",\n])\n(root) {\n-   \"foo\": \"bar\"\n  }\n\n"
+	sp, err := spec.ForDatabase(td)
+	assert.NoError(err)
+	d, err := db.Load(sp)
+	assert.NoError(err)
+	genesisHash := d.Head().NomsStruct.Hash().String()
+	assert.NoError(d.Close())
+	genesis := "commit " + genesisHash + "\nStatus:        SNAPSHOT\nServer state:  none\nLast mutation: 0\n\n"
+
+	commitA := "commit 0edk63ktqf2m2oj9jrsge5mlk7bl39gp\nCreated:     2014-01-24 00:00:00 -1000 HST\nStatus:      PENDING\nTransaction: .putValue([\n  \"foo\",\n  \"bar\",\n])\n(root) {\n+   \"foo\": \"bar\"\n  }\n\n"
+	commitB := "commit 4mim1hir8ss5cmq09v886k75h7ru19o9\nCreated:     2014-01-24 00:00:00 -1000 HST\nStatus:      PENDING\nTransaction: .delValue([\n  \"foo\",\n])\n(root) {\n-   \"foo\": \"bar\"\n  }\n\n"
 
 	tc := []struct {
 		label string
@@ -38,7 +46,7 @@ func TestCommands(t *testing.T) {
 			"",
 			"log --no-pager",
 			0,
-			"",
+			genesis,
 			"",
 		},
 		{
@@ -70,8 +78,56 @@ func TestCommands(t *testing.T) {
 			"",
 			"log --no-pager",
 			0,
-			commitA,
+			commitA + genesis,
+			"",
+		},
+		{
+			"diff put good",
+			"",
+			"diff head~1 head",
+			0,
+			"+ foo: \"bar\"\n",
+			"",
+		},
+		{
+			"diff json",
+			"",
+			"diff snapshot head --format=json",
+			0,
+			"[{\"op\":\"add\",\"key\":\"foo\",\"new\":\"bar\"}]\n",
+			"",
+		},
+		{
+			"diff jsonl",
+			"",
+			"diff snapshot head --format=jsonl",
+			0,
+			"{\"op\":\"add\",\"key\":\"foo\",\"new\":\"bar\"}\n",
+			"",
+		},
+		{
+			"diff too far back",
+			"",
+			"diff head~2 head",
+			1,
+			"",
+			"invalid commit head~2: history is only 2 commits long\n",
+		},
+		{
+			"diff bad commit",
 			"",
+			"diff foo head",
+			1,
+			"",
+			"invalid commit foo: not a hash, head or snapshot\n",
+		},
+		{
+			"diff bad ancestor",
+			"",
+			"diff head~x head",
+			1,
+			"",
+			"invalid commit head~x: ~ must be followed by a number\n",
 		},
 		{
 			"has missing-arg",
@@ -201,14 +257,72 @@ func TestCommands(t *testing.T) {
 			"",
 			"",
 		},
+		{
+			"diff del good",
+			"",
+			"diff head~1 head --prefix=f",
+			0,
+			"- foo: \"bar\"\n",
+			"",
+		},
+		{
+			"diff del prefix",
+			"",
+			"diff 0edk63ktqf2m2oj9jrsge5mlk7bl39gp head --prefix=g",
+			0,
+			"",
+			"",
+		},
+		{
+			"diff no change",
+			"",
+			"diff head~2 head",
+			0,
+			"",
+			"",
+		},
 		{
 			"log del good",
 			"",
 			"log --no-pager",
 			0,
+			commitB + commitA + genesis,
+			"",
+		},
+		{
+			"log limit",
+			"",
+			"log --no-pager --limit=1",
+			0,
+			commitB,
+			"",
+		},
+		{
+			"log key",
+			"",
+			"log --no-pager --key=foo",
+			0,
 			commitB + commitA,
 			"",
 		},
+		{
+			"log key untouched",
+			"",
+			"log --no-pager --key=bar",
+			0,
+			"",
+			"",
+		},
+		{
+			"log graph",
+			"",
+			"log --no-pager --graph",
+			0,
+			"* 4mim1hir8ss5cmq09v886k75h7ru19o9 2 .delValue([\"foo\"]) pending\n" +
+				"* 0edk63ktqf2m2oj9jrsge5mlk7bl39gp 1 .putValue([\"foo\",\"bar\"]) pending\n" +
+				"o " + genesisHash + " snapshot none (last mutation 0)\n",
+			"",
+		},
 	}
 
 	for _, c := range tc {
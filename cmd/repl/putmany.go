@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/attic-labs/noms/go/types"
+	zl "github.com/rs/zerolog"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+
+	nomsjson "roci.dev/diff-server/util/noms/json"
+	"roci.dev/diff-server/util/tbl"
+	"roci.dev/replicache-client/db"
+)
+
+// putManyOp is a record of put-many's JSONL input. It either puts value at key,
+// or deletes key.
+type putManyOp struct {
+	Key    *string         `json:"key"`
+	Value  json.RawMessage `json:"value"`
+	Delete bool            `json:"delete"`
+}
+
+func putMany(parent *kingpin.Application, gdb gdb, gtx gtx, in io.Reader, out io.Writer, l zl.Logger) {
+	kc := parent.Command("put-many", "Puts and deletes many keys in a single commit. "+
+		`The input is either a JSON object that maps keys to the values to put, or JSONL records like {"key": "foo", "value": 42} and {"key": "bar", "delete": true}. `+
+		`The commit is a .putMany mutation, whose args are the ops as a list like [["foo", 42], ["bar"]].`)
+	file := kc.Arg("file", "file to read the input from, instead of stdin").ExistingFile()
+	jsonl := kc.Flag("jsonl", "read the input as JSONL records, even if it is a single JSON object").Bool()
+	dryRun := kc.Flag("dry-run", "print the changes the commit would make instead of committing").Bool()
+	kc.Action(func(_ *kingpin.ParseContext) error {
+		r := in
+		if *file != "" {
+			f, err := os.Open(*file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		ops, err := readPutManyOps(r, *jsonl)
+		if err != nil {
+			return err
+		}
+		d, err := gdb()
+		if err != nil {
+			return err
+		}
+
+		table := &tbl.Table{}
+		if *dryRun {
+			if gtx() != nil {
+				// The ops would be applied to the open transaction.
+				return errors.New("cannot dry-run in an open transaction")
+			}
+			tx := d.NewTransaction()
+			defer tx.Close()
+			changes, err := applyPutManyOps(tx, ops, table, true)
+			if err != nil {
+				return err
+			}
+			printChanges(out, changes)
+			_, err = table.WriteTo(out)
+			return err
+		}
+
+		args, err := putManyArgs(d.Noms(), ops)
+		if err != nil {
+			return err
+		}
+		newTx := func() *db.Transaction {
+			return d.NewTransactionWithArgs(".putMany", args, nil, nil)
+		}
+		head := d.HeadHash()
+		err = runTx(gtx, newTx, true, l, func(tx *db.Transaction) error {
+			_, err := applyPutManyOps(tx, ops, table, false)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if gtx() == nil {
+			if h := d.HeadHash(); h != head {
+				table.Add("Commit: ", h.String())
+			} else {
+				table.Add("Commit: ", "none, nothing changed")
+			}
+		}
+		_, err = table.WriteTo(out)
+		return err
+	})
+}
+
+// readPutManyOps reads the input of put-many. A single JSON object is read as a
+// map from keys to values, unless jsonl is true.
+func readPutManyOps(r io.Reader, jsonl bool) ([]putManyOp, error) {
+	dec := json.NewDecoder(r)
+	var records []json.RawMessage
+	for {
+		var rec json.RawMessage
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("could not parse record %d: %s", len(records)+1, err)
+		}
+		records = append(records, rec)
+	}
+	if len(records) == 0 {
+		return nil, errors.New("no input")
+	}
+
+	if len(records) == 1 && !jsonl {
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(records[0], &m); err != nil {
+			return nil, fmt.Errorf("input must be a JSON object or JSONL records: %s", err)
+		}
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		ops := make([]putManyOp, 0, len(keys))
+		for _, k := range keys {
+			k := k
+			ops = append(ops, putManyOp{Key: &k, Value: m[k]})
+		}
+		return ops, nil
+	}
+
+	ops := make([]putManyOp, 0, len(records))
+	for i, rec := range records {
+		var op putManyOp
+		dec := json.NewDecoder(bytes.NewReader(rec))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&op); err != nil {
+			return nil, fmt.Errorf("invalid record %d: %s", i+1, err)
+		}
+		if op.Key == nil {
+			return nil, fmt.Errorf("invalid record %d: no key", i+1)
+		}
+		if op.Delete == (op.Value != nil) {
+			return nil, fmt.Errorf("invalid record %d: must have either a value or delete", i+1)
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// putManyArgs returns the args of the .putMany mutation that applies ops: a
+// list of ops, each either [key, value] to put value at key or [key] to delete
+// key.
+func putManyArgs(noms types.ValueReadWriter, ops []putManyOp) (types.Value, error) {
+	list := make([][]json.RawMessage, 0, len(ops))
+	for _, op := range ops {
+		k, err := json.Marshal(*op.Key)
+		if err != nil {
+			return nil, err
+		}
+		if op.Delete {
+			list = append(list, []json.RawMessage{k})
+		} else {
+			list = append(list, []json.RawMessage{k, op.Value})
+		}
+	}
+	b, err := json.Marshal(list)
+	if err != nil {
+		return nil, err
+	}
+	return nomsjson.FromJSON(b, noms)
+}
+
+// parsePutManyArgs parses the args of a .putMany mutation into ops.
+func parsePutManyArgs(args json.RawMessage) ([]putManyOp, error) {
+	var list [][]json.RawMessage
+	if err := json.Unmarshal(args, &list); err != nil {
+		return nil, err
+	}
+	ops := make([]putManyOp, 0, len(list))
+	for _, a := range list {
+		if len(a) == 0 || len(a) > 2 {
+			return nil, fmt.Errorf("op must be [key, value] or [key], got %d elements", len(a))
+		}
+		var key string
+		if err := json.Unmarshal(a[0], &key); err != nil {
+			return nil, err
+		}
+		op := putManyOp{Key: &key}
+		if len(a) == 2 {
+			op.Value = a[1]
+		} else {
+			op.Delete = true
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// putOps applies ops to tx.
+func putOps(tx *db.Transaction, ops []putManyOp) error {
+	for _, op := range ops {
+		var err error
+		if op.Delete {
+			_, err = tx.Del(*op.Key)
+		} else {
+			err = tx.Put(*op.Key, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyPutManyOps applies ops to tx and adds the counts of puts and deletes to
+// table. If diff is true, it returns the changes the ops make to tx.
+func applyPutManyOps(tx *db.Transaction, ops []putManyOp, table *tbl.Table, diff bool) ([]keyChange, error) {
+	// old has the values of the changed keys before the ops, nil if missing.
+	old := map[string]json.RawMessage{}
+	put, deleted, missing := 0, 0, 0
+	for _, op := range ops {
+		key := *op.Key
+		if _, ok := old[key]; !ok && diff {
+			v, err := tx.Get(key)
+			if err != nil {
+				return nil, err
+			}
+			old[key] = v
+		}
+		if op.Delete {
+			ok, err := tx.Del(key)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				deleted++
+			} else {
+				missing++
+			}
+			continue
+		}
+		if err := tx.Put(key, op.Value); err != nil {
+			return nil, err
+		}
+		put++
+	}
+	table.Add("Put: ", fmt.Sprintf("%d", put))
+	table.Add("Deleted: ", fmt.Sprintf("%d", deleted))
+	if missing > 0 {
+		table.Add("Not found: ", fmt.Sprintf("%d", missing))
+	}
+	if !diff {
+		return nil, nil
+	}
+
+	keys := make([]string, 0, len(old))
+	for k := range old {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	changes := []keyChange{}
+	for _, k := range keys {
+		v, err := tx.Get(k)
+		if err != nil {
+			return nil, err
+		}
+		c := keyChange{Key: k}
+		if c.Old, err = compactOrNil(old[k]); err != nil {
+			return nil, err
+		}
+		if c.New, err = compactOrNil(v); err != nil {
+			return nil, err
+		}
+		switch {
+		case c.Old == nil && c.New == nil, bytes.Equal(c.Old, c.New):
+			continue
+		case c.Old == nil:
+			c.Op = "add"
+		case c.New == nil:
+			c.Op = "remove"
+		default:
+			c.Op = "change"
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+func compactOrNil(v []byte) (json.RawMessage, error) {
+	if v == nil {
+		return nil, nil
+	}
+	return compactJSON(v)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPutMany(t *testing.T) {
+	assert := assert.New(t)
+
+	td, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	run := func(in string, args ...string) (int, string, string) {
+		ob := &strings.Builder{}
+		eb := &strings.Builder{}
+		code := 0
+		impl(append([]string{"--db=" + td}, args...), strings.NewReader(in), ob, eb, func(c int) { code = c })
+		return code, ob.String(), eb.String()
+	}
+
+	code, out, errs := run(`{"b": 2, "a": {"x": 1}}`, "put-many")
+	assert.Equal(0, code)
+	assert.Equal("", errs)
+	assert.Regexp(`^Put:     2\nDeleted: 0\nCommit:  \w{32}\n$`, out)
+
+	ops := `{"key": "a", "delete": true}
+{"key": "c", "value": "new"}
+{"key": "b", "value": 2}
+{"key": "zz", "delete": true}
+`
+	code, out, errs = run(ops, "put-many", "--dry-run")
+	assert.Equal(0, code)
+	assert.Equal("", errs)
+	assert.Equal("- a: {\"x\":1}\n+ c: \"new\"\nPut:       2\nDeleted:   1\nNot found: 1\n", out)
+	_, out, _ = run("", "get", "a")
+	assert.Equal(`{"x":1}`, strings.TrimSpace(out))
+
+	// The input can also come from a file.
+	f, err := ioutil.TempFile("", "")
+	assert.NoError(err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(ops)
+	assert.NoError(err)
+	assert.NoError(f.Close())
+	code, out, errs = run("", "put-many", f.Name())
+	assert.Equal(0, code)
+	assert.Equal("", errs)
+	assert.Regexp(`^Put:       2\nDeleted:   1\nNot found: 1\nCommit:    \w{32}\n$`, out)
+	_, out, _ = run("", "scan", "--format=jsonl")
+	assert.Equal(`{"key":"b","value":2}`+"\n"+`{"key":"c","value":"new"}`+"\n", out)
+	_, out, _ = run("", "log", "--graph", "--no-pager")
+	assert.Equal(3, strings.Count(out, "\n"))
+
+	code, out, errs = run(`{"key": "zz", "delete": true}`, "put-many", "--jsonl")
+	assert.Equal(0, code)
+	assert.Equal("", errs)
+	assert.Equal("Put:       0\nDeleted:   0\nNot found: 1\nCommit:    none, nothing changed\n", out)
+
+	tc := []struct {
+		in   string
+		args string
+		err  string
+	}{
+		{"", "put-many", "no input\n"},
+		{`{"a": 1} {`, "put-many", "could not parse record 2: unexpected EOF\n"},
+		{`{"key": "a"}`, "put-many --jsonl", "invalid record 1: must have either a value or delete\n"},
+		{`{"key": "a", "value": 1, "delete": true}`, "put-many --jsonl", "invalid record 1: must have either a value or delete\n"},
+		{`{"key": "a", "value": 1}` + "\n" + `{"value": 1}`, "put-many", "invalid record 2: no key\n"},
+		{`{"key": "a", "value": 1}` + "\n" + `{"key": "b", "valu": 1}`, "put-many", "invalid record 2: json: unknown field \"valu\"\n"},
+		{"", "put-many /does/not/exist", "path '/does/not/exist' does not exist\n"},
+	}
+	for _, c := range tc {
+		code, out, errs := run(c.in, strings.Split(c.args, " ")...)
+		assert.Equal(1, code, c.in)
+		assert.Equal("", out, c.in)
+		assert.Equal(c.err, errs, c.in)
+	}
+}
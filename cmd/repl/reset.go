@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+
+	rtime "roci.dev/diff-server/util/time"
+	"roci.dev/replicache-client/db"
+)
+
+const (
+	resetWarning = "This moves master to commit %s and discards %s. The current head %s is kept in the reflog. Proceed? y/n\n"
+)
+
+func reset(parent *kingpin.Application, gdb gdb, gtx gtx, in io.Reader, out io.Writer) {
+	kc := parent.Command("reset", "Moves master to an earlier commit, discarding the commits after it. "+
+		"Without --hard only pending local commits can be discarded. Every reset is recorded in the reflog, see the reflog command.")
+	ref := kc.Arg("commit", "commit to reset to, by hash or as head~N or snapshot~N").Required().String()
+	hard := kc.Flag("hard", "allow discarding snapshots, and resetting to commits that are not in the history of head, eg to undo a reset").Bool()
+
+	r := bufio.NewReader(in)
+	w := bufio.NewWriter(out)
+	kc.Action(func(_ *kingpin.ParseContext) error {
+		if gtx() != nil {
+			return errors.New("cannot reset with an open transaction")
+		}
+		d, err := gdb()
+		if err != nil {
+			return err
+		}
+		to, err := resolveCommit(d, *ref)
+		if err != nil {
+			return err
+		}
+		head := d.Head()
+		if head.NomsStruct.Equals(to.NomsStruct) {
+			fmt.Fprintf(out, "Already at %s.\n", to.Ref().TargetHash())
+			return nil
+		}
+
+		// Find the commits that are discarded, ie those between head and to.
+		var discarded []db.Commit
+		found := false
+		for c := head; ; {
+			if c.NomsStruct.Equals(to.NomsStruct) {
+				found = true
+				break
+			}
+			discarded = append(discarded, c)
+			if len(c.Parents) == 0 {
+				break
+			}
+			if c, err = c.Basis(d.Noms()); err != nil {
+				return err
+			}
+		}
+
+		what := fmt.Sprintf("%d commits", len(discarded))
+		if len(discarded) == 1 {
+			what = "1 commit"
+		}
+		if !found {
+			if !*hard {
+				return fmt.Errorf("commit %s is not in the history of head, resetting to it needs --hard", *ref)
+			}
+			what = "the current history"
+		}
+		if !*hard {
+			for _, c := range discarded {
+				if c.Type() == db.CommitTypeSnapshot {
+					return fmt.Errorf("resetting to %s discards snapshot %s, which needs --hard", *ref, c.Ref().TargetHash())
+				}
+			}
+		}
+
+		fmt.Fprintf(w, resetWarning, to.Ref().TargetHash(), what, head.Ref().TargetHash())
+		w.Flush()
+		answer, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		answer = strings.TrimSpace(answer)
+		if answer != "y" {
+			return nil
+		}
+		return d.Reset(to)
+	})
+}
+
+func reflog(parent *kingpin.Application, gdb gdb, out io.Writer) {
+	kc := parent.Command("reflog", "Lists the resets of master and the syncs that confirmed local commits, most recent first. Reset to the previous head of an entry to undo it.")
+	kc.Action(func(_ *kingpin.ParseContext) error {
+		d, err := gdb()
+		if err != nil {
+			return err
+		}
+		entries, err := d.Reflog()
+		if err != nil {
+			return err
+		}
+		for i := len(entries) - 1; i >= 0; i-- {
+			e := entries[i]
+			move := "reset"
+			if e.Sync {
+				move = "synced"
+			}
+			fmt.Fprintf(out, "%s %s from %s at %s\n", e.To.TargetHash(), move, e.From.TargetHash(), rtime.String(e.Date.Time))
+		}
+		return nil
+	})
+}
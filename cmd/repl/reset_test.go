@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/util/log"
+	"roci.dev/diff-server/util/time"
+	"roci.dev/replicache-client/db"
+)
+
+func TestReset(t *testing.T) {
+	assert := assert.New(t)
+	defer time.SetFake()()
+
+	d, dir := db.LoadTempDB(assert)
+	genesis := d.HeadHash().String()
+	for _, k := range []string{"foo", "bar"} {
+		tx := d.NewTransaction()
+		assert.NoError(tx.Put(k, []byte(`true`)))
+		_, err := tx.Commit(log.Default())
+		assert.NoError(err)
+	}
+	b := d.HeadHash().String()
+	a := d.Head().BasisRef().TargetHash().String()
+
+	tc := []struct {
+		label string
+		in    string
+		args  string
+		code  int
+		out   string
+		err   string
+		head  string
+	}{
+		{"already there", "", "reset head", 0, "Already at " + b + ".\n", "", b},
+		{"declined", "n\n", "reset head~1", 0, fmt.Sprintf(resetWarning, a, "1 commit", b), "", b},
+		{"accepted", "y\n", "reset head~1", 0, fmt.Sprintf(resetWarning, a, "1 commit", b), "", a},
+		{"to genesis", "y\n", "reset " + genesis, 0, fmt.Sprintf(resetWarning, genesis, "1 commit", a), "", genesis},
+		{"not in history", "y\n", "reset " + b, 1, "", "commit " + b + " is not in the history of head, resetting to it needs --hard\n", genesis},
+		{"undo", "y\n", "reset --hard " + b, 0, fmt.Sprintf(resetWarning, b, "the current history", genesis), "", b},
+		{"too far back", "", "reset head~3", 1, "", "invalid commit head~3: history is only 3 commits long\n", b},
+		{"reflog", "", "reflog", 0,
+			b + " reset from " + genesis + " at 2014-01-24 00:00:00 -1000 HST\n" +
+				genesis + " reset from " + a + " at 2014-01-24 00:00:00 -1000 HST\n" +
+				a + " reset from " + b + " at 2014-01-24 00:00:00 -1000 HST\n",
+			"", b},
+	}
+
+	for _, c := range tc {
+		ob := &strings.Builder{}
+		eb := &strings.Builder{}
+		code := 0
+		args := append([]string{"--db=" + dir}, strings.Split(c.args, " ")...)
+		impl(args, strings.NewReader(c.in), ob, eb, func(c int) {
+			code = c
+		})
+
+		assert.Equal(c.code, code, c.label)
+		assert.Equal(c.out, ob.String(), c.label)
+		assert.Equal(c.err, eb.String(), c.label)
+		assert.NoError(d.Reload())
+		assert.Equal(c.head, d.HeadHash().String(), c.label)
+	}
+}
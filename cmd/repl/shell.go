@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	zl "github.com/rs/zerolog"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+
+	"roci.dev/replicache-client/db"
+)
+
+// keyCommands are the commands whose first argument is a key, for completion.
+var keyCommands = map[string]bool{
+	"has": true,
+	"get": true,
+	"put": true,
+	"del": true,
+}
+
+// maxCompletions limits the number of keys offered for completion.
+const maxCompletions = 100
+
+func shell(parent *kingpin.Application, gsp gsp, gdb gdb, in io.Reader, out, errs io.Writer, l zl.Logger) {
+	kc := parent.Command("shell", "Starts an interactive shell that keeps the database open. "+
+		"All commands are available, plus begin, commit and rollback to run several commands in one transaction.")
+	kc.Action(func(_ *kingpin.ParseContext) error {
+		d, err := gdb()
+		if err != nil {
+			return err
+		}
+		s := &shellState{d: d, gsp: gsp, out: out, errs: errs, l: l}
+		s.lr = newLineReader(in, out, s.complete)
+		return s.run()
+	})
+}
+
+type shellState struct {
+	d    *db.DB
+	gsp  gsp
+	lr   *lineReader
+	out  io.Writer
+	errs io.Writer
+	l    zl.Logger
+	// tx is the transaction opened with begin, nil if there is none.
+	tx *db.Transaction
+}
+
+func (s *shellState) run() error {
+	for {
+		prompt := "repl> "
+		if s.tx != nil {
+			prompt = "repl(tx)> "
+		}
+		line, err := s.lr.readLine(prompt)
+		if err == io.EOF {
+			if s.tx != nil {
+				s.tx.Close()
+				fmt.Fprintln(s.errs, "Rolled back open transaction.")
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		args, err := splitArgs(line)
+		if err != nil {
+			fmt.Fprintln(s.errs, err)
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "exit" || args[0] == "quit" {
+			args = []string{"exit"}
+		}
+		if s.exec(args) {
+			return nil
+		}
+	}
+}
+
+// exec runs the command line args. It returns true if the shell should exit.
+func (s *shellState) exec(args []string) (exit bool) {
+	// Commands register their flags and arguments on the app, so each line gets a
+	// fresh one to not inherit values from the previous line.
+	app := kingpin.New("", "Replicache shell")
+	app.ErrorWriter(s.errs)
+	app.UsageWriter(s.out)
+	app.Terminate(nil)
+
+	getDB := func() (*db.DB, error) {
+		return s.d, nil
+	}
+	getTx := func() *db.Transaction {
+		return s.tx
+	}
+	registerCommands(app, s.gsp, getDB, getTx, &lineReaderInput{lr: s.lr}, s.out, s.errs, s.l)
+
+	begin := app.Command("begin", "Opens a transaction that following commands run in until commit or rollback.")
+	commit := app.Command("commit", "Commits the open transaction.")
+	rollback := app.Command("rollback", "Discards the open transaction.")
+	app.Command("exit", "Exits the shell. Any open transaction is rolled back.")
+
+	cmd, err := app.Parse(args)
+	if err == nil {
+		switch cmd {
+		case begin.FullCommand():
+			err = s.begin()
+		case commit.FullCommand():
+			err = s.commit()
+		case rollback.FullCommand():
+			err = s.rollback()
+		case "exit":
+			if s.tx != nil {
+				s.tx.Close()
+				fmt.Fprintln(s.errs, "Rolled back open transaction.")
+			}
+			return true
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(s.errs, err)
+	}
+	if s.tx == nil {
+		// Pick up changes made by drop or by other processes.
+		if err := s.d.Reload(); err != nil {
+			fmt.Fprintln(s.errs, err)
+		}
+	}
+	return false
+}
+
+func (s *shellState) begin() error {
+	if s.tx != nil {
+		return errors.New("a transaction is already open")
+	}
+	s.tx = s.d.NewTransaction()
+	return nil
+}
+
+func (s *shellState) commit() error {
+	if s.tx == nil {
+		return errors.New("no open transaction")
+	}
+	tx := s.tx
+	s.tx = nil
+	defer tx.Close()
+
+	// The open transaction has no name, so sync could not replay it. Instead its
+	// changes are committed on the same basis as a .putMany mutation.
+	basis := tx.Basis()
+	changes, err := diffMaps(basis.Data(s.d.Noms()).NomsMap(), tx.Data().NomsMap(), "")
+	if err != nil {
+		return err
+	}
+	ops := make([]putManyOp, 0, len(changes))
+	for _, c := range changes {
+		c := c
+		ops = append(ops, putManyOp{Key: &c.Key, Value: c.New, Delete: c.Op == "remove"})
+	}
+	args, err := putManyArgs(s.d.Noms(), ops)
+	if err != nil {
+		return err
+	}
+	mtx := s.d.NewTransactionWithArgs(".putMany", args, &basis, nil)
+	if err := putOps(mtx, ops); err != nil {
+		mtx.Close()
+		return err
+	}
+	ref, err := mtx.Commit(s.l)
+	if err != nil {
+		return err
+	}
+	if !ref.IsZeroValue() {
+		fmt.Fprintln(s.out, ref.TargetHash())
+	}
+	return nil
+}
+
+func (s *shellState) rollback() error {
+	if s.tx == nil {
+		return errors.New("no open transaction")
+	}
+	tx := s.tx
+	s.tx = nil
+	return tx.Close()
+}
+
+// complete returns the candidates for the last word of line: command names for the
+// first word and keys for the first argument of commands that take one.
+func (s *shellState) complete(line string) []string {
+	words := strings.Split(line, " ")
+	word := words[len(words)-1]
+	if len(words) == 1 {
+		var r []string
+		for _, c := range append(commandNames(), "begin", "commit", "rollback", "exit") {
+			if strings.HasPrefix(c, word) {
+				r = append(r, c)
+			}
+		}
+		sort.Strings(r)
+		return r
+	}
+	if len(words) != 2 || !keyCommands[words[0]] {
+		return nil
+	}
+
+	tx := s.tx
+	if tx == nil {
+		tx = s.d.NewTransaction()
+		defer tx.Close()
+	}
+	items, err := tx.Scan(db.ScanOptions{Prefix: word, Limit: maxCompletions})
+	if err != nil {
+		return nil
+	}
+	r := make([]string, 0, len(items))
+	for _, it := range items {
+		r = append(r, it.Key)
+	}
+	return r
+}
+
+// commandNames returns the names of the commands registered by registerCommands.
+func commandNames() []string {
+	app := kingpin.New("", "")
+	registerCommands(app, nil, nil, noTx, nil, nil, nil, zl.Nop())
+	var r []string
+	for _, c := range app.Model().Commands {
+		r = append(r, c.Name)
+	}
+	return r
+}
+
+// splitArgs splits line into words at spaces. Single and double quotes group
+// words, and a backslash escapes the next character.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				args = append(args, cur.String())
+				cur.Reset()
+				inWord = false
+			}
+		default:
+			cur.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inWord {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/util/time"
+)
+
+func TestShell(t *testing.T) {
+	assert := assert.New(t)
+	defer time.SetFake()()
+
+	td, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+
+	in := strings.Join([]string{
+		`commit`,
+		`put foo '"bar"'`,
+		`get foo`,
+		`put hot`,
+		`"dog"`,
+		`get hot`,
+		`begin`,
+		`put baz 1`,
+		`del foo`,
+		`has foo`,
+		`get baz`,
+		`rollback`,
+		``,
+		`has foo`,
+		`has baz`,
+		`begin`,
+		`del foo`,
+		`put qux 2`,
+		`commit`,
+		`has foo`,
+		`begin`,
+		`exit`,
+		`has foo`,
+	}, "\n")
+	ob := &strings.Builder{}
+	eb := &strings.Builder{}
+	code := 0
+	impl([]string{"--db=" + td, "shell"}, strings.NewReader(in), ob, eb, func(c int) { code = c })
+
+	assert.Equal(0, code)
+	assert.Regexp(`^"bar""dog"false\n1true\nfalse\n[0-9a-v]{32}\nfalse\n$`, ob.String())
+	assert.Equal("no open transaction\nRolled back open transaction.\n", eb.String())
+
+	// The transaction is committed as a mutation that sync can replay.
+	ob.Reset()
+	impl([]string{"--db=" + td, "log", "--format=json"}, strings.NewReader(""), ob, eb, func(c int) { code = c })
+	assert.Equal(0, code)
+	var entries []logEntry
+	assert.NoError(json.Unmarshal([]byte(ob.String()), &entries))
+	if assert.True(len(entries) > 0) {
+		assert.Equal(".putMany", entries[0].Name)
+		assert.JSONEq(`[["foo"],["qux",2]]`, string(entries[0].Args))
+	}
+}
+
+func TestLineReader(t *testing.T) {
+	assert := assert.New(t)
+
+	keys := strings.Join([]string{
+		"abc\x7fd\r",            // backspace
+		"\x1b[A\r",              // history
+		"xy\x1b[Dz\r",           // cursor left
+		"xy\x01q\x05w\r",        // ctrl-A, ctrl-E
+		"xyz\x1b[D\x1b[D\x0b\r", // ctrl-K
+		"ge\t\r",                // completion to the common prefix
+		"h\t\r",                 // unique completion
+		"foo\x03",               // ctrl-C
+		"\x04",                  // ctrl-D
+	}, "")
+	lr := &lineReader{
+		in:       bufio.NewReader(strings.NewReader(keys)),
+		out:      ioutil.Discard,
+		fd:       -1,
+		terminal: true,
+		complete: func(line string) []string {
+			word := line[strings.LastIndex(line, " ")+1:]
+			var r []string
+			for _, c := range []string{"get", "gets", "has"} {
+				if strings.HasPrefix(c, word) {
+					r = append(r, c)
+				}
+			}
+			return r
+		},
+	}
+
+	for _, expected := range []string{"abd", "abd", "xzy", "qxyw", "x", "get", "has ", ""} {
+		line, err := lr.readLine("> ")
+		assert.NoError(err)
+		assert.Equal(expected, line)
+	}
+	_, err := lr.readLine("> ")
+	assert.Equal(io.EOF, err)
+	assert.Equal([]string{"abd", "xzy", "qxyw", "x", "get", "has "}, lr.history)
+
+	// Candidates that only share the first byte of a multi-byte character have no
+	// common prefix.
+	out := &strings.Builder{}
+	lr = &lineReader{
+		in:       bufio.NewReader(strings.NewReader("d\t\r")),
+		out:      out,
+		fd:       -1,
+		terminal: true,
+		complete: func(line string) []string {
+			return []string{"dé", "dè"}
+		},
+	}
+	line, err := lr.readLine("> ")
+	assert.NoError(err)
+	assert.Equal("d", line)
+	assert.Contains(out.String(), "dé  dè")
+}
+
+func TestSplitArgs(t *testing.T) {
+	assert := assert.New(t)
+
+	tc := []struct {
+		line     string
+		expected []string
+		err      string
+	}{
+		{"", nil, ""},
+		{"  get   foo ", []string{"get", "foo"}, ""},
+		{`put foo '"bar baz"'`, []string{"put", "foo", `"bar baz"`}, ""},
+		{`put "a b" "\"c\""`, []string{"put", "a b", `"c"`}, ""},
+		{`get a\ b ''`, []string{"get", "a b", ""}, ""},
+		{`get 'foo`, nil, "unterminated quote or escape"},
+	}
+
+	for _, t := range tc {
+		args, err := splitArgs(t.line)
+		if t.err != "" {
+			assert.EqualError(err, t.err, t.line)
+			continue
+		}
+		assert.NoError(err, t.line)
+		assert.Equal(t.expected, args, t.line)
+	}
+}
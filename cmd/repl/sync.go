@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/attic-labs/noms/go/hash"
+	zl "github.com/rs/zerolog"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+
+	"roci.dev/diff-server/util/tbl"
+	"roci.dev/replicache-client/db"
+)
+
+func syncCmd(parent *kingpin.Application, gdb gdb, out io.Writer, l zl.Logger) {
+	kc := parent.Command("sync", "Syncs the database with the data layer via the diff-server. Only databases with just .putValue, .delValue and .putMany mutations can be synced, as those are the only mutations the repl can replay.")
+	batchPushURL := kc.Flag("batch-push-url", "URL of the data layer's batch push endpoint").Required().String()
+	diffServerURL := kc.Flag("diff-server-url", "URL of the diff-server's pull endpoint").Required().String()
+	dataLayerAuth := kc.Flag("data-layer-auth", "authorization token for the data layer").String()
+	diffServerAuth := kc.Flag("diff-server-auth", "authorization token for the diff-server").String()
+	kc.Action(func(_ *kingpin.ParseContext) error {
+		d, err := gdb()
+		if err != nil {
+			return err
+		}
+		syncHead, info, err := d.BeginSync(*batchPushURL, *diffServerURL, *diffServerAuth, *dataLayerAuth, l)
+		if err != nil {
+			return err
+		}
+
+		table := &tbl.Table{}
+		if info.BatchPushInfo == nil {
+			table.Add("Push: ", "nothing to push")
+		} else {
+			table.Add("Push: ", fmt.Sprintf("HTTP %d", info.BatchPushInfo.HTTPStatusCode))
+			if info.BatchPushInfo.ErrorMessage != "" {
+				table.Add("Push error: ", info.BatchPushInfo.ErrorMessage)
+			}
+			for _, mi := range info.BatchPushInfo.BatchPushResponse.MutationInfos {
+				table.Add(fmt.Sprintf("Mutation %d: ", mi.ID), mi.Error)
+			}
+		}
+		table.Add("Pull: ", fmt.Sprintf("HTTP %d", info.ClientViewInfo.HTTPStatusCode))
+		if info.ClientViewInfo.ErrorMessage != "" {
+			table.Add("Pull error: ", info.ClientViewInfo.ErrorMessage)
+		}
+
+		replayed := 0
+		for !syncHead.IsEmpty() {
+			replay, err := d.MaybeEndSync(syncHead)
+			if err != nil {
+				return err
+			}
+			if len(replay) == 0 {
+				break
+			}
+			syncHead, err = replayMutations(d, syncHead, replay, l)
+			if err != nil {
+				return err
+			}
+			replayed += len(replay)
+		}
+
+		s, err := d.Stats(false)
+		if err != nil {
+			return err
+		}
+		table.Add("Server state: ", s.ServerStateID)
+		table.Add("Replayed: ", fmt.Sprintf("%d", replayed))
+		table.Add("Pending: ", fmt.Sprintf("%d", s.PendingMutations))
+		_, err = table.WriteTo(out)
+		return err
+	})
+}
+
+// replayMutations replays mutations on top of syncHead and returns the new sync
+// head. It checks all mutations before replaying any, so that it either replays
+// all of them or none.
+func replayMutations(d *db.DB, syncHead hash.Hash, mutations []db.ReplayMutation, l zl.Logger) (hash.Hash, error) {
+	ops := make([][]putManyOp, len(mutations))
+	for i, m := range mutations {
+		var err error
+		if ops[i], err = mutationOps(m.Name, m.Args); err != nil {
+			return hash.Hash{}, fmt.Errorf("cannot replay mutation %d: %s", m.ID, err)
+		}
+	}
+
+	for i, m := range mutations {
+		basis, err := db.ReadCommit(d.Noms(), syncHead)
+		if err != nil {
+			return hash.Hash{}, err
+		}
+		original, err := db.ReadCommit(d.Noms(), m.Original.Hash)
+		if err != nil {
+			return hash.Hash{}, err
+		}
+		// The replayed commit must have the same args as the original.
+		tx := d.NewTransactionWithArgs(m.Name, original.Meta.Local.Args, &basis, &original)
+		if err := putOps(tx, ops[i]); err != nil {
+			tx.Close()
+			return hash.Hash{}, err
+		}
+		ref, err := tx.Commit(l)
+		if err != nil {
+			return hash.Hash{}, err
+		}
+		if ref.IsZeroValue() {
+			// Eg a delete of a key that the new server state doesn't have. Without a
+			// commit the mutation would be handed back for replay again and again.
+			return hash.Hash{}, fmt.Errorf("cannot replay mutation %d: it does not change anything on the new server state", m.ID)
+		}
+		syncHead = ref.TargetHash()
+	}
+	return syncHead, nil
+}
+
+// mutationOps returns the puts and deletes of one of the mutations the repl
+// commits: .putValue, .delValue or .putMany.
+func mutationOps(name string, args json.RawMessage) ([]putManyOp, error) {
+	if name == ".putMany" {
+		ops, err := parsePutManyArgs(args)
+		if err != nil {
+			return nil, fmt.Errorf("invalid args %s", args)
+		}
+		return ops, nil
+	}
+	if name != ".putValue" && name != ".delValue" {
+		return nil, fmt.Errorf("unknown mutation %q", name)
+	}
+
+	var a []json.RawMessage
+	var key string
+	err := json.Unmarshal(args, &a)
+	if err == nil && len(a) > 0 {
+		err = json.Unmarshal(a[0], &key)
+	}
+	switch {
+	case err != nil || len(a) == 0:
+	case name == ".putValue" && len(a) == 2:
+		return []putManyOp{{Key: &key, Value: a[1]}}, nil
+	case name == ".delValue":
+		return []putManyOp{{Key: &key, Delete: true}}, nil
+	}
+	return nil, fmt.Errorf("invalid args %s", args)
+}
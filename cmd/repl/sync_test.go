@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/attic-labs/noms/go/spec"
+	"github.com/attic-labs/noms/go/types"
+	"github.com/stretchr/testify/assert"
+
+	diffserve "roci.dev/diff-server/serve"
+	servetypes "roci.dev/diff-server/serve/types"
+	"roci.dev/diff-server/util/log"
+	"roci.dev/replicache-client/datalayer"
+	"roci.dev/replicache-client/db"
+)
+
+func TestSync(t *testing.T) {
+	assert := assert.New(t)
+
+	// The data layer implements the .putValue mutation, unless failPush is set.
+	failPush := true
+	var lastMutationID uint64
+	data := map[string]json.RawMessage{"srv": json.RawMessage(`1`)}
+	batch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failPush {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("nope"))
+			return
+		}
+		var req db.BatchPushRequest
+		assert.NoError(json.NewDecoder(r.Body).Decode(&req))
+		for _, m := range req.Mutations {
+			var args []json.RawMessage
+			assert.NoError(json.Unmarshal(m.Args, &args))
+			var key string
+			assert.NoError(json.Unmarshal(args[0], &key))
+			data[key] = args[1]
+			lastMutationID = m.ID
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer batch.Close()
+	clientView := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := json.Marshal(servetypes.ClientViewResponse{ClientView: data, LastMutationID: lastMutationID})
+		assert.NoError(err)
+		w.Write(b)
+	}))
+	defer clientView.Close()
+	diffDir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	accounts := []diffserve.Account{{ID: "accountid", Name: "Test", ClientViewURL: clientView.URL}}
+	diffServer := httptest.NewServer(diffserve.NewService(diffDir, accounts, "", diffserve.ClientViewGetter{}, false))
+	defer diffServer.Close()
+
+	td, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	run := func(args ...string) (int, string, string) {
+		ob := &strings.Builder{}
+		eb := &strings.Builder{}
+		code := 0
+		impl(append([]string{"--db=" + td}, args...), strings.NewReader(""), ob, eb, func(c int) { code = c })
+		return code, ob.String(), eb.String()
+	}
+	sync := func() (int, string, string) {
+		return run("sync", "--batch-push-url="+batch.URL, "--diff-server-url="+diffServer.URL+"/pull", "--diff-server-auth=accountid")
+	}
+
+	code, _, _ := run("put", "foo", `"bar"`)
+	assert.Equal(0, code)
+
+	// The push fails, so foo is replayed on top of the new server state.
+	code, out, errs := sync()
+	assert.Equal(0, code)
+	assert.Equal("", errs)
+	assert.Regexp(`^Push:\s+HTTP 500\nPush error:\s+nope\nPull:\s+HTTP 200\nServer state:\s+\w+\nReplayed:\s+1\nPending:\s+1\n$`, out)
+	_, out, _ = run("get", "srv")
+	assert.Equal("1", out)
+	_, out, _ = run("get", "foo")
+	assert.Equal(`"bar"`, out)
+	var entries []logEntry
+	_, out, _ = run("log", "--format=json")
+	assert.NoError(json.Unmarshal([]byte(out), &entries))
+	if assert.Equal(3, len(entries)) {
+		assert.Equal("local", entries[0].Type)
+		assert.NotEqual("", entries[0].Original)
+		assert.Equal("snapshot", entries[1].Type)
+		assert.NotEqual("", entries[1].ServerStateID)
+		assert.Equal(uint64(0), *entries[1].LastMutationID)
+		assert.Equal("snapshot", entries[2].Type)
+	}
+
+	failPush = false
+	code, out, errs = sync()
+	assert.Equal(0, code)
+	assert.Equal("", errs)
+	assert.Regexp(`^Push:\s+HTTP 200\nPull:\s+HTTP 200\nServer state:\s+\w+\nReplayed:\s+0\nPending:\s+0\n$`, out)
+	assert.Equal(json.RawMessage(`"bar"`), data["foo"])
+
+	code, out, _ = sync()
+	assert.Equal(0, code)
+	assert.Regexp(`^Push:\s+nothing to push\n`, out)
+
+	// The repl can't replay mutations it doesn't know.
+	sp, err := spec.ForDatabase(td)
+	assert.NoError(err)
+	d, err := db.Load(sp)
+	assert.NoError(err)
+	tx := d.NewTransactionWithArgs("myPut", types.NewList(d.Noms()), nil, nil)
+	assert.NoError(tx.Put("baz", []byte(`true`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+	assert.NoError(d.Close())
+
+	failPush = true
+	data["srv"] = json.RawMessage(`2`)
+	code, _, errs = sync()
+	assert.Equal(1, code)
+	assert.Equal("cannot replay mutation 2: unknown mutation \"myPut\"\n", errs)
+}
+
+func TestSyncPutMany(t *testing.T) {
+	assert := assert.New(t)
+
+	// The data layer implements the mutations of the repl. It fails pushes while
+	// failPush is set.
+	failPush := true
+	dl := datalayer.New(datalayer.Config{
+		Data:      map[string]json.RawMessage{"srv": json.RawMessage(`1`), "gone": json.RawMessage(`true`)},
+		Mutations: datalayer.DefaultConfig.Mutations,
+	}, ioutil.Discard)
+	dataLayer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failPush && r.URL.Path == "/batch-push" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		dl.ServeHTTP(w, r)
+	}))
+	defer dataLayer.Close()
+	diffDir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	accounts := []diffserve.Account{{ID: "accountid", Name: "Test", ClientViewURL: dataLayer.URL + "/client-view"}}
+	diffServer := httptest.NewServer(diffserve.NewService(diffDir, accounts, "", diffserve.ClientViewGetter{}, false))
+	defer diffServer.Close()
+
+	td, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	run := func(in string, args ...string) (int, string, string) {
+		ob := &strings.Builder{}
+		eb := &strings.Builder{}
+		code := 0
+		impl(append([]string{"--db=" + td}, args...), strings.NewReader(in), ob, eb, func(c int) { code = c })
+		return code, ob.String(), eb.String()
+	}
+	sync := func() (int, string, string) {
+		return run("", "sync", "--batch-push-url="+dataLayer.URL+"/batch-push", "--diff-server-url="+diffServer.URL+"/pull", "--diff-server-auth=accountid")
+	}
+	scan := func() string {
+		_, out, _ := run("", "scan", "--format=jsonl")
+		return out
+	}
+
+	code, _, _ := sync()
+	assert.Equal(0, code)
+	code, _, errs := run(`{"key": "a", "value": {"x": 1}}
+{"key": "gone", "delete": true}
+{"key": "b", "value": [2]}
+`, "put-many")
+	assert.Equal(0, code)
+	assert.Equal("", errs)
+	var entries []logEntry
+	_, out, _ := run("", "log", "--format=json")
+	assert.NoError(json.Unmarshal([]byte(out), &entries))
+	if assert.True(len(entries) > 0) {
+		assert.Equal(".putMany", entries[0].Name)
+		assert.JSONEq(`[["a",{"x":1}],["gone"],["b",[2]]]`, string(entries[0].Args))
+	}
+
+	// The push fails, so the put-many is replayed on top of the new server state.
+	code, out, errs = sync()
+	assert.Equal(0, code)
+	assert.Equal("", errs)
+	assert.Regexp(`\nReplayed:\s+1\nPending:\s+1\n$`, out)
+	assert.Equal(`{"key":"a","value":{"x":1}}`+"\n"+`{"key":"b","value":[2]}`+"\n"+`{"key":"srv","value":1}`+"\n", scan())
+
+	// The data layer applies the pushed put-many, and the client ends up with the
+	// same data without pending mutations.
+	failPush = false
+	code, out, errs = sync()
+	assert.Equal(0, code)
+	assert.Equal("", errs)
+	assert.Regexp(`\nReplayed:\s+0\nPending:\s+0\n$`, out)
+	assert.Equal(`{"key":"a","value":{"x":1}}`+"\n"+`{"key":"b","value":[2]}`+"\n"+`{"key":"srv","value":1}`+"\n", scan())
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/attic-labs/noms/go/hash"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+
+	"roci.dev/replicache-client/db"
+)
+
+// watchEntry is a change in the output of watch --format=json or jsonl.
+type watchEntry struct {
+	Commit        string `json:"commit"`
+	Type          string `json:"type"` // "local" or "snapshot"
+	MutationID    uint64 `json:"mutationId"`
+	Name          string `json:"name,omitempty"`
+	ServerStateID string `json:"serverStateId,omitempty"`
+	// Rewritten is true for the first commit after the history was rewritten, eg
+	// by a sync or reset, so that the previous head is not in the history of the
+	// commit. The change is then relative to the previous head.
+	Rewritten bool `json:"rewritten,omitempty"`
+	keyChange
+}
+
+func watchCmd(parent *kingpin.Application, gdb gdb, format *string, out io.Writer) {
+	kc := parent.Command("watch", "Prints the changes to the data as commits land, until interrupted.")
+	prefix := kc.Flag("prefix", "only show keys starting with prefix").String()
+	interval := kc.Flag("interval", "how often to check for new commits").Default("1s").Duration()
+	kc.Action(func(_ *kingpin.ParseContext) error {
+		d, err := gdb()
+		if err != nil {
+			return err
+		}
+		return watch(d, *prefix, *interval, *format, out, nil)
+	})
+}
+
+// watch reloads d every interval and prints the changes to keys starting with
+// prefix made by new commits. It returns when stop is closed.
+func watch(d *db.DB, prefix string, interval time.Duration, format string, out io.Writer, stop <-chan struct{}) error {
+	last := d.Head()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+		if err := d.Reload(); err != nil {
+			return err
+		}
+		head := d.Head()
+		if head.NomsStruct.Equals(last.NomsStruct) {
+			continue
+		}
+		if err := printNewCommits(d, last, head, prefix, format, out); err != nil {
+			return err
+		}
+		last = head
+	}
+}
+
+// printNewCommits prints the changes each commit from old (exclusive) to head
+// made. If old is not in the history of head, the new commits are those after
+// the common ancestor of old and head, and the first of them is diffed against
+// old. If there are none, as after a reset to an earlier commit, the changes
+// from old to head are printed instead.
+func printNewCommits(d *db.DB, old, head db.Commit, prefix string, format string, out io.Writer) error {
+	noms := d.Noms()
+	var commits []db.Commit
+	rewritten := true
+	for c := head; ; {
+		if c.NomsStruct.Equals(old.NomsStruct) {
+			rewritten = false
+			break
+		}
+		commits = append(commits, c)
+		if len(c.Parents) == 0 {
+			break
+		}
+		var err error
+		if c, err = c.Basis(noms); err != nil {
+			return err
+		}
+	}
+
+	if rewritten {
+		inOld := map[hash.Hash]bool{}
+		for c := old; ; {
+			inOld[c.NomsStruct.Hash()] = true
+			if len(c.Parents) == 0 {
+				break
+			}
+			var err error
+			if c, err = c.Basis(noms); err != nil {
+				return err
+			}
+		}
+		for i, c := range commits {
+			if inOld[c.NomsStruct.Hash()] {
+				commits = commits[:i]
+				break
+			}
+		}
+		if len(commits) == 0 {
+			commits = []db.Commit{head}
+		}
+	}
+
+	for i := len(commits) - 1; i >= 0; i-- {
+		c := commits[i]
+		first := rewritten && i == len(commits)-1
+		basis := old
+		if !first {
+			var err error
+			if basis, err = c.Basis(noms); err != nil {
+				return err
+			}
+		}
+		changes, err := diffData(noms, basis, c, prefix)
+		if err != nil {
+			return err
+		}
+		if err := printCommitChanges(out, format, c, first, changes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func printCommitChanges(out io.Writer, format string, c db.Commit, rewritten bool, changes []keyChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	e := watchEntry{
+		Commit:     c.Ref().TargetHash().String(),
+		MutationID: c.MutationID(),
+		Rewritten:  rewritten,
+	}
+	if c.Type() == db.CommitTypeLocal {
+		e.Type = "local"
+		e.Name = c.Meta.Local.Name
+	} else {
+		e.Type = "snapshot"
+		e.ServerStateID = c.Meta.Snapshot.ServerStateID
+	}
+
+	if format == formatJSON || format == formatJSONL {
+		enc := json.NewEncoder(out)
+		for _, kc := range changes {
+			e.keyChange = kc
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	desc := fmt.Sprintf("mutation %d", e.MutationID)
+	if e.Name != "" {
+		desc += " " + e.Name
+	}
+	if e.Type == "snapshot" {
+		desc = fmt.Sprintf("snapshot %s, last mutation %d", serverStateID(c), e.MutationID)
+	}
+	if rewritten {
+		desc += ", history rewritten"
+	}
+	fmt.Fprintf(out, "commit %s (%s)\n", e.Commit, desc)
+	printChanges(out, changes)
+	return nil
+}
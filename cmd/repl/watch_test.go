@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	gotime "time"
+
+	"github.com/attic-labs/noms/go/hash"
+	"github.com/attic-labs/noms/go/spec"
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/replicache-client/db"
+)
+
+// syncBuilder is a strings.Builder that can be written and read concurrently.
+type syncBuilder struct {
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (b *syncBuilder) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuilder) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestWatch(t *testing.T) {
+	assert := assert.New(t)
+
+	tc := []struct {
+		format string
+		// exp returns the output expected before and after the reset.
+		exp func(a, b, c string) (string, string)
+	}{
+		{"", func(a, b, c string) (string, string) {
+			return "commit " + a + " (mutation 1 .putValue)\n" +
+					"+ todo/1: 1\n" +
+					"commit " + c + " (mutation 3 .delValue)\n" +
+					"- todo/1: 1\n",
+				"commit " + b + " (mutation 2 .putValue, history rewritten)\n" +
+					"+ todo/1: 1\n"
+		}},
+		{formatJSONL, func(a, b, c string) (string, string) {
+			return `{"commit":"` + a + `","type":"local","mutationId":1,"name":".putValue","op":"add","key":"todo/1","new":1}` + "\n" +
+					`{"commit":"` + c + `","type":"local","mutationId":3,"name":".delValue","op":"remove","key":"todo/1","old":1}` + "\n",
+				`{"commit":"` + b + `","type":"local","mutationId":2,"name":".putValue","rewritten":true,"op":"add","key":"todo/1","new":1}` + "\n"
+		}},
+	}
+
+	for _, c := range tc {
+		w, dir := db.LoadTempDB(assert)
+		out := &syncBuilder{}
+		stop := make(chan struct{})
+		done := make(chan error)
+		go func() {
+			done <- watch(w, "todo/", gotime.Millisecond, c.format, out, stop)
+		}()
+
+		// The commits are made by separate handles on the database, as if by another
+		// process.
+		run := func(in string, args ...string) string {
+			code := 0
+			impl(append([]string{"--db=" + dir}, args...), strings.NewReader(in), ioutil.Discard, ioutil.Discard, func(c int) { code = c })
+			assert.Equal(0, code, "%v", args)
+			sp, err := spec.ForDatabase(dir)
+			assert.NoError(err)
+			d, err := db.Load(sp)
+			assert.NoError(err)
+			defer d.Close()
+			return d.HeadHash().String()
+		}
+		a := run("", "put", "todo/1", "1")
+		b := run("", "put", "other", "2")
+		cc := run("", "del", "todo/1")
+		before, after := c.exp(a, b, cc)
+		waitFor := func(exp string) {
+			for i := 0; i < 500 && out.String() != exp; i++ {
+				gotime.Sleep(10 * gotime.Millisecond)
+			}
+			assert.Equal(exp, out.String(), c.format)
+		}
+		// The reset is only seen as such if the watcher has seen the deletion.
+		waitFor(before)
+		run("y\n", "reset", "head~1")
+		waitFor(before + after)
+
+		close(stop)
+		assert.NoError(<-done)
+	}
+}
+
+func TestWatchForkedHistory(t *testing.T) {
+	assert := assert.New(t)
+
+	ld, dir := db.LoadTempDB(assert)
+	assert.NoError(ld.Close())
+	run := func(in string, args ...string) string {
+		code := 0
+		impl(append([]string{"--db=" + dir}, args...), strings.NewReader(in), ioutil.Discard, ioutil.Discard, func(c int) { code = c })
+		assert.Equal(0, code, "%v", args)
+		sp, err := spec.ForDatabase(dir)
+		assert.NoError(err)
+		d, err := db.Load(sp)
+		assert.NoError(err)
+		defer d.Close()
+		return d.HeadHash().String()
+	}
+	run("", "put", "todo/1", "1")
+	old := run("", "put", "todo/2", "2")
+	run("y\n", "reset", "head~1")
+	d := run("", "put", "todo/3", "3")
+	e := run("", "put", "todo/1", "4")
+
+	sp, err := spec.ForDatabase(dir)
+	assert.NoError(err)
+	w, err := db.Load(sp)
+	assert.NoError(err)
+	defer w.Close()
+	oldCommit, err := db.ReadCommit(w.Noms(), hash.Parse(old))
+	assert.NoError(err)
+
+	// Only the commits after the fork are printed, each with its mutation, and the
+	// first relative to the previous head.
+	out := &strings.Builder{}
+	assert.NoError(printNewCommits(w, oldCommit, w.Head(), "todo/", "", out))
+	assert.Equal("commit "+d+" (mutation 2 .putValue, history rewritten)\n"+
+		"- todo/2: 2\n"+
+		"+ todo/3: 3\n"+
+		"commit "+e+" (mutation 3 .putValue)\n"+
+		"~ todo/1: 1 -> 4\n", out.String())
+}
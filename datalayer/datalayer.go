@@ -0,0 +1,310 @@
+// Package datalayer implements a fake data layer for development and testing.
+// It implements the batch push and client view endpoints that sync talks to,
+// and mutations that put and delete keys as configured.
+package datalayer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	servetypes "roci.dev/diff-server/serve/types"
+	"roci.dev/replicache-client/db"
+)
+
+// Config configures the fake data layer.
+type Config struct {
+	// AuthToken, if set, must be passed as the Authorization header to the data layer,
+	// ie as the data layer auth of sync.
+	AuthToken string `json:"authToken,omitempty"`
+	// Data is the data every client starts with.
+	Data map[string]json.RawMessage `json:"data,omitempty"`
+	// Mutations maps the names of the mutations the data layer implements to how
+	// they change the data.
+	Mutations map[string]MutationConfig `json:"mutations"`
+}
+
+// MutationConfig defines how a mutation changes the data.
+type MutationConfig struct {
+	// Op is "put", "del" or "batch". The args of a batch are an array of ops, each
+	// of which puts if Value selects a value from it and deletes otherwise. A batch
+	// changes either all keys or none.
+	Op string `json:"op"`
+	// Key selects the key to put or delete from the mutation's args, or from each
+	// op of a batch. It is either the name of a field of an args object, or the
+	// index of an element of an args array.
+	Key string `json:"key"`
+	// KeyPrefix is prepended to the key.
+	KeyPrefix string `json:"keyPrefix,omitempty"`
+	// Value selects the value to put from the args, like Key. If empty, the value
+	// is the args themselves. A batch must have a Value.
+	Value string `json:"value,omitempty"`
+}
+
+// DefaultConfig implements the mutations of the repl, so that databases changed
+// with repl put and del can be synced.
+var DefaultConfig = Config{
+	Mutations: map[string]MutationConfig{
+		".putValue": {Op: "put", Key: "0", Value: "1"},
+		".delValue": {Op: "del", Key: "0"},
+		".putMany":  {Op: "batch", Key: "0", Value: "1"},
+	},
+}
+
+// ReadConfig reads a JSON config from r and validates it.
+func ReadConfig(r io.Reader) (Config, error) {
+	var c Config
+	if err := json.NewDecoder(r).Decode(&c); err != nil {
+		return Config{}, fmt.Errorf("could not parse config: %s", err)
+	}
+	if err := c.validate(); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+func (c Config) validate() error {
+	if len(c.Mutations) == 0 {
+		return errors.New("invalid config: no mutations")
+	}
+	for name, m := range c.Mutations {
+		if m.Op != "put" && m.Op != "del" && m.Op != "batch" {
+			return fmt.Errorf("invalid config: mutation %s: op must be put, del or batch, got %q", name, m.Op)
+		}
+		if m.Key == "" {
+			return fmt.Errorf("invalid config: mutation %s: no key", name)
+		}
+		if m.Op == "batch" && m.Value == "" {
+			return fmt.Errorf("invalid config: mutation %s: batch has no value", name)
+		}
+	}
+	return nil
+}
+
+// MutationNames returns the names of the mutations, sorted.
+func (c Config) MutationNames() []string {
+	r := make([]string, 0, len(c.Mutations))
+	for name := range c.Mutations {
+		r = append(r, name)
+	}
+	sort.Strings(r)
+	return r
+}
+
+// apply applies the mutation with args to data.
+func (m MutationConfig) apply(data map[string]json.RawMessage, args json.RawMessage) error {
+	if m.Op != "batch" {
+		key, v, err := m.selectOp(args, m.Op == "put")
+		if err != nil {
+			return err
+		}
+		setOrDelete(data, key, v)
+		return nil
+	}
+
+	var ops []json.RawMessage
+	if err := json.Unmarshal(args, &ops); err != nil {
+		return fmt.Errorf("args %s are not an array of ops", args)
+	}
+	keys := make([]string, len(ops))
+	values := make([]json.RawMessage, len(ops))
+	for i, op := range ops {
+		var err error
+		if keys[i], values[i], err = m.selectOp(op, false); err != nil {
+			return fmt.Errorf("op %d: %s", i, err)
+		}
+	}
+	for i := range ops {
+		setOrDelete(data, keys[i], values[i])
+	}
+	return nil
+}
+
+// selectOp returns the key and the value to put that m selects from args. The
+// value is nil if the key is to be deleted: always for a del, and if args have
+// no value unless put is true.
+func (m MutationConfig) selectOp(args json.RawMessage, put bool) (string, json.RawMessage, error) {
+	k, err := selectArg(args, m.Key)
+	if err != nil {
+		return "", nil, err
+	}
+	var key string
+	if err := json.Unmarshal(k, &key); err != nil {
+		return "", nil, fmt.Errorf("key must be a string, got %s", k)
+	}
+	key = m.KeyPrefix + key
+
+	if m.Op == "del" {
+		return key, nil, nil
+	}
+	v, err := selectArg(args, m.Value)
+	if err != nil && put {
+		return "", nil, err
+	}
+	return key, v, nil
+}
+
+func setOrDelete(data map[string]json.RawMessage, key string, v json.RawMessage) {
+	if v == nil {
+		delete(data, key)
+	} else {
+		data[key] = v
+	}
+}
+
+// selectArg returns the field or element of args that sel names, or args if sel
+// is empty.
+func selectArg(args json.RawMessage, sel string) (json.RawMessage, error) {
+	if sel == "" {
+		return args, nil
+	}
+	if i, err := strconv.Atoi(sel); err == nil {
+		var a []json.RawMessage
+		if err := json.Unmarshal(args, &a); err != nil || i < 0 || i >= len(a) {
+			return nil, fmt.Errorf("args %s have no element %d", args, i)
+		}
+		return a[i], nil
+	}
+	var o map[string]json.RawMessage
+	if err := json.Unmarshal(args, &o); err != nil || o[sel] == nil {
+		return nil, fmt.Errorf("args %s have no field %s", args, sel)
+	}
+	return o[sel], nil
+}
+
+// DataLayer is a fake data layer with the batch push and client view endpoints
+// that sync talks to. Every client has data of its own, which is kept in memory.
+type DataLayer struct {
+	config Config
+	out    io.Writer // where requests are logged
+
+	mu     sync.Mutex
+	stores map[string]*store // keyed by clientID
+}
+
+// store is the data for a single client.
+type store struct {
+	lastMutationID uint64
+	data           map[string]json.RawMessage
+}
+
+// New returns a data layer configured by c that logs the mutations pushed to
+// it to out.
+func New(c Config, out io.Writer) *DataLayer {
+	return &DataLayer{config: c, out: out, stores: map[string]*store{}}
+}
+
+func (d *DataLayer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/batch-push":
+		d.push(w, r)
+	case "/client-view":
+		d.clientView(w, r)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// getStore returns the store of clientID. The mutex must be held when called.
+func (d *DataLayer) getStore(clientID string) *store {
+	s := d.stores[clientID]
+	if s != nil {
+		return s
+	}
+	s = &store{0, make(map[string]json.RawMessage, len(d.config.Data))}
+	for k, v := range d.config.Data {
+		s.data[k] = v
+	}
+	d.stores[clientID] = s
+	return s
+}
+
+func (d *DataLayer) auth(r *http.Request) bool {
+	return d.config.AuthToken == "" || r.Header.Get("Authorization") == d.config.AuthToken
+}
+
+// push implements the batch push endpoint. Like a real data layer it treats any
+// error encountered while processing a mutation as permanent.
+func (d *DataLayer) push(w http.ResponseWriter, r *http.Request) {
+	var req db.BatchPushRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.ClientID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !d.auth(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	defer d.lock()()
+	s := d.getStore(req.ClientID)
+	var resp db.BatchPushResponse
+	for _, m := range req.Mutations {
+		var err error
+		if m.ID <= s.lastMutationID {
+			err = fmt.Errorf("ID is not greater than last mutation ID %d", s.lastMutationID)
+		} else {
+			s.lastMutationID = m.ID
+			if mc, ok := d.config.Mutations[m.Name]; !ok {
+				err = fmt.Errorf("mutation %s not supported", m.Name)
+			} else {
+				err = mc.apply(s.data, m.Args)
+			}
+		}
+		if err != nil {
+			resp.MutationInfos = append(resp.MutationInfos, db.MutationInfo{ID: m.ID, Error: "skipping this mutation: " + err.Error()})
+			fmt.Fprintf(d.out, "push %s: mutation %d %s%s: %s\n", req.ClientID, m.ID, m.Name, m.Args, err)
+		} else {
+			fmt.Fprintf(d.out, "push %s: mutation %d %s%s\n", req.ClientID, m.ID, m.Name, m.Args)
+		}
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+func (d *DataLayer) clientView(w http.ResponseWriter, r *http.Request) {
+	var req servetypes.ClientViewRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.ClientID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !d.auth(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	defer d.lock()()
+	s := d.getStore(req.ClientID)
+	var resp servetypes.ClientViewResponse
+	resp.LastMutationID = s.lastMutationID
+	resp.ClientView = make(map[string]json.RawMessage, len(s.data))
+	for k, v := range s.data {
+		resp.ClientView[k] = v
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+func (d *DataLayer) lock() func() {
+	d.mu.Lock()
+	return func() {
+		d.mu.Unlock()
+	}
+}
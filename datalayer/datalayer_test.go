@@ -0,0 +1,192 @@
+package datalayer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/attic-labs/noms/go/types"
+	"github.com/stretchr/testify/assert"
+
+	diffserve "roci.dev/diff-server/serve"
+	servetypes "roci.dev/diff-server/serve/types"
+	"roci.dev/diff-server/util/log"
+	"roci.dev/replicache-client/db"
+)
+
+func TestReadConfig(t *testing.T) {
+	assert := assert.New(t)
+	tc := []struct {
+		in  string
+		err string
+	}{
+		{`{"mutations": {"a": {"op": "put", "key": "id"}}}`, ""},
+		{`{"mutations": {"a": {"op": "del", "key": "0"}}, "data": {"foo": 1}, "authToken": "x"}`, ""},
+		{``, "could not parse config: EOF"},
+		{`{}`, "invalid config: no mutations"},
+		{`{"mutations": {"a": {"op": "set", "key": "id"}}}`, `invalid config: mutation a: op must be put, del or batch, got "set"`},
+		{`{"mutations": {"a": {"op": "put"}}}`, "invalid config: mutation a: no key"},
+		{`{"mutations": {"a": {"op": "batch", "key": "0", "value": "1"}}}`, ""},
+		{`{"mutations": {"a": {"op": "batch", "key": "0"}}}`, "invalid config: mutation a: batch has no value"},
+	}
+	for _, c := range tc {
+		_, err := ReadConfig(strings.NewReader(c.in))
+		if c.err == "" {
+			assert.NoError(err, c.in)
+		} else {
+			assert.EqualError(err, c.err, c.in)
+		}
+	}
+	assert.NoError(DefaultConfig.validate())
+}
+
+func TestSelectArg(t *testing.T) {
+	assert := assert.New(t)
+	tc := []struct {
+		args string
+		sel  string
+		exp  string
+		err  string
+	}{
+		{`{"id": "a", "v": [1]}`, "", `{"id": "a", "v": [1]}`, ""},
+		{`{"id": "a", "v": [1]}`, "id", `"a"`, ""},
+		{`{"id": "a", "v": [1]}`, "v", `[1]`, ""},
+		{`{"id": "a", "v": [1]}`, "x", ``, `args {"id": "a", "v": [1]} have no field x`},
+		{`["a", true]`, "1", `true`, ""},
+		{`["a", true]`, "2", ``, `args ["a", true] have no element 2`},
+		{`["a", true]`, "id", ``, `args ["a", true] have no field id`},
+		{`"a"`, "0", ``, `args "a" have no element 0`},
+	}
+	for _, c := range tc {
+		v, err := selectArg(json.RawMessage(c.args), c.sel)
+		if c.err == "" {
+			assert.NoError(err, c.args)
+			assert.Equal(c.exp, string(v), c.args)
+		} else {
+			assert.EqualError(err, c.err, c.args)
+		}
+	}
+}
+
+func TestDataLayer(t *testing.T) {
+	assert := assert.New(t)
+	c, err := ReadConfig(strings.NewReader(`{
+		"authToken": "secret",
+		"data": {"todo/0": {"title": "first"}},
+		"mutations": {
+			"createTodo": {"op": "put", "key": "id", "keyPrefix": "todo/"},
+			"deleteTodo": {"op": "del", "key": "id", "keyPrefix": "todo/"},
+			"updateTodos": {"op": "batch", "key": "id", "keyPrefix": "todo/", "value": "todo"}
+		}
+	}`))
+	assert.NoError(err)
+	out := &strings.Builder{}
+	d := New(c, out)
+
+	do := func(path, auth, body string) (int, string) {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		d.ServeHTTP(w, req)
+		b, err := ioutil.ReadAll(w.Result().Body)
+		assert.NoError(err)
+		return w.Result().StatusCode, string(b)
+	}
+
+	// clientView returns the JSON of the expected client view response.
+	clientView := func(lastMutationID uint64, data string) string {
+		var cv map[string]json.RawMessage
+		assert.NoError(json.Unmarshal([]byte(data), &cv))
+		b, err := json.Marshal(servetypes.ClientViewResponse{ClientView: cv, LastMutationID: lastMutationID})
+		assert.NoError(err)
+		return string(b)
+	}
+
+	tc := []struct {
+		path string
+		auth string
+		body string
+		code int
+		resp string
+	}{
+		{"/client-view", "secret", `{"clientID": "c1"}`, 200, clientView(0, `{"todo/0":{"title":"first"}}`)},
+		{"/client-view", "wrong", `{"clientID": "c1"}`, 401, ``},
+		{"/client-view", "secret", `{}`, 400, ``},
+		{"/batch-push", "", `{"clientID": "c1", "mutations": []}`, 401, ``},
+		{"/batch-push", "secret", `{"clientID": "c1", "mutations": [` +
+			`{"id": 1, "name": "createTodo", "args": {"id": "1", "title": "second"}},` +
+			`{"id": 2, "name": "deleteTodo", "args": {"id": "0"}},` +
+			`{"id": 2, "name": "deleteTodo", "args": {"id": "1"}},` +
+			`{"id": 3, "name": "updateTodo", "args": {"id": "1"}},` +
+			`{"id": 4, "name": "createTodo", "args": {"title": "third"}}]}`, 200,
+			`{"mutationInfos":[` +
+				`{"id":2,"error":"skipping this mutation: ID is not greater than last mutation ID 2"},` +
+				`{"id":3,"error":"skipping this mutation: mutation updateTodo not supported"},` +
+				`{"id":4,"error":"skipping this mutation: args {\"title\": \"third\"} have no field id"}]}`},
+		{"/client-view", "secret", `{"clientID": "c1"}`, 200, clientView(4, `{"todo/1":{"id":"1","title":"second"}}`)},
+		{"/batch-push", "secret", `{"clientID": "c1", "mutations": [` +
+			`{"id": 5, "name": "updateTodos", "args": [{"id": "2", "todo": {"title": "x"}}, {"id": "1"}]},` +
+			`{"id": 6, "name": "updateTodos", "args": [{"id": "3", "todo": {}}, {"todo": {}}]},` +
+			`{"id": 7, "name": "updateTodos", "args": {"id": "3"}}]}`, 200,
+			`{"mutationInfos":[` +
+				`{"id":6,"error":"skipping this mutation: op 1: args {\"todo\": {}} have no field id"},` +
+				`{"id":7,"error":"skipping this mutation: args {\"id\": \"3\"} are not an array of ops"}]}`},
+		{"/client-view", "secret", `{"clientID": "c1"}`, 200, clientView(7, `{"todo/2":{"title":"x"}}`)},
+		{"/client-view", "secret", `{"clientID": "c2"}`, 200, clientView(0, `{"todo/0":{"title":"first"}}`)},
+		{"/foo", "secret", ``, 404, ``},
+	}
+	for i, c := range tc {
+		code, resp := do(c.path, c.auth, c.body)
+		assert.Equal(c.code, code, "case %d", i)
+		if c.resp != "" {
+			assert.JSONEq(c.resp, resp, "case %d", i)
+		}
+	}
+	assert.Equal(`push c1: mutation 1 createTodo{"id": "1", "title": "second"}
+push c1: mutation 2 deleteTodo{"id": "0"}
+push c1: mutation 2 deleteTodo{"id": "1"}: ID is not greater than last mutation ID 2
+push c1: mutation 3 updateTodo{"id": "1"}: mutation updateTodo not supported
+push c1: mutation 4 createTodo{"title": "third"}: args {"title": "third"} have no field id
+push c1: mutation 5 updateTodos[{"id": "2", "todo": {"title": "x"}}, {"id": "1"}]
+push c1: mutation 6 updateTodos[{"id": "3", "todo": {}}, {"todo": {}}]: op 1: args {"todo": {}} have no field id
+push c1: mutation 7 updateTodos{"id": "3"}: args {"id": "3"} are not an array of ops
+`, out.String())
+}
+
+func TestSync(t *testing.T) {
+	assert := assert.New(t)
+
+	dataLayer := httptest.NewServer(New(DefaultConfig, ioutil.Discard))
+	defer dataLayer.Close()
+	diffDir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	accounts := []diffserve.Account{{ID: "dev", Name: "Development", ClientViewURL: dataLayer.URL + "/client-view"}}
+	diffServer := httptest.NewServer(diffserve.NewService(diffDir, accounts, "", diffserve.ClientViewGetter{}, false))
+	defer diffServer.Close()
+
+	d, _ := db.LoadTempDB(assert)
+	tx := d.NewTransactionWithArgs(".putValue", types.NewList(d.Noms(), types.String("foo"), types.Bool(true)), nil, nil)
+	assert.NoError(tx.Put("foo", []byte("true")))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+
+	syncHead, info, err := d.BeginSync(dataLayer.URL+"/batch-push", diffServer.URL+"/pull", "dev", "", log.Default())
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, info.BatchPushInfo.HTTPStatusCode)
+	assert.Empty(info.BatchPushInfo.BatchPushResponse.MutationInfos)
+	replay, err := d.MaybeEndSync(syncHead)
+	assert.NoError(err)
+	assert.Empty(replay)
+
+	s, err := d.Stats(false)
+	assert.NoError(err)
+	assert.Equal(0, s.PendingMutations)
+	tx = d.NewTransaction()
+	v, err := tx.Get("foo")
+	assert.NoError(err)
+	assert.Equal("true", strings.TrimSpace(string(v)))
+	tx.Close()
+}
@@ -3,6 +3,7 @@ package db
 import (
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/attic-labs/noms/go/hash"
 	"github.com/attic-labs/noms/go/marshal"
@@ -133,6 +134,12 @@ func (c Commit) Type() CommitType {
 	return CommitTypeSnapshot
 }
 
+// IsMigration returns true if c is a local commit made by a migration. Such
+// commits are neither pushed nor replayed, see DB.Migrate.
+func (c Commit) IsMigration() bool {
+	return c.Type() == CommitTypeLocal && strings.HasPrefix(c.Meta.Local.Name, migrationPrefix)
+}
+
 func (c Commit) Original(noms types.ValueReadWriter) (Commit, error) {
 	if c.Meta.Local.Original.IsZeroValue() {
 		return Commit{}, nil
@@ -179,7 +186,8 @@ func ReadCommit(noms types.ValueReadWriter, hash hash.Hash) (Commit, error) {
 	return c, err
 }
 
-// Returns the commits in order (ie, earliest first and head last).
+// Returns the commits in order (ie, earliest first and head last). Migration
+// commits are left out as they are not pushed.
 func pendingCommits(noms types.ValueReadWriter, head Commit) ([]Commit, error) {
 	if head.Type() == CommitTypeSnapshot {
 		return []Commit{}, nil
@@ -192,6 +200,9 @@ func pendingCommits(noms types.ValueReadWriter, head Commit) ([]Commit, error) {
 	if err != nil {
 		return []Commit{}, err
 	}
+	if head.IsMigration() {
+		return pending, nil
+	}
 
 	return append(pending, head), nil
 }
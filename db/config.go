@@ -2,6 +2,7 @@ package db
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/attic-labs/noms/go/datas"
 	"github.com/attic-labs/noms/go/marshal"
@@ -10,19 +11,47 @@ import (
 )
 
 func initClientID(noms datas.Database) (string, error) {
+	cc, err := readClientConfig(noms)
+	if err != nil {
+		return "", err
+	}
+	if cc.ClientID == "" {
+		cc.ClientID = uuid()
+		noms.CommitValue(noms.GetDataset("config"), marshal.MustMarshal(noms, cc))
+	}
+	return cc.ClientID, nil
+}
+
+func readClientConfig(noms datas.Database) (ClientConfig, error) {
 	ds := noms.GetDataset("config")
 	var cc ClientConfig
 	if ds.HasHead() {
 		err := marshal.Unmarshal(ds.HeadValue(), &cc)
 		if err != nil {
-			return "", fmt.Errorf("Could not unmarshal config: %s", err.Error())
+			return ClientConfig{}, fmt.Errorf("Could not unmarshal config: %s", err.Error())
 		}
 	}
-	if cc.ClientID == "" {
-		cc.ClientID = uuid()
-		noms.CommitValue(ds, marshal.MustMarshal(noms, cc))
+	return cc, nil
+}
+
+func writeSchemaVersion(noms datas.Database, version uint64) error {
+	cc, err := readClientConfig(noms)
+	if err != nil {
+		return err
 	}
-	return cc.ClientID, nil
+	cc.SchemaVersion = version
+	_, err = noms.CommitValue(noms.GetDataset("config"), marshal.MustMarshal(noms, cc))
+	return err
+}
+
+func writeLastSync(noms datas.Database, t time.Time) error {
+	cc, err := readClientConfig(noms)
+	if err != nil {
+		return err
+	}
+	cc.LastSync = t.UnixNano() / int64(time.Millisecond)
+	_, err = noms.CommitValue(noms.GetDataset("config"), marshal.MustMarshal(noms, cc))
+	return err
 }
 
 var uuid = func() string {
@@ -33,6 +62,10 @@ var uuid = func() string {
 // or other nodes.
 type ClientConfig struct {
 	ClientID string
+	// SchemaVersion is the version of the schema of the data in the database, see Migrate.
+	SchemaVersion uint64 `noms:",omitempty"`
+	// LastSync is when a sync last completed, in milliseconds since the epoch.
+	LastSync int64        `noms:",omitempty"`
 	Original types.Struct `noms:",original"`
 }
 
@@ -4,9 +4,11 @@ package db
 import (
 	"errors"
 	"fmt"
+	"os"
 	"strings"
 	"sync"
 
+	"github.com/attic-labs/noms/go/chunks"
 	"github.com/attic-labs/noms/go/d"
 	"github.com/attic-labs/noms/go/datas"
 	"github.com/attic-labs/noms/go/hash"
@@ -15,6 +17,7 @@ import (
 	"github.com/attic-labs/noms/go/types"
 
 	"roci.dev/diff-server/kv"
+	"roci.dev/diff-server/util/log"
 	jsnoms "roci.dev/diff-server/util/noms/json"
 )
 
@@ -22,37 +25,102 @@ const (
 	MASTER_DATASET = "master"
 )
 
+var (
+	// ErrReadOnly is returned when trying to change a database that was loaded read-only.
+	ErrReadOnly = errors.New("database is read-only")
+
+	// ErrDatabaseNotFound is returned when loading a database read-only that does not exist.
+	ErrDatabaseNotFound = errors.New("database does not exist")
+)
+
 type DB struct {
 	noms     datas.Database
 	clientID string
 	pusher   pusher
 	puller   puller
+	readOnly bool
 
 	mu   sync.Mutex
 	head Commit
 }
 
+// LoadOptions configures how a database is loaded.
+type LoadOptions struct {
+	// EncryptionKey, if non-empty, is the AES key (16, 24 or 32 bytes) used to encrypt
+	// the database at rest. Only supported for local and in-memory databases.
+	EncryptionKey []byte
+	// Migrations, if any, are run on load to bring the database up to the latest
+	// schema version. See Migrate.
+	Migrations []Migration
+	// ReadOnly loads an existing database without writing anything to it, not even
+	// its client ID. Write transactions and sync fail with ErrReadOnly.
+	ReadOnly bool
+}
+
 func Load(sp spec.Spec) (*DB, error) {
+	return LoadWithOptions(sp, LoadOptions{})
+}
+
+func LoadWithOptions(sp spec.Spec, opts LoadOptions) (*DB, error) {
 	if !sp.Path.IsEmpty() {
 		return nil, errors.New("Invalid spec - must not specify a path")
 	}
+	if !opts.ReadOnly && sp.Protocol == "nbs" {
+		if err := recoverRekey(sp.DatabaseName); err != nil {
+			return nil, fmt.Errorf("could not recover from interrupted rekey: %w", err)
+		}
+	}
+	if opts.ReadOnly && sp.Protocol == "nbs" {
+		// Opening the store would create the directory.
+		if _, err := os.Stat(sp.DatabaseName); os.IsNotExist(err) {
+			return nil, ErrDatabaseNotFound
+		}
+	}
 
 	var noms datas.Database
 	err := d.Try(func() {
-		noms = sp.GetDatabase()
+		if sp.Protocol != "nbs" && len(opts.EncryptionKey) == 0 {
+			noms = sp.GetDatabase()
+			return
+		}
+		cs, err := openChunkStore(sp, opts.EncryptionKey)
+		d.PanicIfError(err)
+		noms = datas.NewDatabase(cs)
 	})
 	if err != nil {
 		err = err.(d.WrappedError).Cause()
 		return nil, err
 	}
-	return New(noms)
+	db, err := newDB(noms, opts.ReadOnly)
+	if err != nil {
+		noms.Close()
+		return nil, err
+	}
+	if len(opts.Migrations) > 0 {
+		if err := db.Migrate(opts.Migrations, log.Default()); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// NewInMemory returns a new, empty DB backed by a noms memory store. Nothing is
+// written to disk and the data is lost when the DB is discarded.
+func NewInMemory() (*DB, error) {
+	return New(datas.NewDatabase((&chunks.MemoryStorage{}).NewView()))
 }
 
 func New(noms datas.Database) (*DB, error) {
+	return newDB(noms, false)
+}
+
+func newDB(noms datas.Database, readOnly bool) (*DB, error) {
 	r := DB{
-		noms:   noms,
-		pusher: &defaultPusher{},
-		puller: &defaultPuller{},
+		noms:     noms,
+		pusher:   &defaultPusher{},
+		puller:   &defaultPuller{},
+		readOnly: readOnly,
 	}
 	// Of course nothing could have a handle on r yet, but still good practice.
 	defer r.lock()()
@@ -69,7 +137,11 @@ func (db *DB) initLocked() error {
 	var err error
 
 	cid := db.clientID
-	if cid == "" {
+	if cid == "" && db.readOnly {
+		var cc ClientConfig
+		cc, err = readClientConfig(db.noms)
+		cid = cc.ClientID
+	} else if cid == "" {
 		// TODO create obfuscated clientID for data layer here as well.
 		cid, err = initClientID(db.noms)
 	}
@@ -79,6 +151,9 @@ func (db *DB) initLocked() error {
 	db.clientID = cid
 
 	ds := db.noms.GetDataset(MASTER_DATASET)
+	if !ds.HasHead() && db.readOnly {
+		return ErrDatabaseNotFound
+	}
 	if !ds.HasHead() {
 		m := kv.NewMap(db.noms)
 		genesis := makeGenesis(db.noms, "", db.noms.WriteValue(m.NomsMap()), m.NomsChecksum(), 0 /*lastMutationID*/)
@@ -113,6 +188,30 @@ func (db DB) ClientID() string {
 	return db.clientID
 }
 
+// ResetClientID gives the database a new, random client ID, so that it is seen as
+// a different client by the data layer and diff-server. It returns the new ID.
+func (db *DB) ResetClientID() (string, error) {
+	if db.readOnly {
+		return "", ErrReadOnly
+	}
+	defer db.lock()()
+	cc, err := readClientConfig(db.noms)
+	if err != nil {
+		return "", err
+	}
+	cc.ClientID = uuid()
+	if _, err := db.noms.CommitValue(db.noms.GetDataset("config"), marshal.MustMarshal(db.noms, cc)); err != nil {
+		return "", err
+	}
+	db.clientID = cc.ClientID
+	return cc.ClientID, nil
+}
+
+// ReadOnly returns true if the database was loaded read-only.
+func (db *DB) ReadOnly() bool {
+	return db.readOnly
+}
+
 func (db *DB) Head() Commit {
 	defer db.lock()()
 	return db.head
@@ -120,6 +219,9 @@ func (db *DB) Head() Commit {
 
 // setHead sets the head commit to newHead and fast-forwards the underlying dataset.
 func (db *DB) setHead(newHead Commit) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
 	defer db.lock()()
 	_, err := db.noms.FastForward(db.noms.GetDataset(MASTER_DATASET), newHead.Ref())
 	if err != nil {
@@ -133,6 +235,11 @@ func (db *DB) HeadHash() hash.Hash {
 	return db.Head().NomsStruct.Hash()
 }
 
+// Close releases the resources held by the underlying noms database.
+func (db *DB) Close() error {
+	return db.noms.Close()
+}
+
 func (db *DB) Reload() error {
 	defer db.lock()()
 	db.noms.Rebase()
@@ -2,8 +2,11 @@ package db
 
 import (
 	"errors"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/attic-labs/noms/go/spec"
@@ -135,3 +138,109 @@ func TestConflictingCommits(t *testing.T) {
 	assert.True(errors.As(err, &commitErrror))
 	assert.True(ref2.IsZeroValue())
 }
+
+func TestNewInMemory(t *testing.T) {
+	assert := assert.New(t)
+	db, err := NewInMemory()
+	assert.NoError(err)
+	assert.NotEqual("", db.ClientID())
+
+	tx := db.NewTransaction()
+	assert.NoError(tx.Put("foo", []byte(`"bar"`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+
+	tx = db.NewTransaction()
+	v, err := tx.Get("foo")
+	assert.NoError(err)
+	assert.Equal(`"bar"`, string(v))
+	assert.NoError(tx.Close())
+
+	// Each in-memory DB is independent.
+	db2, err := NewInMemory()
+	assert.NoError(err)
+	tx = db2.NewTransaction()
+	ok, err := tx.Has("foo")
+	assert.NoError(err)
+	assert.False(ok)
+	assert.NoError(tx.Close())
+}
+
+func TestReadOnly(t *testing.T) {
+	assert := assert.New(t)
+	td, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	load := func(dir string) (*DB, error) {
+		sp, err := spec.ForDatabase(dir)
+		assert.NoError(err)
+		return LoadWithOptions(sp, LoadOptions{ReadOnly: true})
+	}
+
+	dir := filepath.Join(td, "db")
+	_, err = load(dir)
+	assert.Equal(ErrDatabaseNotFound, err)
+	_, err = os.Stat(dir)
+	assert.True(os.IsNotExist(err))
+
+	// An existing directory without a database in it is not a database either.
+	assert.NoError(os.Mkdir(dir, 0777))
+	_, err = load(dir)
+	assert.Equal(ErrDatabaseNotFound, err)
+
+	db, dir := LoadTempDB(assert)
+	tx := db.NewTransaction()
+	assert.NoError(tx.Put("foo", []byte(`"bar"`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+	cid, head := db.ClientID(), db.HeadHash()
+	assert.NoError(db.Close())
+
+	db, err = load(dir)
+	assert.NoError(err)
+	assert.True(db.ReadOnly())
+	assert.Equal(cid, db.ClientID())
+	assert.Equal(head, db.HeadHash())
+
+	tx = db.NewTransaction()
+	v, err := tx.Get("foo")
+	assert.NoError(err)
+	assert.Equal(`"bar"`, string(v))
+	assert.Equal(ErrReadOnly, tx.Put("foo", []byte(`"baz"`)))
+	_, err = tx.Del("foo")
+	assert.Equal(ErrReadOnly, err)
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+
+	_, _, err = db.BeginSync("", "", "", "", log.Default())
+	assert.Equal(ErrReadOnly, err)
+	_, err = db.MaybeEndSync(head)
+	assert.Equal(ErrReadOnly, err)
+	assert.Equal(ErrReadOnly, db.setHead(db.Head()))
+	assert.Equal(head, db.HeadHash())
+	assert.NoError(db.Close())
+}
+
+func TestResetClientID(t *testing.T) {
+	assert := assert.New(t)
+	db, dir := LoadTempDB(assert)
+	cid := db.ClientID()
+
+	ncid, err := db.ResetClientID()
+	assert.NoError(err)
+	assert.NotEqual(cid, ncid)
+	assert.Equal(ncid, db.ClientID())
+	assert.NoError(db.Close())
+
+	sp, err := spec.ForDatabase(dir)
+	assert.NoError(err)
+	db, err = Load(sp)
+	assert.NoError(err)
+	assert.Equal(ncid, db.ClientID())
+	assert.NoError(db.Close())
+
+	db, err = LoadWithOptions(sp, LoadOptions{ReadOnly: true})
+	assert.NoError(err)
+	_, err = db.ResetClientID()
+	assert.Equal(ErrReadOnly, err)
+	assert.Equal(ncid, db.ClientID())
+}
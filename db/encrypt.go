@@ -0,0 +1,328 @@
+package db
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/attic-labs/noms/go/chunks"
+	"github.com/attic-labs/noms/go/d"
+	"github.com/attic-labs/noms/go/hash"
+	"github.com/attic-labs/noms/go/nbs"
+	"github.com/attic-labs/noms/go/spec"
+	"github.com/attic-labs/noms/go/types"
+)
+
+const (
+	// Same as the memtable size noms uses for local databases.
+	memTableSize = 1 << 28
+)
+
+var (
+	// encryptedChunkMagic prefixes every chunk written by an encryptedChunkStore.
+	// No noms chunk starts with these bytes, so it also lets us tell an encrypted
+	// database from a plaintext one.
+	encryptedChunkMagic = []byte("rce1")
+
+	// ErrWrongEncryptionKey is returned when a database cannot be decrypted with
+	// the provided key.
+	ErrWrongEncryptionKey = errors.New("could not decrypt database: wrong encryption key or database is not encrypted")
+
+	// ErrEncryptionKeyRequired is returned when opening an encrypted database
+	// without a key.
+	ErrEncryptionKeyRequired = errors.New("database is encrypted: an encryption key is required")
+)
+
+// encryptedChunkStore wraps a ChunkStore, sealing each chunk with AES-GCM before
+// it is written and opening it again when it is read. Chunks keep their plaintext
+// hash as address, which is also used as additional data so that a chunk cannot
+// be moved to a different address undetected.
+type encryptedChunkStore struct {
+	chunks.ChunkStore
+	aead cipher.AEAD
+}
+
+func newEncryptedChunkStore(cs chunks.ChunkStore, key []byte) (*encryptedChunkStore, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedChunkStore{cs, aead}, nil
+}
+
+func (s *encryptedChunkStore) seal(h hash.Hash, data []byte) []byte {
+	nonce := make([]byte, s.aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	d.PanicIfError(err)
+	out := append([]byte{}, encryptedChunkMagic...)
+	out = append(out, nonce...)
+	return s.aead.Seal(out, nonce, data, h[:])
+}
+
+func (s *encryptedChunkStore) open(h hash.Hash, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, encryptedChunkMagic) {
+		return nil, ErrWrongEncryptionKey
+	}
+	data = data[len(encryptedChunkMagic):]
+	ns := s.aead.NonceSize()
+	if len(data) < ns {
+		return nil, ErrWrongEncryptionKey
+	}
+	plain, err := s.aead.Open(nil, data[:ns], data[ns:], h[:])
+	if err != nil {
+		return nil, ErrWrongEncryptionKey
+	}
+	return plain, nil
+}
+
+func (s *encryptedChunkStore) decrypt(c chunks.Chunk) chunks.Chunk {
+	if c.IsEmpty() {
+		return c
+	}
+	plain, err := s.open(c.Hash(), c.Data())
+	d.PanicIfError(err)
+	return chunks.NewChunkWithHash(c.Hash(), plain)
+}
+
+func (s *encryptedChunkStore) Get(h hash.Hash) chunks.Chunk {
+	return s.decrypt(s.ChunkStore.Get(h))
+}
+
+func (s *encryptedChunkStore) GetMany(hashes hash.HashSet, foundChunks chan *chunks.Chunk) {
+	found := make(chan *chunks.Chunk, len(hashes))
+	s.ChunkStore.GetMany(hashes, found)
+	close(found)
+	for c := range found {
+		dc := s.decrypt(*c)
+		foundChunks <- &dc
+	}
+}
+
+func (s *encryptedChunkStore) Put(c chunks.Chunk) {
+	s.ChunkStore.Put(chunks.NewChunkWithHash(c.Hash(), s.seal(c.Hash(), c.Data())))
+}
+
+// verify checks that the root chunk, if any, can be decrypted with our key.
+func (s *encryptedChunkStore) verify() error {
+	root := s.ChunkStore.Root()
+	if root.IsEmpty() {
+		return nil
+	}
+	c := s.ChunkStore.Get(root)
+	if c.IsEmpty() {
+		return nil
+	}
+	_, err := s.open(root, c.Data())
+	return err
+}
+
+// isEncrypted returns true if the root chunk of cs was written by an encryptedChunkStore.
+func isEncrypted(cs chunks.ChunkStore) bool {
+	root := cs.Root()
+	if root.IsEmpty() {
+		return false
+	}
+	return bytes.HasPrefix(cs.Get(root).Data(), encryptedChunkMagic)
+}
+
+// newChunkStore returns a fresh ChunkStore for the local (nbs) or in-memory database
+// described by sp.
+func newChunkStore(sp spec.Spec) (chunks.ChunkStore, error) {
+	switch sp.Protocol {
+	case "nbs":
+		if err := os.MkdirAll(sp.DatabaseName, 0777); err != nil {
+			return nil, err
+		}
+		return nbs.NewLocalStore(sp.DatabaseName, memTableSize), nil
+	case "mem":
+		return (&chunks.MemoryStorage{}).NewView(), nil
+	}
+	return nil, fmt.Errorf("encryption is not supported for %s databases", sp.Protocol)
+}
+
+// openChunkStore opens the ChunkStore for sp, decrypting it with key if non-empty.
+func openChunkStore(sp spec.Spec, key []byte) (chunks.ChunkStore, error) {
+	cs, err := newChunkStore(sp)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		if isEncrypted(cs) {
+			cs.Close()
+			return nil, ErrEncryptionKeyRequired
+		}
+		return cs, nil
+	}
+	ecs, err := newEncryptedChunkStore(cs, key)
+	if err != nil {
+		cs.Close()
+		return nil, err
+	}
+	if err := ecs.verify(); err != nil {
+		cs.Close()
+		return nil, err
+	}
+	return ecs, nil
+}
+
+// Rekey re-encrypts the local database described by sp, which is currently encrypted
+// with oldKey, with newKey. Either key may be empty, meaning plaintext, so Rekey can
+// also be used to encrypt or decrypt an existing database. The database must not be
+// open while Rekey runs.
+//
+// The re-encrypted copy is swapped in place of the database with two renames. If
+// Rekey is interrupted, eg by a crash, the database is rolled back to oldKey the
+// next time it is loaded or rekeyed, see recoverRekey.
+func Rekey(sp spec.Spec, oldKey, newKey []byte) error {
+	if sp.Protocol != "nbs" {
+		return fmt.Errorf("rekey is not supported for %s databases", sp.Protocol)
+	}
+	if err := recoverRekey(sp.DatabaseName); err != nil {
+		return fmt.Errorf("could not recover from interrupted rekey: %w", err)
+	}
+
+	src, err := openChunkStore(sp, oldKey)
+	if err != nil {
+		return err
+	}
+	tmp, old, marker := rekeyPaths(sp.DatabaseName)
+	err = copyToNewStore(src, tmp, newKey)
+	src.Close()
+	if err != nil {
+		os.RemoveAll(tmp)
+		return fmt.Errorf("rekey failed: %w", err)
+	}
+
+	// From here on the marker tells recoverRekey that old, if it exists, is the
+	// original database.
+	if err := ioutil.WriteFile(marker, nil, 0666); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.Rename(sp.DatabaseName, old); err != nil {
+		return rollbackRekey(sp.DatabaseName, err)
+	}
+	if err := os.Rename(tmp, sp.DatabaseName); err != nil {
+		return rollbackRekey(sp.DatabaseName, err)
+	}
+	// Removing the marker commits the rekey.
+	if err := os.Remove(marker); err != nil {
+		return rollbackRekey(sp.DatabaseName, err)
+	}
+	// The rekey succeeded even if this fails, recoverRekey removes the leftover.
+	os.RemoveAll(old)
+	return nil
+}
+
+// rekeyPaths returns the paths Rekey uses next to the database directory dir: the
+// re-encrypted copy, the original while it is being replaced, and the marker that
+// exists while the two are being swapped.
+func rekeyPaths(dir string) (tmp, old, marker string) {
+	return dir + ".rekey", dir + ".old", dir + ".rekey-swap"
+}
+
+// rollbackRekey restores the original database after the swap in Rekey failed
+// with err, which it returns.
+func rollbackRekey(dir string, err error) error {
+	if rerr := recoverRekey(dir); rerr != nil {
+		return fmt.Errorf("rekey failed: %s, rollback failed: %w", err, rerr)
+	}
+	return fmt.Errorf("rekey failed: %w", err)
+}
+
+// recoverRekey rolls back an interrupted Rekey of the database in dir and removes
+// what is left over from earlier attempts. Like Rekey, it must not run while the
+// database is open.
+func recoverRekey(dir string) error {
+	tmp, old, marker := rekeyPaths(dir)
+	if _, err := os.Stat(marker); os.IsNotExist(err) {
+		// Either no rekey was interrupted, or it was before the swap started or after
+		// it completed. The database in dir is intact either way.
+		if err := os.RemoveAll(tmp); err != nil {
+			return err
+		}
+		return os.RemoveAll(old)
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(old); err == nil {
+		// The original was moved aside, and dir is either missing or the copy.
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+		if err := os.Rename(old, dir); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	return os.Remove(marker)
+}
+
+// copyToNewStore creates a new local store in dir, encrypted with key if non-empty,
+// and copies the current state of src into it.
+func copyToNewStore(src chunks.ChunkStore, dir string, key []byte) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	var dst chunks.ChunkStore = nbs.NewLocalStore(dir, memTableSize)
+	defer dst.Close()
+	if len(key) > 0 {
+		ecs, err := newEncryptedChunkStore(dst, key)
+		if err != nil {
+			return err
+		}
+		dst = ecs
+	}
+
+	err := d.Try(func() {
+		root := src.Root()
+		if !root.IsEmpty() {
+			copyChunks(src, dst, root)
+		}
+		d.PanicIfFalse(dst.Commit(root, dst.Root()))
+	})
+	if err != nil {
+		return err.(d.WrappedError).Cause()
+	}
+	return nil
+}
+
+// copyChunks copies every chunk reachable from root from src to dst.
+func copyChunks(src, dst chunks.ChunkStore, root hash.Hash) {
+	seen := hash.HashSet{}
+	queue := []hash.Hash{root}
+	for len(queue) > 0 {
+		h := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if seen.Has(h) {
+			continue
+		}
+		seen.Insert(h)
+		c := src.Get(h)
+		if c.IsEmpty() {
+			d.Panic("chunk %s not found", h)
+		}
+		dst.Put(c)
+		types.WalkRefs(c, func(r types.Ref) {
+			queue = append(queue, r.TargetHash())
+		})
+	}
+}
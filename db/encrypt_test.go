@@ -0,0 +1,235 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/attic-labs/noms/go/spec"
+	"github.com/stretchr/testify/assert"
+	"roci.dev/diff-server/util/log"
+)
+
+func loadEncrypted(assert *assert.Assertions, dir string, key []byte) (*DB, error) {
+	sp, err := spec.ForDatabase(dir)
+	assert.NoError(err)
+	return LoadWithOptions(sp, LoadOptions{EncryptionKey: key})
+}
+
+func assertOnDiskContains(assert *assert.Assertions, dir string, s string, expected bool) {
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	assert.NoError(err)
+	found := false
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		assert.NoError(err)
+		if bytes.Contains(b, []byte(s)) {
+			found = true
+		}
+	}
+	assert.Equal(expected, found)
+}
+
+func TestEncryption(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	key := bytes.Repeat([]byte{1}, 32)
+
+	db, err := loadEncrypted(assert, dir, key)
+	assert.NoError(err)
+	tx := db.NewTransaction()
+	assert.NoError(tx.Put("foo", []byte(`"verysecretvalue"`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+	assert.NoError(db.Close())
+	assertOnDiskContains(assert, dir, "verysecretvalue", false)
+
+	db, err = loadEncrypted(assert, dir, key)
+	assert.NoError(err)
+	tx = db.NewTransaction()
+	v, err := tx.Get("foo")
+	assert.NoError(err)
+	assert.Equal(`"verysecretvalue"`, string(v))
+	assert.NoError(tx.Close())
+	assert.NoError(db.Close())
+
+	db, err = loadEncrypted(assert, dir, nil)
+	assert.Nil(db)
+	assert.Equal(ErrEncryptionKeyRequired, err)
+
+	db, err = loadEncrypted(assert, dir, bytes.Repeat([]byte{2}, 32))
+	assert.Nil(db)
+	assert.Equal(ErrWrongEncryptionKey, err)
+
+	db, err = loadEncrypted(assert, dir, []byte("short"))
+	assert.Nil(db)
+	assert.EqualError(err, "invalid encryption key: crypto/aes: invalid key size 5")
+
+	// A plaintext database cannot be opened with a key.
+	db, dir = LoadTempDB(assert)
+	assert.NoError(db.Close())
+	db, err = loadEncrypted(assert, dir, key)
+	assert.Nil(db)
+	assert.Equal(ErrWrongEncryptionKey, err)
+}
+
+func TestRekey(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	sp, err := spec.ForDatabase(dir)
+	assert.NoError(err)
+	k1 := bytes.Repeat([]byte{1}, 32)
+	k2 := bytes.Repeat([]byte{2}, 16)
+
+	db, err := loadEncrypted(assert, dir, k1)
+	assert.NoError(err)
+	tx := db.NewTransaction()
+	assert.NoError(tx.Put("foo", []byte(`"verysecretvalue"`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+	head := db.HeadHash()
+	cid := db.ClientID()
+	assert.NoError(db.Close())
+
+	assert.Equal(ErrWrongEncryptionKey, Rekey(sp, k2, k1))
+
+	tc := []struct {
+		oldKey, newKey []byte
+		onDisk         bool
+	}{
+		{k1, k2, false},
+		{k2, nil, true},
+		{nil, k1, false},
+	}
+	for i, t := range tc {
+		assert.NoError(Rekey(sp, t.oldKey, t.newKey), "test case %d", i)
+		assertOnDiskContains(assert, dir, "verysecretvalue", t.onDisk)
+
+		if len(t.oldKey) > 0 {
+			_, err = loadEncrypted(assert, dir, t.oldKey)
+			assert.Error(err, "test case %d", i)
+		}
+		db, err = loadEncrypted(assert, dir, t.newKey)
+		assert.NoError(err, "test case %d", i)
+		assert.Equal(head, db.HeadHash(), "test case %d", i)
+		assert.Equal(cid, db.ClientID(), "test case %d", i)
+		assert.NoError(db.Close())
+	}
+}
+
+func TestRekeyInterrupted(t *testing.T) {
+	assert := assert.New(t)
+	k1 := bytes.Repeat([]byte{1}, 32)
+	k2 := bytes.Repeat([]byte{2}, 16)
+
+	exists := func(p string) bool {
+		_, err := os.Stat(p)
+		return err == nil
+	}
+
+	tc := []struct {
+		name string
+		// interrupt leaves the database in dir as a Rekey from k1 to k2 interrupted at
+		// some point would.
+		interrupt func(dir string)
+	}{
+		{"copy incomplete", func(dir string) {
+			tmp, _, _ := rekeyPaths(dir)
+			assert.NoError(os.MkdirAll(tmp, 0777))
+			assert.NoError(ioutil.WriteFile(filepath.Join(tmp, "garbage"), []byte("garbage"), 0666))
+		}},
+		{"original moved aside", func(dir string) {
+			tmp, old, marker := rekeyPaths(dir)
+			copyForRekey(assert, dir, k1, k2)
+			assert.NoError(ioutil.WriteFile(marker, nil, 0666))
+			assert.NoError(os.Rename(dir, old))
+			assert.True(exists(tmp))
+			assert.False(exists(dir))
+		}},
+		{"copy swapped in", func(dir string) {
+			tmp, old, marker := rekeyPaths(dir)
+			copyForRekey(assert, dir, k1, k2)
+			assert.NoError(ioutil.WriteFile(marker, nil, 0666))
+			assert.NoError(os.Rename(dir, old))
+			assert.NoError(os.Rename(tmp, dir))
+		}},
+		{"original left over", func(dir string) {
+			_, old, _ := rekeyPaths(dir)
+			assert.NoError(copyDir(dir, old))
+		}},
+	}
+
+	for _, c := range tc {
+		for _, rekey := range []bool{false, true} {
+			msg := fmt.Sprintf("%s, rekey: %t", c.name, rekey)
+			dir, err := ioutil.TempDir("", "")
+			assert.NoError(err)
+			sp, err := spec.ForDatabase(dir)
+			assert.NoError(err)
+
+			db, err := loadEncrypted(assert, dir, k1)
+			assert.NoError(err)
+			tx := db.NewTransaction()
+			assert.NoError(tx.Put("foo", []byte(`"bar"`)))
+			_, err = tx.Commit(log.Default())
+			assert.NoError(err)
+			head := db.HeadHash()
+			assert.NoError(db.Close())
+
+			c.interrupt(dir)
+
+			// Either loading or rekeying again rolls back to the original database.
+			key := k1
+			if rekey {
+				assert.NoError(Rekey(sp, k1, k2), msg)
+				key = k2
+			}
+			db, err = loadEncrypted(assert, dir, key)
+			if assert.NoError(err, msg) {
+				assert.Equal(head, db.HeadHash(), msg)
+				assert.NoError(db.Close())
+			}
+			for _, p := range []string{dir + ".rekey", dir + ".old", dir + ".rekey-swap"} {
+				assert.False(exists(p), "%s: %s exists", msg, p)
+			}
+		}
+	}
+}
+
+// copyForRekey makes the re-encrypted copy of the database in dir that Rekey
+// swaps in.
+func copyForRekey(assert *assert.Assertions, dir string, oldKey, newKey []byte) {
+	sp, err := spec.ForDatabase(dir)
+	assert.NoError(err)
+	src, err := openChunkStore(sp, oldKey)
+	assert.NoError(err)
+	defer src.Close()
+	tmp, _, _ := rekeyPaths(dir)
+	assert.NoError(copyToNewStore(src, tmp, newKey))
+}
+
+// copyDir copies the files in src to the new directory dst.
+func copyDir(src, dst string) error {
+	if err := os.MkdirAll(dst, 0777); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		b, err := ioutil.ReadFile(filepath.Join(src, fi.Name()))
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dst, fi.Name()), b, 0666); err != nil {
+			return err
+		}
+	}
+	return nil
+}
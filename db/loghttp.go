@@ -0,0 +1,46 @@
+package db
+
+import (
+	"net/http"
+	"time"
+
+	"roci.dev/diff-server/util/log"
+)
+
+// logTransport logs the http requests of pull and push at debug level. Unlike
+// roci.dev/diff-server/util/loghttp it never logs credentials: the
+// Authorization header is redacted and bodies, which may contain the client
+// view auth, are not logged at all.
+//
+// Pull and push are the only http requests repm makes, so this is all the http
+// logging there is. loghttp must not be imported: it wraps http.DefaultTransport,
+// which logTransport builds on, and would log the credentials again.
+type logTransport struct {
+	http.RoundTripper
+}
+
+func newHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: logTransport{http.DefaultTransport},
+	}
+}
+
+func (t logTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u := *req.URL
+	u.User = nil
+	e := log.Default().Debug().
+		Str("method", req.Method).
+		Str("url", u.String()).
+		Str("auth", redactAuth(req.Header.Get("Authorization")))
+
+	t0 := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+	e = e.Dur("dur", time.Since(t0))
+	if err != nil {
+		e.Err(err).Msg("http request failed")
+		return resp, err
+	}
+	e.Int("status", resp.StatusCode).Msg("http request")
+	return resp, nil
+}
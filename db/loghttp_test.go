@@ -0,0 +1,45 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	zl "github.com/rs/zerolog"
+	zlog "github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPLogIsRedacted(t *testing.T) {
+	assert := assert.New(t)
+	db, _ := LoadTempDB(assert)
+
+	var buf bytes.Buffer
+	defer func(l zl.Logger, lvl zl.Level) {
+		zlog.Logger = l
+		zl.SetGlobalLevel(lvl)
+	}(zlog.Logger, zl.GetGlobalLevel())
+	zlog.Logger = zlog.Output(&buf)
+	zl.SetGlobalLevel(zl.DebugLevel)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	puller := &defaultPuller{}
+	_, _, err := puller.Pull(db.noms, db.Head(), fmt.Sprintf("%s/pull", server.URL), "diffserversecret", "clientviewsecret", db.clientID)
+	assert.Error(err)
+	pusher := &defaultPusher{}
+	info := pusher.Push([]Local{}, fmt.Sprintf("%s/push", server.URL), "datalayersecret", "obfuscated")
+	assert.Equal(http.StatusInternalServerError, info.HTTPStatusCode)
+
+	assert.Contains(buf.String(), server.URL+"/pull")
+	assert.Contains(buf.String(), server.URL+"/push")
+	for _, s := range []string{"diffserversecret", "clientviewsecret", "datalayersecret"} {
+		assert.NotContains(buf.String(), s)
+	}
+	assert.Contains(buf.String(), `"clientViewAuth":"<redacted>"`)
+}
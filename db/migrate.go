@@ -0,0 +1,72 @@
+package db
+
+import (
+	"fmt"
+
+	zl "github.com/rs/zerolog"
+
+	jsnoms "roci.dev/diff-server/util/noms/json"
+)
+
+// migrationPrefix prefixes the mutation names of the commits migrations make.
+const migrationPrefix = ".migrate/"
+
+// Migration upgrades the data in a database from one schema version to the next.
+type Migration struct {
+	// Name is used, prefixed with ".migrate/", as the mutation name of the local
+	// commit the migration makes.
+	Name string
+	// Migrate rewrites the data in tx. It must not commit or close tx.
+	Migrate func(tx *Transaction) error
+}
+
+// SchemaVersion returns the schema version of the data in the database. Databases
+// that have never been migrated are at version 0.
+func (db *DB) SchemaVersion() (uint64, error) {
+	cc, err := readClientConfig(db.noms)
+	if err != nil {
+		return 0, err
+	}
+	return cc.SchemaVersion, nil
+}
+
+// Migrate brings the database up to the latest schema version by running the
+// migrations it has not run yet, in order. migrations[i] upgrades data from schema
+// version i to i+1, so the latest version is len(migrations).
+//
+// Each migration that changes data is committed as a local commit that stays
+// local: it is not pushed to the data layer and not replayed on top of the next
+// sync snapshot, which replaces the migrated data with the data layer's. The data
+// layer is thus expected to serve data in the latest schema version. The schema
+// version is recorded after the commit lands, so if the process dies in between
+// the migration runs again on next load: migrations should be idempotent.
+func (db *DB) Migrate(migrations []Migration, l zl.Logger) error {
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > uint64(len(migrations)) {
+		return fmt.Errorf("database schema version %d is newer than the latest known version %d", version, len(migrations))
+	}
+	if db.readOnly && version < uint64(len(migrations)) {
+		return fmt.Errorf("%w: cannot migrate from schema version %d to %d", ErrReadOnly, version, len(migrations))
+	}
+
+	for ; version < uint64(len(migrations)); version++ {
+		m := migrations[version]
+		tx := db.NewTransactionWithArgs(migrationPrefix+m.Name, jsnoms.Null(), nil, nil)
+		tx.migration = true
+		if err := m.Migrate(tx); err != nil {
+			tx.Close()
+			return fmt.Errorf("migration to schema version %d (%s) failed: %w", version+1, m.Name, err)
+		}
+		if _, err := tx.Commit(l); err != nil {
+			return fmt.Errorf("could not commit migration to schema version %d (%s): %w", version+1, m.Name, err)
+		}
+		if err := writeSchemaVersion(db.noms, version+1); err != nil {
+			return err
+		}
+		l.Info().Msgf("Migrated database to schema version %d (%s)", version+1, m.Name)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/attic-labs/noms/go/spec"
+	"github.com/attic-labs/noms/go/types"
+	"github.com/stretchr/testify/assert"
+	"roci.dev/diff-server/kv"
+	"roci.dev/diff-server/util/log"
+	nomsjson "roci.dev/diff-server/util/noms/json"
+)
+
+func TestMigrate(t *testing.T) {
+	assert := assert.New(t)
+	db, dir := LoadTempDB(assert)
+	cid := db.ClientID()
+
+	v, err := db.SchemaVersion()
+	assert.NoError(err)
+	assert.Equal(uint64(0), v)
+
+	tx := db.NewTransaction()
+	assert.NoError(tx.Put("foo", []byte(`"bar"`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+
+	migrations := []Migration{
+		{"rename-foo", func(tx *Transaction) error {
+			v, err := tx.Get("foo")
+			if err != nil || v == nil {
+				return err
+			}
+			if _, err := tx.Del("foo"); err != nil {
+				return err
+			}
+			return tx.Put("baz", v)
+		}},
+		{"add-version", func(tx *Transaction) error {
+			return tx.Put("version", []byte(`2`))
+		}},
+	}
+
+	assert.NoError(db.Migrate(migrations[:1], log.Default()))
+	v, err = db.SchemaVersion()
+	assert.NoError(err)
+	assert.Equal(uint64(1), v)
+	head := db.Head()
+	assert.Equal(CommitTypeLocal, head.Type())
+	assert.Equal(".migrate/rename-foo", head.Meta.Local.Name)
+	assert.True(head.IsMigration())
+	tx = db.NewTransaction()
+	has, err := tx.Has("foo")
+	assert.NoError(err)
+	assert.False(has)
+	val, err := tx.Get("baz")
+	assert.NoError(err)
+	assert.Equal(`"bar"`, string(val))
+	assert.NoError(tx.Close())
+	assert.NoError(db.Close())
+
+	// Remaining migrations run on load.
+	sp, err := spec.ForDatabase(dir)
+	assert.NoError(err)
+	db, err = LoadWithOptions(sp, LoadOptions{Migrations: migrations})
+	assert.NoError(err)
+	v, err = db.SchemaVersion()
+	assert.NoError(err)
+	assert.Equal(uint64(2), v)
+	assert.Equal(cid, db.ClientID())
+	assert.Equal(".migrate/add-version", db.Head().Meta.Local.Name)
+
+	// Migrating an up to date database does nothing.
+	head = db.Head()
+	assert.NoError(db.Migrate(migrations, log.Default()))
+	assert.True(head.NomsStruct.Equals(db.Head().NomsStruct))
+
+	assert.EqualError(db.Migrate(migrations[:1], log.Default()), "database schema version 2 is newer than the latest known version 1")
+
+	// A failed migration leaves the database untouched.
+	failing := append(migrations, Migration{"fail", func(tx *Transaction) error {
+		assert.NoError(tx.Put("hot", []byte(`"dog"`)))
+		return errors.New("boom")
+	}})
+	assert.EqualError(db.Migrate(failing, log.Default()), "migration to schema version 3 (fail) failed: boom")
+	v, err = db.SchemaVersion()
+	assert.NoError(err)
+	assert.Equal(uint64(2), v)
+	assert.True(head.NomsStruct.Equals(db.Head().NomsStruct))
+}
+
+func TestMigrateSync(t *testing.T) {
+	assert := assert.New(t)
+	db, _ := LoadTempDB(assert)
+
+	put := func(key string) {
+		tx := db.NewTransactionWithArgs("put", types.String(key), nil, nil)
+		assert.NoError(tx.Put(key, []byte(`true`)))
+		_, err := tx.Commit(log.Default())
+		assert.NoError(err)
+	}
+	put("foo")
+	assert.NoError(db.Migrate([]Migration{{"add-version", func(tx *Transaction) error {
+		return tx.Put("version", []byte(`1`))
+	}}}, log.Default()))
+	migration := db.Head()
+	assert.True(migration.IsMigration())
+	assert.Equal(uint64(1), migration.MutationID())
+	put("bar")
+	assert.Equal(uint64(2), db.Head().MutationID())
+
+	// The migration is not pushed.
+	genesis := db.Head()
+	for genesis.Type() == CommitTypeLocal {
+		var err error
+		genesis, err = genesis.Basis(db.noms)
+		assert.NoError(err)
+	}
+	m := kv.NewMap(db.noms)
+	snapshot := makeSnapshot(db.noms, genesis.Ref(), "newssid", db.noms.WriteValue(m.NomsMap()), m.NomsChecksum(), 0)
+	pusher := fakePusher{}
+	db.pusher = &pusher
+	db.puller = &fakePuller{newSnapshot: snapshot}
+	syncHead, _, err := db.BeginSync("https://example.com/push", "https://example.com/pull", "diffServerAuth", "dataLayerAuth", log.Default())
+	assert.NoError(err)
+	var pushed []string
+	for _, l := range pusher.gotPending {
+		pushed = append(pushed, fmt.Sprintf("%d %s", l.MutationID, l.Name))
+	}
+	assert.Equal([]string{"1 put", "2 put"}, pushed)
+
+	// Nor replayed, and the mutations after it replay with their own IDs.
+	replay, err := db.MaybeEndSync(syncHead)
+	assert.NoError(err)
+	var replayed []string
+	for _, r := range replay {
+		replayed = append(replayed, fmt.Sprintf("%d %s", r.ID, r.Name))
+		original, err := ReadCommit(db.noms, r.Original.Hash)
+		assert.NoError(err)
+		basis, err := ReadCommit(db.noms, syncHead)
+		assert.NoError(err)
+		args, err := nomsjson.FromJSON(r.Args, db.noms)
+		assert.NoError(err)
+		tx := db.NewTransactionWithArgs(r.Name, args, &basis, &original)
+		assert.NoError(tx.Put(string(args.(types.String)), []byte(`true`)))
+		ref, err := tx.Commit(log.Default())
+		assert.NoError(err)
+		syncHead = ref.TargetHash()
+	}
+	assert.Equal([]string{"1 put", "2 put"}, replayed)
+	replay, err = db.MaybeEndSync(syncHead)
+	assert.NoError(err)
+	assert.Empty(replay)
+	assert.Equal(syncHead, db.Head().NomsStruct.Hash())
+	v, _ := db.Head().Data(db.noms).NomsMap().MaybeGet(types.String("version"))
+	assert.Nil(v)
+}
@@ -11,10 +11,11 @@ import (
 
 	"roci.dev/diff-server/kv"
 	servetypes "roci.dev/diff-server/serve/types"
+	"roci.dev/diff-server/util/log"
 
 	"github.com/attic-labs/noms/go/types"
-	"github.com/attic-labs/noms/go/util/verbose"
 	"github.com/pkg/errors"
+	zl "github.com/rs/zerolog"
 )
 
 func baseSnapshot(noms types.ValueReadWriter, c Commit) (Commit, error) {
@@ -28,6 +29,26 @@ func baseSnapshot(noms types.ValueReadWriter, c Commit) (Commit, error) {
 	return baseSnapshot(noms, basis)
 }
 
+// redactAuth returns a placeholder for a credential that is safe to log. It
+// still shows whether the credential was set.
+func redactAuth(auth string) string {
+	if auth == "" {
+		return ""
+	}
+	return "<redacted>"
+}
+
+// pullRequest is the request sent to the diff server. Logging it redacts the
+// client view auth.
+type pullRequest servetypes.PullRequest
+
+func (r pullRequest) MarshalZerologObject(e *zl.Event) {
+	e.Str("clientId", r.ClientID).
+		Str("baseStateId", r.BaseStateID).
+		Str("checksum", r.Checksum).
+		Str("clientViewAuth", redactAuth(r.ClientViewAuth))
+}
+
 type puller interface {
 	Pull(noms types.ValueReadWriter, baseState Commit, url string, diffServerAuth string, clientViewAuth string, clientID string) (Commit, servetypes.ClientViewInfo, error)
 }
@@ -38,9 +59,7 @@ type defaultPuller struct {
 
 func (d *defaultPuller) client() *http.Client {
 	if d.c == nil {
-		d.c = &http.Client{
-			Timeout: 20 * time.Second, // Enough time to download 4MB on a slow connection.
-		}
+		d.c = newHTTPClient(20 * time.Second) // Enough time to download 4MB on a slow connection.
 	}
 	return d.c
 }
@@ -50,18 +69,19 @@ func (d *defaultPuller) client() *http.Client {
 // code or the server having a lesser last mutation id.
 func (d *defaultPuller) Pull(noms types.ValueReadWriter, baseState Commit, url string, diffServerAuth string, clientViewAuth string, clientID string) (Commit, servetypes.ClientViewInfo, error) {
 	baseMap := baseState.Data(noms)
-	pullReq, err := json.Marshal(servetypes.PullRequest{
+	pullReq := pullRequest{
 		ClientViewAuth: clientViewAuth,
 		ClientID:       clientID,
 		BaseStateID:    baseState.Meta.Snapshot.ServerStateID,
 		Checksum:       baseMap.Checksum(),
-	})
+	}
+	reqBody, err := json.Marshal(pullReq)
 	if err != nil {
 		return Commit{}, servetypes.ClientViewInfo{}, errors.New("could not marshal PullRequest")
 	}
-	verbose.Log("Pulling: %s from baseStateID %s with auth %s", url, baseState.Meta.Snapshot.ServerStateID, clientViewAuth)
+	log.Default().Debug().Str("url", url).Object("req", pullReq).Msg("Pulling")
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(pullReq))
+	req, err := http.NewRequest("POST", url, bytes.NewReader(reqBody))
 	if err != nil {
 		return Commit{}, servetypes.ClientViewInfo{}, err
 	}
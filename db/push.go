@@ -8,6 +8,9 @@ import (
 	"net/http"
 	"time"
 
+	zl "github.com/rs/zerolog"
+
+	"roci.dev/diff-server/util/log"
 	nomsjson "roci.dev/diff-server/util/noms/json"
 )
 
@@ -16,6 +19,12 @@ type BatchPushRequest struct {
 	Mutations []Mutation `json:"mutations"`
 }
 
+// MarshalZerologObject logs the request without the mutation args, which hold
+// user data. The data layer auth is sent as a header and never part of it.
+func (r BatchPushRequest) MarshalZerologObject(e *zl.Event) {
+	e.Str("clientId", r.ClientID).Int("mutations", len(r.Mutations))
+}
+
 // Public because returned in the MaybeEndSyncResponse.
 type Mutation struct {
 	ID   uint64          `json:"id"`
@@ -55,9 +64,7 @@ type defaultPusher struct {
 
 func (d *defaultPusher) client() *http.Client {
 	if d.c == nil {
-		d.c = &http.Client{
-			Timeout: 20 * time.Second, // Enough time to upload 4MB on a slow connection.
-		}
+		d.c = newHTTPClient(20 * time.Second) // Enough time to upload 4MB on a slow connection.
 	}
 	return d.c
 }
@@ -86,6 +93,7 @@ func (d *defaultPusher) Push(pending []Local, url string, dataLayerAuth string,
 	if err != nil {
 		return withErrMsg(err.Error())
 	}
+	log.Default().Debug().Str("url", url).Object("req", req).Msg("Pushing")
 
 	httpReq, err := http.NewRequest("POST", url, bytes.NewReader(reqBody))
 	if err != nil {
@@ -0,0 +1,72 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/attic-labs/noms/go/datas"
+	"github.com/attic-labs/noms/go/marshal"
+	"github.com/attic-labs/noms/go/types"
+	"github.com/attic-labs/noms/go/util/datetime"
+
+	"roci.dev/diff-server/util/time"
+)
+
+const (
+	REFLOG_DATASET = "reflog"
+)
+
+// ReflogEntry records a move of the head by Reset, or by a sync that confirmed
+// local commits. As the entry references the previous head, that commit is kept
+// around: a reset can be undone by resetting to it, and the local commits a sync
+// confirmed can still be found in its history.
+type ReflogEntry struct {
+	From types.Ref
+	To   types.Ref
+	Date datetime.DateTime
+	// Sync is true if the entry records a sync rather than a reset.
+	Sync bool `noms:",omitempty"`
+}
+
+// Reset moves the head to the commit to, which can be any commit in the database,
+// and records the move in the reflog. Unlike sync, which only moves the head
+// forward, this discards any commits between the old head and to.
+func (db *DB) Reset(to Commit) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	defer db.lock()()
+	if err := appendReflog(db.noms, ReflogEntry{From: db.head.Ref(), To: to.Ref(), Date: time.DateTime()}); err != nil {
+		return err
+	}
+	if _, err := db.noms.SetHead(db.noms.GetDataset(MASTER_DATASET), to.Ref()); err != nil {
+		return err
+	}
+	db.head = to
+	return nil
+}
+
+// Reflog returns the moves of the head made by Reset and sync, oldest first.
+func (db *DB) Reflog() ([]ReflogEntry, error) {
+	return readReflog(db.noms)
+}
+
+func readReflog(noms datas.Database) ([]ReflogEntry, error) {
+	ds := noms.GetDataset(REFLOG_DATASET)
+	var r []ReflogEntry
+	if ds.HasHead() {
+		if err := marshal.Unmarshal(ds.HeadValue(), &r); err != nil {
+			return nil, fmt.Errorf("Could not unmarshal reflog: %s", err.Error())
+		}
+	}
+	return r, nil
+}
+
+func appendReflog(noms datas.Database, e ReflogEntry) error {
+	entries, err := readReflog(noms)
+	if err != nil {
+		return err
+	}
+	entries = append(entries, e)
+	_, err = noms.CommitValue(noms.GetDataset(REFLOG_DATASET), marshal.MustMarshal(noms, entries))
+	return err
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/attic-labs/noms/go/spec"
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/util/log"
+	"roci.dev/diff-server/util/time"
+)
+
+func TestReset(t *testing.T) {
+	assert := assert.New(t)
+	defer time.SetFake()()
+	db, dir := LoadTempDB(assert)
+	genesis := db.Head()
+
+	entries, err := db.Reflog()
+	assert.NoError(err)
+	assert.Empty(entries)
+
+	tx := db.NewTransaction()
+	assert.NoError(tx.Put("foo", []byte(`"bar"`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+	local := db.Head()
+
+	assert.NoError(db.Reset(genesis))
+	assert.True(genesis.NomsStruct.Equals(db.Head().NomsStruct))
+	tx = db.NewTransaction()
+	ok, err := tx.Has("foo")
+	assert.NoError(err)
+	assert.False(ok)
+	tx.Close()
+
+	// Undo the reset.
+	assert.NoError(db.Reset(local))
+	db = reloadDB(assert, dir)
+	assert.True(local.NomsStruct.Equals(db.Head().NomsStruct))
+
+	entries, err = db.Reflog()
+	assert.NoError(err)
+	if assert.Equal(2, len(entries)) {
+		assert.Equal(local.Ref().TargetHash(), entries[0].From.TargetHash())
+		assert.Equal(genesis.Ref().TargetHash(), entries[0].To.TargetHash())
+		assert.Equal(genesis.Ref().TargetHash(), entries[1].From.TargetHash())
+		assert.Equal(local.Ref().TargetHash(), entries[1].To.TargetHash())
+		assert.Equal(time.DateTime().Unix(), entries[1].Date.Unix())
+	}
+
+	sp, err := spec.ForDatabase(dir)
+	assert.NoError(err)
+	db, err = LoadWithOptions(sp, LoadOptions{ReadOnly: true})
+	assert.NoError(err)
+	assert.Equal(ErrReadOnly, db.Reset(genesis))
+}
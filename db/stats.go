@@ -0,0 +1,109 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/attic-labs/noms/go/hash"
+	"github.com/attic-labs/noms/go/types"
+)
+
+// Stats describes the contents of a database.
+type Stats struct {
+	// Keys is the number of keys at head.
+	Keys uint64
+	// PendingMutations is the number of local commits that are not yet part of a snapshot.
+	PendingMutations int
+	// ServerStateID is the server state ID of the most recent snapshot.
+	ServerStateID string
+	// LastSync is when a sync last completed. Zero if the database was never synced.
+	LastSync time.Time
+
+	// The following are only computed if requested, as they require walking the
+	// entire history.
+
+	// CommitChainLength is the number of commits from head back to genesis, both included.
+	CommitChainLength int
+	// Chunks is the number of noms chunks reachable from head.
+	Chunks int
+}
+
+// Stats returns statistics about the database. If detailed is true, CommitChainLength
+// and Chunks are computed as well.
+func (db *DB) Stats(detailed bool) (Stats, error) {
+	head := db.Head()
+	var s Stats
+	s.Keys = head.Data(db.noms).NomsMap().Len()
+
+	pending, err := pendingCommits(db.noms, head)
+	if err != nil {
+		return Stats{}, err
+	}
+	s.PendingMutations = len(pending)
+
+	snapshot, err := baseSnapshot(db.noms, head)
+	if err != nil {
+		return Stats{}, err
+	}
+	s.ServerStateID = snapshot.Meta.Snapshot.ServerStateID
+
+	cc, err := readClientConfig(db.noms)
+	if err != nil {
+		return Stats{}, err
+	}
+	if cc.LastSync != 0 {
+		s.LastSync = time.Unix(0, cc.LastSync*int64(time.Millisecond)).UTC()
+	}
+
+	if !detailed {
+		return s, nil
+	}
+
+	for c := head; ; {
+		s.CommitChainLength++
+		if len(c.Parents) == 0 {
+			break
+		}
+		c, err = c.Basis(db.noms)
+		if err != nil {
+			return Stats{}, err
+		}
+	}
+	s.Chunks = countChunks(db.noms, head.NomsStruct.Hash())
+	return s, nil
+}
+
+// countChunks returns the number of chunks reachable from root.
+func countChunks(vr types.ValueReader, root hash.Hash) int {
+	seen := hash.HashSet{}
+	queue := []hash.Hash{root}
+	for len(queue) > 0 {
+		h := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if seen.Has(h) {
+			continue
+		}
+		seen.Insert(h)
+		vr.ReadValue(h).WalkRefs(func(r types.Ref) {
+			queue = append(queue, r.TargetHash())
+		})
+	}
+	return len(seen)
+}
+
+// DirSize returns the total size of the files in dir, eg the on-disk size of a
+// database.
+func DirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
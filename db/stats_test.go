@@ -0,0 +1,44 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/attic-labs/noms/go/types"
+	"github.com/stretchr/testify/assert"
+	"roci.dev/diff-server/util/log"
+)
+
+func TestStats(t *testing.T) {
+	assert := assert.New(t)
+	db, _ := LoadTempDB(assert)
+
+	s, err := db.Stats(false)
+	assert.NoError(err)
+	assert.Equal(Stats{}, s)
+
+	s, err = db.Stats(true)
+	assert.NoError(err)
+	assert.Equal(1, s.CommitChainLength)
+	assert.True(s.Chunks > 0)
+	genesisChunks := s.Chunks
+
+	for _, keys := range [][]string{{"a", "b"}, {"c"}} {
+		tx := db.NewTransactionWithArgs("put", types.NewList(db.noms), nil, nil)
+		for _, k := range keys {
+			assert.NoError(tx.Put(k, []byte(`true`)))
+		}
+		_, err = tx.Commit(log.Default())
+		assert.NoError(err)
+	}
+	assert.NoError(writeLastSync(db.noms, time.Unix(1500000000, 0)))
+
+	s, err = db.Stats(true)
+	assert.NoError(err)
+	assert.Equal(uint64(3), s.Keys)
+	assert.Equal(2, s.PendingMutations)
+	assert.Equal("", s.ServerStateID)
+	assert.Equal(time.Unix(1500000000, 0).UTC(), s.LastSync)
+	assert.Equal(3, s.CommitChainLength)
+	assert.True(s.Chunks > genesisChunks)
+}
@@ -2,14 +2,36 @@ package db
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 
 	"github.com/attic-labs/noms/go/hash"
 	zl "github.com/rs/zerolog"
 	servetypes "roci.dev/diff-server/serve/types"
+	"roci.dev/diff-server/util/log"
 	nomsjson "roci.dev/diff-server/util/noms/json"
+	"roci.dev/diff-server/util/time"
 )
 
+// ErrSyncAborted is returned by MaybeEndSync when another sync landed on master
+// while the sync was running. The sync can be retried from the start.
+var ErrSyncAborted = errors.New("sync aborted")
+
+// SyncError is used to signal that BeginSync could not complete the pull, eg
+// because the diff-server could not be reached.
+type SyncError struct {
+	error
+}
+
+// NewSyncError creates a new SyncError.
+func NewSyncError(err error) SyncError {
+	return SyncError{err}
+}
+
+func (e SyncError) Unwrap() error {
+	return e.error
+}
+
 type SyncInfo struct {
 	// BatchPushInfo will be set if we attempted to push, ie if there were >0 pending commits.
 	// Status code will be 0 if the request was not sent (eg, connection refused). The
@@ -39,6 +61,9 @@ type SyncInfo struct {
 // invalid argument values, or internal errors.
 func (db *DB) BeginSync(batchPushURL string, diffServerURL string, diffServerAuth string, dataLayerAuth string, l zl.Logger) (syncHead hash.Hash, syncInfo SyncInfo, err error) {
 	syncInfo = SyncInfo{}
+	if db.readOnly {
+		return hash.Hash{}, syncInfo, ErrReadOnly
+	}
 	head := db.Head()
 
 	// Push
@@ -61,14 +86,19 @@ func (db *DB) BeginSync(batchPushURL string, diffServerURL string, diffServerAut
 	// Pull
 	headSnapshot, err := baseSnapshot(db.noms, head)
 	if err != nil {
-		return hash.Hash{}, syncInfo, fmt.Errorf("sync failed: could not find head snapshot: %w", err)
+		return hash.Hash{}, syncInfo, NewSyncError(fmt.Errorf("sync failed: could not find head snapshot: %w", err))
 	}
 	newSnapshot, clientViewInfo, err := db.puller.Pull(db.noms, headSnapshot, diffServerURL, diffServerAuth, dataLayerAuth, db.clientID)
 	if err != nil {
-		return hash.Hash{}, syncInfo, fmt.Errorf("sync failed: pull from %s failed: %w", diffServerURL, err)
+		return hash.Hash{}, syncInfo, NewSyncError(fmt.Errorf("sync failed: pull from %s failed: %w", diffServerURL, err))
 	}
 	syncInfo.ClientViewInfo = clientViewInfo
 	if newSnapshot.Meta.Snapshot.ServerStateID == headSnapshot.Meta.Snapshot.ServerStateID {
+		// Nothing new, the sync is already complete.
+		if err := writeLastSync(db.noms, time.Now()); err != nil {
+			// The sync itself succeeded, only stats are affected.
+			l.Error().Err(err).Msg("Could not record last sync time")
+		}
 		return hash.Hash{}, syncInfo, nil
 	}
 	syncHeadRef := db.noms.WriteValue(newSnapshot.NomsStruct)
@@ -83,6 +113,9 @@ func (db *DB) BeginSync(batchPushURL string, diffServerURL string, diffServerAut
 // that must be replayed are returned. Caller must replay them, then
 // call MaybeEndSync again.
 func (db *DB) MaybeEndSync(syncHead hash.Hash) ([]ReplayMutation, error) {
+	if db.readOnly {
+		return []ReplayMutation{}, ErrReadOnly
+	}
 	syncHeadCommit, err := ReadCommit(db.Noms(), syncHead)
 	if err != nil {
 		return []ReplayMutation{}, err
@@ -117,7 +150,7 @@ func (db *DB) MaybeEndSync(syncHead hash.Hash) ([]ReplayMutation, error) {
 	// some other sync landed a new snapshot on master and we have to abort. We do
 	// not expect this in normal operation, we're being defensive.
 	if !syncSnapshotBasis.NomsStruct.Equals(headSnapshot.NomsStruct) {
-		return []ReplayMutation{}, fmt.Errorf("sync aborted: found a newer snapshot %s on master", headSnapshot.NomsStruct.Hash())
+		return []ReplayMutation{}, fmt.Errorf("%w: found a newer snapshot %s on master", ErrSyncAborted, headSnapshot.NomsStruct.Hash())
 	}
 
 	// Determine if there are any pending mutations that we need to replay.
@@ -155,8 +188,19 @@ func (db *DB) MaybeEndSync(syncHead hash.Hash) ([]ReplayMutation, error) {
 	if err != nil {
 		return []ReplayMutation{}, err
 	}
+	if len(pendingCommits) > 0 {
+		// The confirmed commits are no longer in the history of master. The reflog
+		// keeps the previous head, so that they can still be shown.
+		if err := appendReflog(db.noms, ReflogEntry{From: head.Ref(), To: syncHeadCommit.Ref(), Date: time.DateTime(), Sync: true}); err != nil {
+			log.Default().Error().Err(err).Msg("Could not record the sync in the reflog")
+		}
+	}
 	db.head = syncHeadCommit
 
+	// Master has moved, so the sync must not be reported as failed anymore.
+	if err := writeLastSync(db.noms, time.Now()); err != nil {
+		log.Default().Error().Err(err).Msg("Could not record last sync time")
+	}
 	return []ReplayMutation{}, nil
 }
 
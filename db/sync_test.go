@@ -338,6 +338,16 @@ func TestDB_MaybeEndSync(t *testing.T) {
 			// If successful...
 			if tt.expErr == "" && len(tt.expReplayIds) == 0 {
 				assert.True(syncHead.NomsStruct.Equals(db.Head().NomsStruct))
+				// A sync that confirmed pending commits keeps them in the reflog.
+				entries, err := db.Reflog()
+				assert.NoError(err)
+				if tt.numPending == 0 {
+					assert.Empty(entries)
+				} else if assert.Equal(1, len(entries)) {
+					assert.True(entries[0].Sync)
+					assert.Equal(master.head().Ref().TargetHash(), entries[0].From.TargetHash())
+					assert.Equal(syncHead.Ref().TargetHash(), entries[0].To.TargetHash())
+				}
 			} else {
 				assert.True(master.head().NomsStruct.Equals(db.Head().NomsStruct))
 			}
@@ -34,6 +34,10 @@ type Transaction struct {
 	args     types.Value
 	original *Commit // non-nil for replay transactions.
 
+	// migration is set for the transactions of DB.Migrate. Their commits are
+	// never pushed so they don't take a mutation ID of their own.
+	migration bool
+
 	mutex sync.RWMutex
 }
 
@@ -51,6 +55,17 @@ func (tx *Transaction) lock() func() {
 	}
 }
 
+// Name returns the name of the transaction, empty for transactions opened
+// without one.
+func (tx *Transaction) Name() string {
+	return tx.name
+}
+
+// Basis returns the commit the transaction is based on.
+func (tx *Transaction) Basis() Commit {
+	return tx.basis
+}
+
 // IsReplay returns true if the transaction is a replay.
 func (tx Transaction) IsReplay() bool {
 	return tx.original != nil
@@ -101,11 +116,20 @@ func (tx *Transaction) Scan(opts ScanOptions) ([]ScanItem, error) {
 	return scan(tx.me.Build().NomsMap(), opts)
 }
 
+// Data returns the data of the transaction, including the changes made in it.
+func (tx *Transaction) Data() kv.Map {
+	defer tx.rlock()()
+	return tx.me.Build()
+}
+
 // Put adds or updates an existing entry in the database.
 func (tx *Transaction) Put(id string, json []byte) error {
 	if tx.Closed() {
 		return ErrClosed
 	}
+	if tx.db.readOnly {
+		return ErrReadOnly
+	}
 
 	value, err := nomsjson.FromJSON(json, tx.db.noms)
 	if err != nil {
@@ -131,6 +155,9 @@ func (tx *Transaction) Del(id string) (ok bool, err error) {
 	if tx.closed {
 		return false, ErrClosed
 	}
+	if tx.db.readOnly {
+		return false, ErrReadOnly
+	}
 
 	k := types.String(id)
 	ok = tx.me.Has(k)
@@ -194,7 +221,11 @@ func (tx *Transaction) Commit(l zl.Logger) (ref types.Ref, err error) {
 		return
 	}
 
-	commit = makeLocal(tx.db.noms, basis, time.DateTime(), tx.basis.NextMutationID(), tx.name, tx.args, newData, newDataChecksum)
+	mutationID := tx.basis.NextMutationID()
+	if tx.migration {
+		mutationID = tx.basis.MutationID()
+	}
+	commit = makeLocal(tx.db.noms, basis, time.DateTime(), mutationID, tx.name, tx.args, newData, newDataChecksum)
 	ref = tx.db.noms.WriteValue(commit.NomsStruct)
 	err = tx.db.setHead(commit)
 	if err == nil {
@@ -4,6 +4,7 @@ go 1.12
 
 require (
 	github.com/attic-labs/noms v0.0.0-20191214023511-2a57d6783c14
+	github.com/fxamacker/cbor/v2 v2.2.0
 	github.com/google/uuid v1.1.1 // indirect
 	github.com/lithammer/shortuuid v3.0.0+incompatible
 	github.com/mgutz/ansi v0.0.0-20170206155736-9520e82c474b
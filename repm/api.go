@@ -3,39 +3,228 @@ package repm
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/attic-labs/noms/go/hash"
 	zl "github.com/rs/zerolog"
 	"roci.dev/diff-server/util/chk"
 	jsnoms "roci.dev/diff-server/util/noms/json"
+	rtime "roci.dev/diff-server/util/time"
 	"roci.dev/replicache-client/db"
 )
 
+const (
+	defaultTransactionIdleTimeout = 5 * time.Minute
+	defaultMaxOpenTransactions    = 1000
+)
+
+// transactionLimits bounds the transactions a connection keeps open on behalf
+// of the host, so that a host that crashes or forgets to close them cannot leak
+// them forever.
+type transactionLimits struct {
+	// idleTimeout is how long a transaction may go unused before it is closed.
+	idleTimeout time.Duration
+	// maxOpen is the maximum number of simultaneously open transactions.
+	maxOpen int
+}
+
+var defaultTransactionLimits = transactionLimits{defaultTransactionIdleTimeout, defaultMaxOpenTransactions}
+
+// openTransaction is a transaction opened via the api along with bookkeeping
+// for leak detection.
+type openTransaction struct {
+	tx       *db.Transaction
+	opened   time.Time
+	lastUsed time.Time
+}
+
+func (ot openTransaction) expired(now time.Time, idleTimeout time.Duration) bool {
+	return idleTimeout > 0 && now.Sub(ot.lastUsed) > idleTimeout
+}
+
 type connection struct {
 	dir                string
+	dirLock            *dirLock // nil for in-memory and read-only connections.
 	db                 *db.DB
-	transactions       map[int]*db.Transaction
+	encoding           encoding
+	limits             transactionLimits
+	options            openRequest // what the database was opened with, to reopen it after rename.
+	transactions       map[int]*openTransaction
 	transactionCounter int
-	transactionMutex   sync.RWMutex
+	// expired holds the IDs of transactions that were closed because they were
+	// idle for too long, and when. They are kept until the next attempt to use
+	// them, or for another idle timeout if there is none.
+	expired          map[int]time.Time
+	transactionMutex sync.RWMutex
+	// now is the clock transactions are timed with, rtime.Now outside of tests.
+	now func() time.Time
+
+	// mutex is held exclusively by operations that must not run concurrently
+	// with any other operation on this connection, and shared by all others.
+	// It also guards closed.
+	mutex  sync.RWMutex
+	closed bool
+}
+
+func newConnection(d *db.DB, p string, enc encoding, limits transactionLimits) *connection {
+	return &connection{db: d, dir: p, encoding: enc, limits: limits, transactions: map[int]*openTransaction{}, expired: map[int]time.Time{}, transactionCounter: 1, now: rtime.Now}
+}
+
+func (conn *connection) lock() func() {
+	conn.mutex.Lock()
+	return func() {
+		conn.mutex.Unlock()
+	}
+}
+
+func (conn *connection) rlock() func() {
+	conn.mutex.RLock()
+	return func() {
+		conn.mutex.RUnlock()
+	}
+}
+
+// acquire locks the connection, exclusively if requested, and returns a function
+// that releases the lock. It fails if the connection was closed while waiting.
+func (conn *connection) acquire(exclusive bool) (func(), error) {
+	var release func()
+	if exclusive {
+		release = conn.lock()
+	} else {
+		release = conn.rlock()
+	}
+	if conn.closed {
+		release()
+		return nil, newError(codeDatabaseNotOpen, "specified database is not open")
+	}
+	return release, nil
 }
 
-func newConnection(d *db.DB, p string) *connection {
-	return &connection{db: d, dir: p, transactions: map[int]*db.Transaction{}, transactionCounter: 1}
+// close waits for in-flight operations on the connection to finish and closes
+// it. The connection must already be removed from connections.
+func (conn *connection) close() error {
+	defer conn.lock()()
+	conn.closed = true
+	err := conn.db.Close()
+	if conn.dirLock != nil {
+		conn.dirLock.release()
+	}
+	return err
+}
+
+// dispatchRPC acquires the connection and runs rpc with a request body in its encoding.
+func (conn *connection) dispatchRPC(rpc string, data []byte, l zl.Logger) ([]byte, error) {
+	conn.forgetExpired()
+
+	if rpc == "batch" {
+		return conn.dispatchBatch(data, l)
+	}
+
+	// Ending a sync moves master and must not interleave with other operations on
+	// the connection. Everything else, including concurrent transactions, can
+	// proceed in parallel.
+	release, err := conn.acquire(rpc == "maybeEndSync")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return conn.dispatch(rpc, data, l)
+}
+
+// dispatch runs a connection-level rpc. The caller must have acquired the connection.
+func (conn *connection) dispatch(rpc string, data []byte, l zl.Logger) ([]byte, error) {
+	switch rpc {
+	case "getRoot":
+		return conn.dispatchGetRoot(data)
+	case "has":
+		return conn.dispatchHas(data)
+	case "get":
+		return conn.dispatchGet(data)
+	case "scan":
+		return conn.dispatchScan(data)
+	case "put":
+		return conn.dispatchPut(data)
+	case "del":
+		return conn.dispatchDel(data)
+	case "beginSync":
+		return conn.dispatchBeginSync(data, l)
+	case "maybeEndSync":
+		return conn.dispatchMaybeEndSync(data)
+	case "openTransaction":
+		return conn.dispatchOpenTransaction(data)
+	case "closeTransaction":
+		return conn.dispatchCloseTransaction(data)
+	case "commitTransaction":
+		return conn.dispatchCommitTransaction(data, l)
+	case "listTransactions":
+		return conn.dispatchListTransactions(data)
+	case "schemaVersion":
+		return conn.dispatchSchemaVersion(data)
+	case "stats":
+		return conn.dispatchStats(data)
+	}
+	return nil, newError(codeUnknownRPC, "Unsupported rpc name: %s", rpc)
 }
 
 func (conn *connection) findTransaction(txID int) (*db.Transaction, error) {
 	if txID == 0 {
-		return nil, fmt.Errorf("Missing transaction ID")
+		return nil, newError(codeMissingTransactionID, "Missing transaction ID")
 	}
-	conn.transactionMutex.RLock()
-	defer conn.transactionMutex.RUnlock()
+	conn.transactionMutex.Lock()
+	defer conn.transactionMutex.Unlock()
 
-	if tx, ok := conn.transactions[txID]; ok {
-		return tx, nil
+	now := conn.now()
+	if ot, ok := conn.transactions[txID]; ok {
+		if ot.expired(now, conn.limits.idleTimeout) {
+			conn.expireLocked(txID, now)
+		} else {
+			ot.lastUsed = now
+			return ot.tx, nil
+		}
+	}
+	if _, ok := conn.expired[txID]; ok {
+		delete(conn.expired, txID)
+		return nil, newError(codeTransactionExpired, "Transaction %d expired after being idle for more than %s", txID, conn.limits.idleTimeout).
+			withDetail("transactionId", txID).
+			withDetail("idleTimeoutMs", int64(conn.limits.idleTimeout/time.Millisecond))
+	}
+	return nil, newError(codeTransactionNotFound, "Invalid transaction ID: %d", txID).withDetail("transactionId", txID)
+}
+
+// expireLocked closes and removes a transaction that has been idle for too long.
+// The transaction mutex must be held when called.
+func (conn *connection) expireLocked(txID int, now time.Time) {
+	conn.transactions[txID].tx.Close()
+	delete(conn.transactions, txID)
+	conn.expired[txID] = now
+}
+
+// sweepLocked expires all transactions that have been idle for too long. The
+// transaction mutex must be held when called.
+func (conn *connection) sweepLocked(now time.Time) {
+	for id, ot := range conn.transactions {
+		if ot.expired(now, conn.limits.idleTimeout) {
+			conn.expireLocked(id, now)
+		}
+	}
+}
+
+// forgetExpired drops the IDs of transactions that expired more than an idle
+// timeout ago, so that expired transactions that are never used again do not
+// accumulate.
+func (conn *connection) forgetExpired() {
+	conn.transactionMutex.Lock()
+	defer conn.transactionMutex.Unlock()
+
+	now := conn.now()
+	for id, t := range conn.expired {
+		if now.Sub(t) > conn.limits.idleTimeout {
+			delete(conn.expired, id)
+		}
 	}
-	return nil, fmt.Errorf("Invalid transaction ID: %d", txID)
 }
 
 func (conn *connection) removeTransaction(txID int) {
@@ -46,22 +235,22 @@ func (conn *connection) removeTransaction(txID int) {
 
 func (conn *connection) dispatchGetRoot(reqBytes []byte) ([]byte, error) {
 	var req getRootRequest
-	err := json.Unmarshal(reqBytes, &req)
+	err := conn.encoding.unmarshal(reqBytes, &req)
 	if err != nil {
 		return nil, err
 	}
 
 	res := getRootResponse{
-		Root: jsnoms.Hash{
+		Root: nomsHash{
 			Hash: conn.db.HeadHash(),
 		},
 	}
-	return mustMarshal(res), nil
+	return conn.encoding.marshal(res)
 }
 
 func (conn *connection) dispatchHas(reqBytes []byte) ([]byte, error) {
 	var req hasRequest
-	err := json.Unmarshal(reqBytes, &req)
+	err := conn.encoding.unmarshal(reqBytes, &req)
 	if err != nil {
 		return nil, err
 	}
@@ -77,12 +266,12 @@ func (conn *connection) dispatchHas(reqBytes []byte) ([]byte, error) {
 	res := hasResponse{
 		Has: ok,
 	}
-	return mustMarshal(res), nil
+	return conn.encoding.marshal(res)
 }
 
 func (conn *connection) dispatchGet(reqBytes []byte) ([]byte, error) {
 	var req getRequest
-	err := json.Unmarshal(reqBytes, &req)
+	err := conn.encoding.unmarshal(reqBytes, &req)
 	if err != nil {
 		return nil, err
 	}
@@ -99,12 +288,12 @@ func (conn *connection) dispatchGet(reqBytes []byte) ([]byte, error) {
 		res.Has = true
 		res.Value = v
 	}
-	return mustMarshal(res), nil
+	return conn.encoding.marshal(res)
 }
 
 func (conn *connection) dispatchScan(reqBytes []byte) ([]byte, error) {
 	var req scanRequest
-	err := json.Unmarshal(reqBytes, &req)
+	err := conn.encoding.unmarshal(reqBytes, &req)
 	if err != nil {
 		return nil, err
 	}
@@ -116,17 +305,21 @@ func (conn *connection) dispatchScan(reqBytes []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return mustMarshal(items), nil
+	res := make([]scanItem, 0, len(items))
+	for _, it := range items {
+		res = append(res, scanItem{Key: it.Key, Value: nomsValue{it.Value.Value}})
+	}
+	return conn.encoding.marshal(res)
 }
 
 func (conn *connection) dispatchPut(reqBytes []byte) ([]byte, error) {
 	var req putRequest
-	err := json.Unmarshal(reqBytes, &req)
+	err := conn.encoding.unmarshal(reqBytes, &req)
 	if err != nil {
 		return nil, err
 	}
 	if len(req.Value) == 0 {
-		return nil, errors.New("value field is required")
+		return nil, newError(codeInvalidRequest, "value field is required")
 	}
 	tx, err := conn.findTransaction(req.TransactionID)
 	if err != nil {
@@ -137,12 +330,12 @@ func (conn *connection) dispatchPut(reqBytes []byte) ([]byte, error) {
 		return nil, err
 	}
 	res := putResponse{}
-	return mustMarshal(res), nil
+	return conn.encoding.marshal(res)
 }
 
 func (conn *connection) dispatchDel(reqBytes []byte) ([]byte, error) {
 	var req delRequest
-	err := json.Unmarshal(reqBytes, &req)
+	err := conn.encoding.unmarshal(reqBytes, &req)
 	if err != nil {
 		return nil, err
 	}
@@ -157,12 +350,12 @@ func (conn *connection) dispatchDel(reqBytes []byte) ([]byte, error) {
 	res := delResponse{
 		Ok: ok,
 	}
-	return mustMarshal(res), nil
+	return conn.encoding.marshal(res)
 }
 
 func (conn *connection) dispatchBeginSync(reqBytes []byte, l zl.Logger) ([]byte, error) {
 	var req beginSyncRequest
-	err := json.Unmarshal(reqBytes, &req)
+	err := conn.encoding.unmarshal(reqBytes, &req)
 	if err != nil {
 		return nil, err
 	}
@@ -171,15 +364,15 @@ func (conn *connection) dispatchBeginSync(reqBytes []byte, l zl.Logger) ([]byte,
 		return nil, err
 	}
 	res := beginSyncResponse{
-		SyncHead: jsnoms.Hash{Hash: syncHead},
+		SyncHead: nomsHash{Hash: syncHead},
 		SyncInfo: syncInfo,
 	}
-	return mustMarshal(res), nil
+	return conn.encoding.marshal(res)
 }
 
 func (conn *connection) dispatchMaybeEndSync(reqBytes []byte) ([]byte, error) {
 	var req maybeEndSyncRequest
-	err := json.Unmarshal(reqBytes, &req)
+	err := conn.encoding.unmarshal(reqBytes, &req)
 	if err != nil {
 		return nil, err
 	}
@@ -187,15 +380,28 @@ func (conn *connection) dispatchMaybeEndSync(reqBytes []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	res := maybeEndSyncResponse{
-		ReplayMutations: replay,
+	res := maybeEndSyncResponse{}
+	for _, m := range replay {
+		rm := replayMutation{ID: m.ID, Name: m.Name, Args: value(m.Args)}
+		if m.Original != nil {
+			rm.Original = &nomsHash{m.Original.Hash}
+		}
+		res.ReplayMutations = append(res.ReplayMutations, rm)
 	}
-	return mustMarshal(res), nil
+	return conn.encoding.marshal(res)
 }
 
 func (conn *connection) newTransaction(name string, jsonArgs json.RawMessage, basis hash.Hash, original hash.Hash) (int, error) {
 	conn.transactionMutex.Lock()
 	defer conn.transactionMutex.Unlock()
+
+	now := conn.now()
+	conn.sweepLocked(now)
+	if conn.limits.maxOpen > 0 && len(conn.transactions) >= conn.limits.maxOpen {
+		return 0, newError(codeTooManyTransactions, "Too many open transactions: limit is %d", conn.limits.maxOpen).
+			withDetail("limit", conn.limits.maxOpen)
+	}
+
 	txID := conn.transactionCounter
 	conn.transactionCounter++
 	var tx *db.Transaction
@@ -228,13 +434,13 @@ func (conn *connection) newTransaction(name string, jsonArgs json.RawMessage, ba
 		tx = conn.db.NewTransactionWithArgs(name, nomsArgs, basisCommit, originalCommit)
 	}
 
-	conn.transactions[txID] = tx
+	conn.transactions[txID] = &openTransaction{tx: tx, opened: now, lastUsed: now}
 	return txID, nil
 }
 
 func (conn *connection) dispatchOpenTransaction(reqBytes []byte) ([]byte, error) {
 	var req openTransactionRequest
-	err := json.Unmarshal(reqBytes, &req)
+	err := conn.encoding.unmarshal(reqBytes, &req)
 	if err != nil {
 		return nil, err
 	}
@@ -245,7 +451,7 @@ func (conn *connection) dispatchOpenTransaction(reqBytes []byte) ([]byte, error)
 		original = req.RebaseOpts.Original.Hash
 	}
 
-	txID, err := conn.newTransaction(req.Name, req.Args, basis, original)
+	txID, err := conn.newTransaction(req.Name, json.RawMessage(req.Args), basis, original)
 	if err != nil {
 		return nil, err
 	}
@@ -253,12 +459,12 @@ func (conn *connection) dispatchOpenTransaction(reqBytes []byte) ([]byte, error)
 	res := openTransactionResponse{
 		TransactionID: txID,
 	}
-	return mustMarshal(res), nil
+	return conn.encoding.marshal(res)
 }
 
 func (conn *connection) dispatchCloseTransaction(reqBytes []byte) ([]byte, error) {
 	var req closeTransactionRequest
-	err := json.Unmarshal(reqBytes, &req)
+	err := conn.encoding.unmarshal(reqBytes, &req)
 	if err != nil {
 		return nil, err
 	}
@@ -272,12 +478,12 @@ func (conn *connection) dispatchCloseTransaction(reqBytes []byte) ([]byte, error
 		return nil, err
 	}
 	res := closeTransactionResponse{}
-	return mustMarshal(res), nil
+	return conn.encoding.marshal(res)
 }
 
 func (conn *connection) dispatchCommitTransaction(reqBytes []byte, l zl.Logger) ([]byte, error) {
 	var req commitTransactionRequest
-	err := json.Unmarshal(reqBytes, &req)
+	err := conn.encoding.unmarshal(reqBytes, &req)
 	if err != nil {
 		return nil, err
 	}
@@ -299,11 +505,143 @@ func (conn *connection) dispatchCommitTransaction(reqBytes []byte, l zl.Logger)
 	}
 
 	if !commitRef.IsZeroValue() {
-		res.Ref = &jsnoms.Hash{
+		res.Ref = &nomsHash{
 			Hash: commitRef.TargetHash(),
 		}
 	}
-	return mustMarshal(res), nil
+	return conn.encoding.marshal(res)
+}
+
+// batchRPCs are the rpcs that may be used in a batch.
+var batchRPCs = map[string]bool{
+	"getRoot":           true,
+	"has":               true,
+	"get":               true,
+	"scan":              true,
+	"put":               true,
+	"del":               true,
+	"beginSync":         true,
+	"maybeEndSync":      true,
+	"openTransaction":   true,
+	"closeTransaction":  true,
+	"commitTransaction": true,
+	"listTransactions":  true,
+	"schemaVersion":     true,
+	"stats":             true,
+}
+
+func (conn *connection) dispatchBatch(reqBytes []byte, l zl.Logger) ([]byte, error) {
+	var req batchRequest
+	err := conn.encoding.unmarshal(reqBytes, &req)
+	if err != nil {
+		return nil, err
+	}
+
+	exclusive := false
+	for _, op := range req.Ops {
+		if op.RPC == "maybeEndSync" {
+			exclusive = true
+		}
+	}
+	release, err := conn.acquire(exclusive)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	res := batchResponse{
+		Results: []batchResult{},
+	}
+	for _, op := range req.Ops {
+		var r batchResult
+		if batchRPCs[op.RPC] {
+			r.Result, err = conn.dispatch(op.RPC, op.Data, l)
+		} else {
+			err = newError(codeUnknownRPC, "Unsupported rpc name in batch: %s", op.RPC)
+		}
+		if err != nil {
+			r.Error = toRPCError(err)
+		}
+		res.Results = append(res.Results, r)
+		if err != nil && req.AbortOnError {
+			break
+		}
+	}
+	return conn.encoding.marshal(res)
+}
+
+func (conn *connection) dispatchListTransactions(reqBytes []byte) ([]byte, error) {
+	var req listTransactionsRequest
+	err := conn.encoding.unmarshal(reqBytes, &req)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.transactionMutex.RLock()
+	defer conn.transactionMutex.RUnlock()
+
+	now := conn.now()
+	res := listTransactionsResponse{
+		Transactions: []transactionInfo{},
+	}
+	for id, ot := range conn.transactions {
+		res.Transactions = append(res.Transactions, transactionInfo{
+			TransactionID: id,
+			Name:          ot.tx.Name(),
+			Basis:         nomsHash{Hash: ot.tx.Basis().NomsStruct.Hash()},
+			AgeMs:         int64(now.Sub(ot.opened) / time.Millisecond),
+			IdleMs:        int64(now.Sub(ot.lastUsed) / time.Millisecond),
+			Expired:       ot.expired(now, conn.limits.idleTimeout),
+		})
+	}
+	sort.Slice(res.Transactions, func(i, j int) bool {
+		return res.Transactions[i].TransactionID < res.Transactions[j].TransactionID
+	})
+	return conn.encoding.marshal(res)
+}
+
+func (conn *connection) dispatchSchemaVersion(reqBytes []byte) ([]byte, error) {
+	var req schemaVersionRequest
+	err := conn.encoding.unmarshal(reqBytes, &req)
+	if err != nil {
+		return nil, err
+	}
+	v, err := conn.db.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	res := schemaVersionResponse{
+		SchemaVersion: v,
+	}
+	return conn.encoding.marshal(res)
+}
+
+// stats returns the stats of the connection's database. The caller must have acquired the connection.
+func (conn *connection) stats(detailed bool) (*DatabaseStats, db.Stats, error) {
+	s, err := conn.db.Stats(detailed)
+	if err != nil {
+		return nil, db.Stats{}, err
+	}
+	ds, err := newDatabaseStats(conn.dir, s)
+	return ds, s, err
+}
+
+func (conn *connection) dispatchStats(reqBytes []byte) ([]byte, error) {
+	var req statsRequest
+	err := conn.encoding.unmarshal(reqBytes, &req)
+	if err != nil {
+		return nil, err
+	}
+	ds, s, err := conn.stats(true)
+	if err != nil {
+		return nil, err
+	}
+	res := statsResponse{
+		DatabaseStats:     *ds,
+		CommitChainLength: s.CommitChainLength,
+		Chunks:            s.Chunks,
+	}
+	return conn.encoding.marshal(res)
 }
 
 func mustMarshal(thing interface{}) []byte {
@@ -1,8 +1,11 @@
 package repm
 
 import (
+	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"testing"
+	gotime "time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -38,6 +41,10 @@ func TestBasics(t *testing.T) {
 		// getRoot on empty db
 		{"getRoot", `{}`, `{"root":"e99uif9c7bpavajrt666es1ki52dv239"}`, ""},
 
+		// schemaVersion
+		{"schemaVersion", invalidRequest, ``, invalidRequestError},
+		{"schemaVersion", `{}`, `{"schemaVersion":0}`, ""},
+
 		// put
 		{"put", invalidRequest, ``, invalidRequestError},
 		{"getRoot", `{}`, `{"root":"e99uif9c7bpavajrt666es1ki52dv239"}`, ""}, // getRoot when db didn't change
@@ -78,7 +85,7 @@ func TestBasics(t *testing.T) {
 
 		// Open transaction for replay
 		{"openTransaction", `{"name": "foo", "args": [], "rebaseOpts": {"basis": "e99uif9c7bpavajrt666es1ki52dv239", "original": "e99uif9c7bpavajrt666es1ki52dv239"}}`, ``, "only local mutations"}, // bad basis
-		{"openTransaction", `{"name": "foo", "args": [], "rebaseOpts": {"basis": "", "original": "e99uif9c7bpavajrt666es1ki52dv239"}}`, ``, "Invaild hash"},                                         // no basis
+		{"openTransaction", `{"name": "foo", "args": [], "rebaseOpts": {"basis": "", "original": "e99uif9c7bpavajrt666es1ki52dv239"}}`, ``, "invalid hash"},                                         // no basis
 		{"openTransaction", `{"name": "foo", "args": [], "rebaseOpts": {"basis": "e99uif9c7bpavajrt666es1ki52dv239", "original": "0000000000pavajrt666es1ki52dv239"}}`, ``, "not found"},            // bad original
 		{"openTransaction", `{"name": "foo", "args": [], "rebaseOpts": {"basis": "e99uif9c7bpavajrt666es1ki52dv239", "original": "3enaqu4u7lfn58th9b3dnfp90sf9nrc2"}}`, `{"transactionId":8}`, ""},  // good case
 		{"put", `{"transactionId": 8, "key": "foom", "value": "fomo"}`, `{}`, ""},
@@ -98,3 +105,242 @@ func TestBasics(t *testing.T) {
 		}
 	}
 }
+
+func TestBatch(t *testing.T) {
+	defer deinit()
+	defer time.SetFake()()
+
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	Init(dir, "", nil)
+	ret, err := Dispatch("db1", "open", nil)
+	assert.Nil(ret)
+	assert.NoError(err)
+
+	ret, err = Dispatch("db1", "openTransaction", []byte(`{}`))
+	assert.NoError(err)
+	assert.Equal(`{"transactionId":1}`, string(ret))
+
+	tc := []struct {
+		req              string
+		expectedResponse string
+		expectedError    string
+	}{
+		{``, ``, "unexpected end of JSON input"},
+		{`{"ops":[]}`, `{"results":[]}`, ""},
+		{
+			`{"ops":[
+				{"rpc":"put","data":{"transactionId":1,"key":"foo","value":"bar"}},
+				{"rpc":"put","data":{"transactionId":1,"key":"foo"}},
+				{"rpc":"open"},
+				{"rpc":"get","data":{"transactionId":1,"key":"foo"}}
+			]}`,
+			`{"results":[{"result":{}},{"error":{"code":"InvalidRequest","message":"value field is required"}},{"error":{"code":"UnknownRPC","message":"Unsupported rpc name in batch: open"}},{"result":{"has":true,"value":"bar"}}]}`,
+			"",
+		},
+		{
+			`{"abortOnError":true,"ops":[
+				{"rpc":"put","data":{"transactionId":1,"key":"hot","value":"dog"}},
+				{"rpc":"put","data":{"transactionId":2,"key":"foo","value":"baz"}},
+				{"rpc":"put","data":{"transactionId":1,"key":"foo","value":"baz"}}
+			]}`,
+			`{"results":[{"result":{}},{"error":{"code":"TransactionNotFound","message":"Invalid transaction ID: 2","details":{"transactionId":2}}}]}`,
+			"",
+		},
+	}
+
+	for _, t := range tc {
+		res, err := Dispatch("db1", "batch", []byte(t.req))
+		if t.expectedError != "" {
+			assert.Nil(res, "test case %s", t.req)
+			assert.Regexp(t.expectedError, err.Error(), "test case %s", t.req)
+		} else {
+			assert.Equal(t.expectedResponse, string(res), "test case %s", t.req)
+			assert.NoError(err, "test case %s", t.req)
+		}
+	}
+
+	res, err := Dispatch("db1", "batch", []byte(`{"ops":[
+		{"rpc":"commitTransaction","data":{"transactionId":1}},
+		{"rpc":"getRoot","data":{}}
+	]}`))
+	assert.NoError(err)
+	var br batchResponse
+	assert.NoError(json.Unmarshal(res, &br))
+	assert.Equal(2, len(br.Results))
+	var ctr commitTransactionResponse
+	assert.NoError(json.Unmarshal(br.Results[0].Result, &ctr))
+	var grr getRootResponse
+	assert.NoError(json.Unmarshal(br.Results[1].Result, &grr))
+	assert.Equal(grr.Root.Hash, ctr.Ref.Hash)
+}
+
+func TestCBORConnection(t *testing.T) {
+	defer deinit()
+	defer time.SetFake()()
+
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	Init(dir, "", nil)
+
+	_, err = Dispatch("db1", "open", []byte(`{"encoding":"msgpack"}`))
+	assert.EqualError(err, `{"code":"InvalidRequest","message":"unsupported encoding: msgpack"}`)
+	_, err = Dispatch("db1", "open", []byte(`{"encoding":"cbor"}`))
+	assert.NoError(err)
+
+	dispatch := func(rpc, req string) (string, error) {
+		c, err := value(req).MarshalCBOR()
+		assert.NoError(err)
+		res, err := Dispatch("db1", rpc, c)
+		if err != nil {
+			return "", err
+		}
+		var j value
+		assert.NoError(j.UnmarshalCBOR(res))
+		return string(j), nil
+	}
+
+	res, err := dispatch("openTransaction", `{}`)
+	assert.NoError(err)
+	assert.Equal(`{"transactionId":1}`, res)
+	res, err = dispatch("put", `{"transactionId":1,"key":"foo","value":{"bar":[1,2.5,"baz"]}}`)
+	assert.NoError(err)
+	assert.Equal(`{}`, res)
+	res, err = dispatch("get", `{"transactionId":1,"key":"foo"}`)
+	assert.NoError(err)
+	assert.Equal(`{"has":true,"value":{"bar":[1,2.5,"baz"]}}`, res)
+	res, err = dispatch("scan", `{"transactionId":1}`)
+	assert.NoError(err)
+	assert.Equal(`[{"key":"foo","value":{"bar":[1,2.5,"baz"]}}]`, res)
+	res, err = dispatch("batch", `{"ops":[{"rpc":"has","data":{"transactionId":1,"key":"foo"}}]}`)
+	assert.NoError(err)
+	assert.Equal(`{"results":[{"result":{"has":true}}]}`, res)
+
+	// Errors are CBOR too.
+	_, err = dispatch("get", `{"transactionId":42,"key":"foo"}`)
+	var re *rpcError
+	assert.True(errors.As(err, &re))
+	var j value
+	assert.NoError(j.UnmarshalCBOR([]byte(err.Error())))
+	assert.Equal(`{"code":"TransactionNotFound","details":{"transactionId":42},"message":"Invalid transaction ID: 42"}`, string(j))
+
+	// Malformed bodies and byte strings are rejected before reaching the handler.
+	for _, body := range [][]byte{{0x18}, {0xa1, 0x63, 'k', 'e', 'y', 0x43, 'f', 'o', 'o'}} {
+		_, err = Dispatch("db1", "get", body)
+		if assert.True(errors.As(err, &re)) {
+			assert.Equal(codeInvalidRequest, re.Code)
+		}
+	}
+
+	// Other connections keep using JSON.
+	_, err = Dispatch("db2", "open", nil)
+	assert.NoError(err)
+	ret, err := Dispatch("db2", "openTransaction", []byte(`{}`))
+	assert.NoError(err)
+	assert.Equal(`{"transactionId":1}`, string(ret))
+}
+
+func TestTransactionLimits(t *testing.T) {
+	defer deinit()
+
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	Init(dir, "", nil)
+	_, err = Dispatch("db1", "open", []byte(`{"transactionIdleTimeoutMs":100,"maxOpenTransactions":2}`))
+	assert.NoError(err)
+	now := gotime.Date(2020, 1, 1, 0, 0, 0, 0, gotime.UTC)
+	connections["db1"].now = func() gotime.Time {
+		return now
+	}
+
+	list := func() listTransactionsResponse {
+		res, err := Dispatch("db1", "listTransactions", []byte(`{}`))
+		assert.NoError(err)
+		var ltr listTransactionsResponse
+		assert.NoError(json.Unmarshal(res, &ltr))
+		return ltr
+	}
+
+	assert.Equal(0, len(list().Transactions))
+
+	res, err := Dispatch("db1", "openTransaction", []byte(`{}`))
+	assert.NoError(err)
+	assert.Equal(`{"transactionId":1}`, string(res))
+	res, err = Dispatch("db1", "openTransaction", []byte(`{"name":"foo","args":[]}`))
+	assert.NoError(err)
+	assert.Equal(`{"transactionId":2}`, string(res))
+	res, err = Dispatch("db1", "openTransaction", []byte(`{}`))
+	assert.Nil(res)
+	assert.EqualError(err, `{"code":"TooManyTransactions","message":"Too many open transactions: limit is 2","details":{"limit":2}}`)
+
+	ltr := list()
+	assert.Equal(2, len(ltr.Transactions))
+	assert.Equal(1, ltr.Transactions[0].TransactionID)
+	assert.Equal("", ltr.Transactions[0].Name)
+	assert.Equal(2, ltr.Transactions[1].TransactionID)
+	assert.Equal("foo", ltr.Transactions[1].Name)
+	for _, ti := range ltr.Transactions {
+		assert.Equal("e99uif9c7bpavajrt666es1ki52dv239", ti.Basis.Hash.String())
+		assert.False(ti.Expired)
+	}
+
+	now = now.Add(150 * gotime.Millisecond)
+
+	ltr = list()
+	assert.True(ltr.Transactions[0].Expired)
+	assert.Equal(int64(150), ltr.Transactions[0].IdleMs)
+
+	res, err = Dispatch("db1", "has", []byte(`{"transactionId":1,"key":"foo"}`))
+	assert.Nil(res)
+	assert.EqualError(err, `{"code":"TransactionExpired","message":"Transaction 1 expired after being idle for more than 100ms","details":{"idleTimeoutMs":100,"transactionId":1}}`)
+	res, err = Dispatch("db1", "has", []byte(`{"transactionId":1,"key":"foo"}`))
+	assert.Nil(res)
+	assert.EqualError(err, `{"code":"TransactionNotFound","message":"Invalid transaction ID: 1","details":{"transactionId":1}}`)
+
+	// Opening a transaction sweeps the expired ones, making room for new ones.
+	res, err = Dispatch("db1", "openTransaction", []byte(`{}`))
+	assert.NoError(err)
+	assert.Equal(`{"transactionId":3}`, string(res))
+	res, err = Dispatch("db1", "commitTransaction", []byte(`{"transactionId":2}`))
+	assert.Nil(res)
+	assert.EqualError(err, `{"code":"TransactionExpired","message":"Transaction 2 expired after being idle for more than 100ms","details":{"idleTimeoutMs":100,"transactionId":2}}`)
+
+	ltr = list()
+	assert.Equal(1, len(ltr.Transactions))
+	assert.Equal(3, ltr.Transactions[0].TransactionID)
+
+	// Expired transactions that are never used again are forgotten after another
+	// idle timeout.
+	now = now.Add(150 * gotime.Millisecond)
+	res, err = Dispatch("db1", "openTransaction", []byte(`{}`))
+	assert.NoError(err)
+	assert.Equal(`{"transactionId":4}`, string(res))
+	assert.Equal(1, len(connections["db1"].expired))
+	now = now.Add(150 * gotime.Millisecond)
+	_, err = Dispatch("db1", "getRoot", []byte(`{}`))
+	assert.NoError(err)
+	assert.Equal(0, len(connections["db1"].expired))
+	res, err = Dispatch("db1", "has", []byte(`{"transactionId":3,"key":"foo"}`))
+	assert.Nil(res)
+	assert.EqualError(err, `{"code":"TransactionNotFound","message":"Invalid transaction ID: 3","details":{"transactionId":3}}`)
+}
+
+func TestTransactionClosed(t *testing.T) {
+	defer deinit()
+
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	Init(dir, "", nil)
+	_, err = Dispatch("db1", "open", nil)
+	assert.NoError(err)
+	res, err := Dispatch("db1", "openTransaction", []byte(`{}`))
+	assert.NoError(err)
+	assert.Equal(`{"transactionId":1}`, string(res))
+
+	// As if another rpc closed the transaction after this one found it.
+	assert.NoError(connections["db1"].transactions[1].tx.Close())
+
+	res, err = Dispatch("db1", "has", []byte(`{"transactionId":1,"key":"foo"}`))
+	assert.Nil(res)
+	assert.EqualError(err, `{"code":"TransactionClosed","message":"Transaction is closed"}`)
+}
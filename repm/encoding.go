@@ -0,0 +1,342 @@
+package repm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/attic-labs/noms/go/hash"
+	"github.com/attic-labs/noms/go/types"
+	"github.com/fxamacker/cbor/v2"
+
+	jsnoms "roci.dev/diff-server/util/noms/json"
+)
+
+// encoding is the wire format of request and response bodies that a connection
+// negotiated at open. The rpc handlers decode requests and encode responses with
+// it directly.
+type encoding interface {
+	unmarshal(data []byte, v interface{}) error
+	marshal(v interface{}) ([]byte, error)
+}
+
+var encodings = map[string]encoding{
+	"json": jsonEncoding{},
+	"cbor": cborEncoding{},
+}
+
+// jsonEncoding is the default encoding.
+type jsonEncoding struct{}
+
+func (jsonEncoding) unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonEncoding) marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// cborEncoding encodes bodies as CBOR (RFC 7049), which is much cheaper than
+// JSON to parse on the host side, in particular for large scans. Field names are
+// the same as in JSON.
+type cborEncoding struct{}
+
+var (
+	// cborDec keeps the library's limits on nesting depth and on the sizes of
+	// arrays and maps, so that hostile requests cannot exhaust the stack or memory.
+	cborDec = mustCBORDecMode(cbor.DecOptions{TagsMd: cbor.TagsForbidden})
+	// cborEnc sorts map keys so that responses are deterministic.
+	cborEnc = mustCBOREncMode(cbor.EncOptions{Sort: cbor.SortBytewiseLexical, Time: cbor.TimeRFC3339Nano})
+)
+
+func mustCBORDecMode(opts cbor.DecOptions) cbor.DecMode {
+	dm, err := opts.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return dm
+}
+
+func mustCBOREncMode(opts cbor.EncOptions) cbor.EncMode {
+	em, err := opts.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	return em
+}
+
+func (cborEncoding) unmarshal(data []byte, v interface{}) error {
+	dec := cborDec.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(v); err != nil {
+		if err == io.EOF && len(data) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return newError(codeInvalidRequest, "cbor: %s", strings.TrimPrefix(err.Error(), "cbor: "))
+	}
+	if dec.NumBytesRead() != len(data) {
+		return newError(codeInvalidRequest, "cbor: unexpected data after top-level value")
+	}
+	return nil
+}
+
+func (cborEncoding) marshal(v interface{}) ([]byte, error) {
+	return cborEnc.Marshal(v)
+}
+
+// value is a JSON value in a request or response, eg the value of a put. It is
+// kept as JSON, but encoded as the equivalent value in the connection's encoding.
+type value []byte
+
+func (v value) MarshalJSON() ([]byte, error) {
+	if len(v) == 0 {
+		return []byte("null"), nil
+	}
+	return v, nil
+}
+
+func (v *value) UnmarshalJSON(data []byte) error {
+	*v = append((*v)[:0], data...)
+	return nil
+}
+
+func (v value) MarshalCBOR() ([]byte, error) {
+	if len(v) == 0 {
+		return cborEnc.Marshal(nil)
+	}
+	dec := json.NewDecoder(bytes.NewReader(v))
+	dec.UseNumber()
+	var x interface{}
+	if err := dec.Decode(&x); err != nil {
+		return nil, err
+	}
+	x, err := fromJSONValue(x)
+	if err != nil {
+		return nil, err
+	}
+	return cborEnc.Marshal(x)
+}
+
+func (v *value) UnmarshalCBOR(data []byte) error {
+	var x interface{}
+	if err := cborDec.Unmarshal(data, &x); err != nil {
+		return err
+	}
+	x, err := toJSONValue(x)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+	*v = b
+	return nil
+}
+
+// fromJSONValue turns the numbers in x, decoded from JSON with UseNumber, into
+// integers where possible and floats otherwise.
+func fromJSONValue(x interface{}) (interface{}, error) {
+	switch x := x.(type) {
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i, nil
+		}
+		if u, err := strconv.ParseUint(x.String(), 10, 64); err == nil {
+			return u, nil
+		}
+		return x.Float64()
+	case []interface{}:
+		for i, item := range x {
+			v, err := fromJSONValue(item)
+			if err != nil {
+				return nil, err
+			}
+			x[i] = v
+		}
+	case map[string]interface{}:
+		for k, item := range x {
+			v, err := fromJSONValue(item)
+			if err != nil {
+				return nil, err
+			}
+			x[k] = v
+		}
+	}
+	return x, nil
+}
+
+// toJSONValue checks that x, decoded from CBOR, can be represented in JSON and
+// returns it with map keys as strings. The decoder bounds its nesting depth.
+func toJSONValue(x interface{}) (interface{}, error) {
+	switch x := x.(type) {
+	case nil, bool, string, uint64, int64:
+		return x, nil
+	case float64:
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return nil, fmt.Errorf("cbor: %v cannot be represented in JSON", x)
+		}
+		return x, nil
+	case []byte:
+		return nil, errors.New("cbor: byte strings cannot be represented in JSON, use text strings")
+	case []interface{}:
+		for i, item := range x {
+			v, err := toJSONValue(item)
+			if err != nil {
+				return nil, err
+			}
+			x[i] = v
+		}
+		return x, nil
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(x))
+		for k, item := range x {
+			ks, ok := k.(string)
+			if !ok {
+				return nil, errors.New("cbor: map keys must be text strings")
+			}
+			v, err := toJSONValue(item)
+			if err != nil {
+				return nil, err
+			}
+			m[ks] = v
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("cbor: %T cannot be represented in JSON", x)
+}
+
+// nomsValue is a value read from the database. It is encoded straight from noms,
+// without going through JSON first.
+type nomsValue struct {
+	types.Value
+}
+
+func (v nomsValue) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	err := jsnoms.ToJSON(v.Value, &b)
+	return b.Bytes(), err
+}
+
+func (v nomsValue) MarshalCBOR() ([]byte, error) {
+	x, err := fromNomsValue(v.Value)
+	if err != nil {
+		return nil, err
+	}
+	return cborEnc.Marshal(x)
+}
+
+// fromNomsValue returns v, which was read from JSON into noms, as the Go value
+// that encodes to the same value.
+func fromNomsValue(v types.Value) (interface{}, error) {
+	switch v := v.(type) {
+	case types.Bool:
+		return bool(v), nil
+	case types.Number:
+		f := float64(v)
+		if f == math.Trunc(f) && math.Abs(f) < math.MaxInt64 {
+			return int64(f), nil
+		}
+		return f, nil
+	case types.String:
+		return string(v), nil
+	case types.List:
+		items := make([]interface{}, 0, v.Len())
+		var err error
+		v.IterAll(func(item types.Value, _ uint64) {
+			if err == nil {
+				var x interface{}
+				x, err = fromNomsValue(item)
+				items = append(items, x)
+			}
+		})
+		return items, err
+	case types.Map:
+		m := make(map[string]interface{}, v.Len())
+		var err error
+		v.IterAll(func(k, item types.Value) {
+			if err != nil {
+				return
+			}
+			ks, ok := k.(types.String)
+			if !ok {
+				err = fmt.Errorf("map key %s is not a string", types.EncodedValue(k))
+				return
+			}
+			m[string(ks)], err = fromNomsValue(item)
+		})
+		return m, err
+	}
+	if v.Equals(jsnoms.Null()) {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("cannot encode %s", types.TypeOf(v).Describe())
+}
+
+// nomsHash is a noms hash. Like jsnoms.Hash it is encoded as a string, in every
+// encoding.
+type nomsHash struct {
+	hash.Hash
+}
+
+func (h nomsHash) MarshalJSON() ([]byte, error) {
+	return json.Marshal(h.String())
+}
+
+func (h *nomsHash) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return h.parse(s)
+}
+
+func (h nomsHash) MarshalCBOR() ([]byte, error) {
+	return cborEnc.Marshal(h.String())
+}
+
+func (h *nomsHash) UnmarshalCBOR(data []byte) error {
+	var s string
+	if err := cborDec.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return h.parse(s)
+}
+
+func (h *nomsHash) parse(s string) error {
+	p, ok := hash.MaybeParse(s)
+	if !ok {
+		return fmt.Errorf("invalid hash: %s", s)
+	}
+	h.Hash = p
+	return nil
+}
+
+// body is a request or response body nested in another one, eg an op of a
+// batch. It is kept in the encoding of the connection.
+type body []byte
+
+func (b body) MarshalJSON() ([]byte, error) {
+	return value(b).MarshalJSON()
+}
+
+func (b *body) UnmarshalJSON(data []byte) error {
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+func (b body) MarshalCBOR() ([]byte, error) {
+	if len(b) == 0 {
+		return cborEnc.Marshal(nil)
+	}
+	return b, nil
+}
+
+func (b *body) UnmarshalCBOR(data []byte) error {
+	*b = append((*b)[:0], data...)
+	return nil
+}
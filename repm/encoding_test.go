@@ -0,0 +1,156 @@
+package repm
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/attic-labs/noms/go/hash"
+	"github.com/stretchr/testify/assert"
+
+	jsnoms "roci.dev/diff-server/util/noms/json"
+	"roci.dev/replicache-client/db"
+)
+
+func TestCBORValue(t *testing.T) {
+	assert := assert.New(t)
+
+	// Examples from RFC 7049, Appendix A.
+	roundTrip := []struct {
+		json string
+		cbor string
+	}{
+		{`0`, "00"},
+		{`1`, "01"},
+		{`10`, "0a"},
+		{`23`, "17"},
+		{`24`, "1818"},
+		{`100`, "1864"},
+		{`1000`, "1903e8"},
+		{`1000000`, "1a000f4240"},
+		{`1000000000000`, "1b000000e8d4a51000"},
+		{`18446744073709551615`, "1bffffffffffffffff"},
+		{`-1`, "20"},
+		{`-10`, "29"},
+		{`-100`, "3863"},
+		{`-1000`, "3903e7"},
+		{`1.1`, "fb3ff199999999999a"},
+		{`-4.1`, "fbc010666666666666"},
+		{`false`, "f4"},
+		{`true`, "f5"},
+		{`null`, "f6"},
+		{`""`, "60"},
+		{`"a"`, "6161"},
+		{`"IETF"`, "6449455446"},
+		{`"\"\\"`, "62225c"},
+		{`"ü"`, "62c3bc"},
+		{`[]`, "80"},
+		{`[1,2,3]`, "83010203"},
+		{`[1,[2,3],[4,5]]`, "8301820203820405"},
+		{`{}`, "a0"},
+		{`{"a":1,"b":[2,3]}`, "a26161016162820203"},
+		{`["a",{"b":"c"}]`, "826161a161626163"},
+	}
+	for _, t := range roundTrip {
+		c, err := value(t.json).MarshalCBOR()
+		assert.NoError(err, t.json)
+		assert.Equal(t.cbor, hex.EncodeToString(c), t.json)
+		var v value
+		assert.NoError(v.UnmarshalCBOR(c), t.json)
+		assert.Equal(t.json, string(v), t.json)
+	}
+
+	decode := []struct {
+		cbor string
+		json string
+		err  string
+	}{
+		{"f93c00", `1`, ""},
+		{"fa47c35000", `100000`, ""},
+		{"9f018202039f0405ffff", `[1,[2,3],[4,5]]`, ""},
+		{"bf61610161629f0203ffff", `{"a":1,"b":[2,3]}`, ""},
+		{"7f657374726561646d696e67ff", `"streaming"`, ""},
+		{"4401020304", ``, "cbor: byte strings cannot be represented in JSON, use text strings"},
+		{"a10102", ``, "cbor: map keys must be text strings"},
+		{"f97c00", ``, "cbor: +Inf cannot be represented in JSON"},
+		{"c11a514b67b0", ``, "cbor: CBOR tag isn't allowed"},
+		{strings.Repeat("81", 40) + "01", ``, "cbor: exceeded max nested level 32"},
+	}
+	for _, t := range decode {
+		b, err := hex.DecodeString(t.cbor)
+		assert.NoError(err)
+		var v value
+		err = v.UnmarshalCBOR(b)
+		if t.err != "" {
+			assert.EqualError(err, t.err, t.cbor)
+		} else {
+			assert.NoError(err, t.cbor)
+			assert.Equal(t.json, string(v), t.cbor)
+		}
+	}
+}
+
+func TestCBOREncoding(t *testing.T) {
+	assert := assert.New(t)
+	enc := cborEncoding{}
+
+	// Requests are decoded straight into the request structs.
+	b, err := hex.DecodeString("a36d7472616e73616374696f6e496401636b657963666f6f6576616c7565a1636261728301fb40040000000000006362617a")
+	assert.NoError(err)
+	var req putRequest
+	assert.NoError(enc.unmarshal(b, &req))
+	assert.Equal(1, req.TransactionID)
+	assert.Equal("foo", req.Key)
+	assert.Equal(`{"bar":[1,2.5,"baz"]}`, string(req.Value))
+
+	for _, t := range []struct {
+		cbor string
+		err  string
+	}{
+		{"", "cbor: EOF"},
+		{"18", "cbor: unexpected EOF"},
+		{"a0a0", "cbor: unexpected data after top-level value"},
+		{"a16576616c75654401020304", "cbor: byte strings cannot be represented in JSON, use text strings"},
+		{"a1636b657943666f6f", "cbor: cannot unmarshal byte string into Go struct field repm.putRequest.key of type string"},
+	} {
+		b, err := hex.DecodeString(t.cbor)
+		assert.NoError(err)
+		err = enc.unmarshal(b, &putRequest{})
+		var re *rpcError
+		if assert.True(errors.As(err, &re), t.cbor) {
+			assert.Equal(codeInvalidRequest, re.Code, t.cbor)
+			assert.Equal(t.err, re.Message, t.cbor)
+		}
+	}
+
+	// Values read from noms encode the same as the JSON they were put as.
+	d, _ := db.LoadTempDB(assert)
+	defer d.Close()
+	for _, j := range []string{`null`, `true`, `-7`, `2.5`, `"ü"`, `[1,[2,"x"]]`, `{"b":[],"a":{"c":null}}`} {
+		nv, err := jsnoms.FromJSON([]byte(j), d.Noms())
+		assert.NoError(err, j)
+		fromNoms, err := enc.marshal(nomsValue{nv})
+		assert.NoError(err, j)
+		fromJSON, err := enc.marshal(value(j))
+		assert.NoError(err, j)
+		assert.Equal(hex.EncodeToString(fromJSON), hex.EncodeToString(fromNoms), j)
+		asJSON, err := json.Marshal(nomsValue{nv})
+		assert.NoError(err, j)
+		assert.JSONEq(j, string(asJSON), j)
+	}
+
+	// Hashes are strings in either encoding.
+	h := nomsHash{hash.Of([]byte("foo"))}
+	for _, e := range []encoding{jsonEncoding{}, cborEncoding{}} {
+		b, err := e.marshal(getRootResponse{Root: h})
+		assert.NoError(err)
+		var s map[string]string
+		assert.NoError(e.unmarshal(b, &s))
+		assert.Equal(h.String(), s["root"])
+		var res getRootResponse
+		assert.NoError(e.unmarshal(b, &res))
+		assert.Equal(h, res.Root)
+	}
+}
@@ -0,0 +1,126 @@
+package repm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"roci.dev/replicache-client/db"
+)
+
+// errorCode is a stable identifier for a class of failure. Hosts should branch
+// on the code rather than on the message, which may change at any time.
+type errorCode string
+
+const (
+	// codeInternal is used for all failures that don't have a more specific code.
+	codeInternal              errorCode = "Internal"
+	codeInvalidRequest        errorCode = "InvalidRequest"
+	codeUninitialized         errorCode = "Uninitialized"
+	codeUnknownRPC            errorCode = "UnknownRPC"
+	codeDatabaseNotOpen       errorCode = "DatabaseNotOpen"
+	codeDatabaseLocked        errorCode = "DatabaseLocked"
+	codeDatabaseNotFound      errorCode = "DatabaseNotFound"
+	codeDatabaseExists        errorCode = "DatabaseExists"
+	codeReadOnly              errorCode = "ReadOnly"
+	codeMissingTransactionID  errorCode = "MissingTransactionID"
+	codeTransactionNotFound   errorCode = "TransactionNotFound"
+	codeTransactionClosed     errorCode = "TransactionClosed"
+	codeTransactionExpired    errorCode = "TransactionExpired"
+	codeTooManyTransactions   errorCode = "TooManyTransactions"
+	codeSyncFailed            errorCode = "SyncFailed"
+	codeSyncAborted           errorCode = "SyncAborted"
+	codeEncryptionKeyRequired errorCode = "EncryptionKeyRequired"
+	codeWrongEncryptionKey    errorCode = "WrongEncryptionKey"
+)
+
+// rpcError is the error returned by Dispatch. Error() is its JSON encoding, eg:
+//
+//	{"code":"TransactionNotFound","message":"Invalid transaction ID: 3","details":{"transactionId":3}}
+//
+// Connections with another encoding get it wrapped in an encodedError instead.
+type rpcError struct {
+	Code    errorCode `json:"code"`
+	Message string    `json:"message"`
+	// Retryable is true if the same request may succeed when retried later.
+	Retryable bool                   `json:"retryable,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+func (e *rpcError) Error() string {
+	return string(mustMarshal(e))
+}
+
+// in returns e as returned to a connection that uses enc, whose Error() is e in
+// that encoding.
+func (e *rpcError) in(enc encoding) error {
+	if _, ok := enc.(jsonEncoding); ok {
+		return e
+	}
+	b, err := enc.marshal(e)
+	if err != nil {
+		return e
+	}
+	return &encodedError{e, string(b)}
+}
+
+// encodedError is an rpcError in an encoding other than JSON.
+type encodedError struct {
+	*rpcError
+	text string
+}
+
+func (e *encodedError) Error() string {
+	return e.text
+}
+
+func (e *encodedError) Unwrap() error {
+	return e.rpcError
+}
+
+func newError(code errorCode, format string, args ...interface{}) *rpcError {
+	return &rpcError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *rpcError) withDetail(key string, value interface{}) *rpcError {
+	if e.Details == nil {
+		e.Details = map[string]interface{}{}
+	}
+	e.Details[key] = value
+	return e
+}
+
+// toRPCError classifies err, which may come from anywhere below Dispatch.
+func toRPCError(err error) *rpcError {
+	var re *rpcError
+	if errors.As(err, &re) {
+		return re
+	}
+
+	re = &rpcError{Code: codeInternal, Message: err.Error()}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var syncErr db.SyncError
+	switch {
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		re.Code = codeInvalidRequest
+	case errors.Is(err, db.ErrClosed):
+		// The transaction was closed, committed or expired while this rpc was using it.
+		re.Code = codeTransactionClosed
+	case errors.Is(err, db.ErrSyncAborted):
+		re.Code = codeSyncAborted
+		re.Retryable = true
+	case errors.As(err, &syncErr):
+		re.Code = codeSyncFailed
+		re.Retryable = true
+	case errors.Is(err, db.ErrEncryptionKeyRequired):
+		re.Code = codeEncryptionKeyRequired
+	case errors.Is(err, db.ErrWrongEncryptionKey):
+		re.Code = codeWrongEncryptionKey
+	case errors.Is(err, db.ErrReadOnly):
+		re.Code = codeReadOnly
+	case errors.Is(err, db.ErrDatabaseNotFound):
+		re.Code = codeDatabaseNotFound
+	}
+	return re
+}
@@ -0,0 +1,41 @@
+package repm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"roci.dev/replicache-client/db"
+)
+
+func TestToRPCError(t *testing.T) {
+	assert := assert.New(t)
+
+	var syntaxErr error = json.Unmarshal([]byte(`{`), &struct{}{})
+
+	tc := []struct {
+		err               error
+		expectedCode      errorCode
+		expectedRetryable bool
+	}{
+		{errors.New("boom"), codeInternal, false},
+		{newError(codeUnknownRPC, "Unsupported rpc name: foo"), codeUnknownRPC, false},
+		{fmt.Errorf("wrapped: %w", newError(codeTransactionNotFound, "Invalid transaction ID: 1")), codeTransactionNotFound, false},
+		{syntaxErr, codeInvalidRequest, false},
+		{db.ErrClosed, codeTransactionClosed, false},
+		{fmt.Errorf("%w: found a newer snapshot on master", db.ErrSyncAborted), codeSyncAborted, true},
+		{db.NewSyncError(errors.New("sync failed: pull failed")), codeSyncFailed, true},
+		{db.ErrEncryptionKeyRequired, codeEncryptionKeyRequired, false},
+		{db.ErrWrongEncryptionKey, codeWrongEncryptionKey, false},
+		{db.ErrReadOnly, codeReadOnly, false},
+		{db.ErrDatabaseNotFound, codeDatabaseNotFound, false},
+	}
+
+	for i, t := range tc {
+		re := toRPCError(t.err)
+		assert.Equal(t.expectedCode, re.Code, "test case %d", i)
+		assert.Equal(t.expectedRetryable, re.Retryable, "test case %d", i)
+	}
+}
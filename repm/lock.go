@@ -0,0 +1,41 @@
+package repm
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// lockFileName is the name of the lock file inside a database directory. It must
+// not collide with the files noms keeps there.
+const lockFileName = "replicache.lock"
+
+// dirLock is an advisory lock on a database directory. It keeps another process,
+// eg an app extension, from opening the database while we have it open.
+type dirLock struct {
+	f *os.File
+}
+
+// lockDir takes the lock on the database directory dir, creating dir if needed.
+func lockDir(dir string) (*dirLock, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := tryLockFile(f)
+	if err == nil && !ok {
+		err = &rpcError{Code: codeDatabaseLocked, Message: "database locked by another process", Retryable: true}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &dirLock{f}, nil
+}
+
+// release releases the lock. Closing the file is enough for the OS to drop it.
+func (dl *dirLock) release() error {
+	return dl.f.Close()
+}
@@ -0,0 +1,14 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package repm
+
+import (
+	"os"
+)
+
+// tryLockFile is a no-op on platforms without flock, eg Windows and wasm, which
+// none of our hosts run on.
+func tryLockFile(f *os.File) (bool, error) {
+	return true, nil
+}
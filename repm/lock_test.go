@@ -0,0 +1,53 @@
+package repm
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirLock(t *testing.T) {
+	defer deinit()
+
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	Init(dir, "", nil)
+	const lockedError = `{"code":"DatabaseLocked","message":"database locked by another process","retryable":true}`
+
+	_, err = Dispatch("db1", "open", nil)
+	assert.NoError(err)
+	_, err = Dispatch("db1", "close", nil)
+	assert.NoError(err)
+
+	// Stands in for another process that has the database open.
+	other, err := lockDir(dbPath(dir, "db1"))
+	assert.NoError(err)
+
+	_, err = Dispatch("db1", "open", nil)
+	assert.EqualError(err, lockedError)
+	assert.Nil(connections["db1"])
+	_, err = Dispatch("db1", "drop", nil)
+	assert.EqualError(err, lockedError)
+
+	_, err = Dispatch("db1", "open", []byte(`{"readOnly":true}`))
+	assert.NoError(err)
+	_, err = Dispatch("db1", "close", nil)
+	assert.NoError(err)
+
+	assert.NoError(other.release())
+	_, err = Dispatch("db1", "open", nil)
+	assert.NoError(err)
+	_, err = lockDir(dbPath(dir, "db1"))
+	assert.EqualError(err, lockedError)
+
+	_, err = Dispatch("db1", "close", nil)
+	assert.NoError(err)
+	other, err = lockDir(dbPath(dir, "db1"))
+	assert.NoError(err)
+	assert.NoError(other.release())
+
+	_, err = Dispatch("db1", "drop", nil)
+	assert.NoError(err)
+}
@@ -0,0 +1,191 @@
+package repm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	gotime "time"
+)
+
+// latencyBuckets are the upper bounds in seconds of the rpc latency histogram buckets.
+var latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+type metricsKey struct {
+	db  string
+	rpc string
+}
+
+// rpcMetrics aggregates the Dispatch calls of one rpc on one database.
+type rpcMetrics struct {
+	count         uint64
+	errors        uint64
+	latencySum    float64
+	buckets       []uint64 // Not cumulative, the last one counts calls slower than all latencyBuckets.
+	requestBytes  uint64
+	responseBytes uint64
+}
+
+var (
+	metricsMutex sync.Mutex
+	metrics      = map[metricsKey]*rpcMetrics{}
+)
+
+// recordMetrics records a Dispatch call. It is cheap enough to run on every call.
+func recordMetrics(dbName, rpc string, dur gotime.Duration, reqSize, resSize int, failed bool) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	k := metricsKey{dbName, rpc}
+	m := metrics[k]
+	if m == nil {
+		m = &rpcMetrics{buckets: make([]uint64, len(latencyBuckets)+1)}
+		metrics[k] = m
+	}
+	m.count++
+	if failed {
+		m.errors++
+	}
+	secs := dur.Seconds()
+	m.latencySum += secs
+	m.buckets[sort.SearchFloat64s(latencyBuckets, secs)]++
+	m.requestBytes += uint64(reqSize)
+	m.responseBytes += uint64(resSize)
+}
+
+func resetMetrics() {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	metrics = map[metricsKey]*rpcMetrics{}
+}
+
+type metricsRequest struct {
+	// Format is "json" (the default) or "prometheus" for the Prometheus text
+	// exposition format.
+	Format string `json:"format,omitempty"`
+	// Reset clears all metrics after they have been read.
+	Reset bool `json:"reset,omitempty"`
+}
+
+type latencyBucket struct {
+	// LE is the upper bound of the bucket in seconds, counts are cumulative.
+	LE    float64 `json:"le"`
+	Count uint64  `json:"count"`
+}
+
+type rpcMetricsInfo struct {
+	DB             string          `json:"db"`
+	RPC            string          `json:"rpc"`
+	Count          uint64          `json:"count"`
+	Errors         uint64          `json:"errors"`
+	LatencySum     float64         `json:"latencySecondsSum"`
+	LatencyBuckets []latencyBucket `json:"latencySecondsBuckets"`
+	RequestBytes   uint64          `json:"requestBytes"`
+	ResponseBytes  uint64          `json:"responseBytes"`
+}
+
+type metricsResponse struct {
+	RPCs []rpcMetricsInfo `json:"rpcs"`
+}
+
+// dispatchMetrics returns the metrics of all databases.
+func dispatchMetrics(reqBytes []byte) ([]byte, error) {
+	var req metricsRequest
+	if len(reqBytes) > 0 {
+		if err := json.Unmarshal(reqBytes, &req); err != nil {
+			return nil, err
+		}
+	}
+	if req.Format != "" && req.Format != "json" && req.Format != "prometheus" {
+		return nil, newError(codeInvalidRequest, "unsupported metrics format: %s", req.Format)
+	}
+
+	res := snapshotMetrics(req.Reset)
+	if req.Format == "prometheus" {
+		return formatPrometheus(res), nil
+	}
+	return mustMarshal(res), nil
+}
+
+func snapshotMetrics(reset bool) metricsResponse {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	res := metricsResponse{
+		RPCs: []rpcMetricsInfo{},
+	}
+	for k, m := range metrics {
+		info := rpcMetricsInfo{
+			DB:             k.db,
+			RPC:            k.rpc,
+			Count:          m.count,
+			Errors:         m.errors,
+			LatencySum:     m.latencySum,
+			LatencyBuckets: []latencyBucket{},
+			RequestBytes:   m.requestBytes,
+			ResponseBytes:  m.responseBytes,
+		}
+		var cum uint64
+		for i, le := range latencyBuckets {
+			cum += m.buckets[i]
+			info.LatencyBuckets = append(info.LatencyBuckets, latencyBucket{le, cum})
+		}
+		res.RPCs = append(res.RPCs, info)
+	}
+	sort.Slice(res.RPCs, func(i, j int) bool {
+		a, b := res.RPCs[i], res.RPCs[j]
+		if a.DB != b.DB {
+			return a.DB < b.DB
+		}
+		return a.RPC < b.RPC
+	})
+	if reset {
+		metrics = map[metricsKey]*rpcMetrics{}
+	}
+	return res
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatPrometheus(res metricsResponse) []byte {
+	var b bytes.Buffer
+	labels := func(m rpcMetricsInfo) string {
+		return fmt.Sprintf(`db="%s",rpc="%s"`, promLabelEscaper.Replace(m.DB), promLabelEscaper.Replace(m.RPC))
+	}
+	header := func(name, typ, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	float := func(f float64) string {
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+
+	header("replicache_rpc_duration_seconds", "histogram", "Latency of Dispatch calls.")
+	for _, m := range res.RPCs {
+		l := labels(m)
+		for _, bk := range m.LatencyBuckets {
+			fmt.Fprintf(&b, "replicache_rpc_duration_seconds_bucket{%s,le=\"%s\"} %d\n", l, float(bk.LE), bk.Count)
+		}
+		fmt.Fprintf(&b, "replicache_rpc_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", l, m.Count)
+		fmt.Fprintf(&b, "replicache_rpc_duration_seconds_sum{%s} %s\n", l, float(m.LatencySum))
+		fmt.Fprintf(&b, "replicache_rpc_duration_seconds_count{%s} %d\n", l, m.Count)
+	}
+
+	counters := []struct {
+		name, help string
+		value      func(m rpcMetricsInfo) uint64
+	}{
+		{"replicache_rpc_errors_total", "Dispatch calls that returned an error.", func(m rpcMetricsInfo) uint64 { return m.Errors }},
+		{"replicache_rpc_request_bytes_total", "Size of Dispatch request bodies.", func(m rpcMetricsInfo) uint64 { return m.RequestBytes }},
+		{"replicache_rpc_response_bytes_total", "Size of Dispatch response bodies.", func(m rpcMetricsInfo) uint64 { return m.ResponseBytes }},
+	}
+	for _, c := range counters {
+		header(c.name, "counter", c.help)
+		for _, m := range res.RPCs {
+			fmt.Fprintf(&b, "%s{%s} %d\n", c.name, labels(m), c.value(m))
+		}
+	}
+	return b.Bytes()
+}
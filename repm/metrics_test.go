@@ -0,0 +1,98 @@
+package repm
+
+import (
+	"encoding/json"
+	"testing"
+	gotime "time"
+
+	"github.com/stretchr/testify/assert"
+	"roci.dev/diff-server/util/time"
+)
+
+func TestMetrics(t *testing.T) {
+	defer deinit()
+	defer time.SetFake()()
+
+	assert := assert.New(t)
+
+	_, err := Dispatch("db1", "open", []byte(`{"memory":true}`))
+	assert.NoError(err)
+	_, err = Dispatch("db1", "openTransaction", []byte(`{}`))
+	assert.NoError(err)
+	_, err = Dispatch("db1", "get", []byte(`{"transactionId":1,"key":"foo"}`))
+	assert.NoError(err)
+	_, err = Dispatch("db1", "get", []byte(`{"transactionId":2,"key":"foo"}`))
+	assert.Error(err)
+
+	_, err = Dispatch("", "metrics", []byte(`{"format":"xml"}`))
+	assert.EqualError(err, `{"code":"InvalidRequest","message":"unsupported metrics format: xml"}`)
+
+	res, err := Dispatch("", "metrics", []byte(`{"reset":true}`))
+	assert.NoError(err)
+	var mr metricsResponse
+	assert.NoError(json.Unmarshal(res, &mr))
+	rpcs := map[string]rpcMetricsInfo{}
+	for _, m := range mr.RPCs {
+		rpcs[m.DB+"/"+m.RPC] = m
+	}
+	get := rpcs["db1/get"]
+	assert.Equal(uint64(2), get.Count)
+	assert.Equal(uint64(1), get.Errors)
+	assert.Equal(uint64(len(`{"transactionId":1,"key":"foo"}`)*2), get.RequestBytes)
+	assert.Equal(uint64(len(`{"has":false}`)), get.ResponseBytes)
+	assert.Equal(len(latencyBuckets), len(get.LatencyBuckets))
+	assert.Equal(uint64(2), get.LatencyBuckets[0].Count)
+	assert.Equal(uint64(1), rpcs["db1/open"].Count)
+	assert.Equal(uint64(1), rpcs["/metrics"].Errors)
+
+	// Reset cleared everything but the metrics call that did it.
+	resetRes := res
+	res, err = Dispatch("", "metrics", nil)
+	assert.NoError(err)
+	mr = metricsResponse{}
+	assert.NoError(json.Unmarshal(res, &mr))
+	assert.Equal(1, len(mr.RPCs))
+	assert.Equal("metrics", mr.RPCs[0].RPC)
+	assert.Equal(uint64(1), mr.RPCs[0].Count)
+	assert.Equal(uint64(len(`{"reset":true}`)), mr.RPCs[0].RequestBytes)
+	assert.Equal(uint64(len(resetRes)), mr.RPCs[0].ResponseBytes)
+}
+
+func TestFormatPrometheus(t *testing.T) {
+	defer resetMetrics()
+	assert := assert.New(t)
+
+	resetMetrics()
+	recordMetrics("db\"1", "scan", 20*gotime.Millisecond, 10, 100, false)
+	recordMetrics("db\"1", "scan", 60*gotime.Second, 10, 0, true)
+
+	assert.Equal(`# HELP replicache_rpc_duration_seconds Latency of Dispatch calls.
+# TYPE replicache_rpc_duration_seconds histogram
+replicache_rpc_duration_seconds_bucket{db="db\"1",rpc="scan",le="0.001"} 0
+replicache_rpc_duration_seconds_bucket{db="db\"1",rpc="scan",le="0.0025"} 0
+replicache_rpc_duration_seconds_bucket{db="db\"1",rpc="scan",le="0.005"} 0
+replicache_rpc_duration_seconds_bucket{db="db\"1",rpc="scan",le="0.01"} 0
+replicache_rpc_duration_seconds_bucket{db="db\"1",rpc="scan",le="0.025"} 1
+replicache_rpc_duration_seconds_bucket{db="db\"1",rpc="scan",le="0.05"} 1
+replicache_rpc_duration_seconds_bucket{db="db\"1",rpc="scan",le="0.1"} 1
+replicache_rpc_duration_seconds_bucket{db="db\"1",rpc="scan",le="0.25"} 1
+replicache_rpc_duration_seconds_bucket{db="db\"1",rpc="scan",le="0.5"} 1
+replicache_rpc_duration_seconds_bucket{db="db\"1",rpc="scan",le="1"} 1
+replicache_rpc_duration_seconds_bucket{db="db\"1",rpc="scan",le="2.5"} 1
+replicache_rpc_duration_seconds_bucket{db="db\"1",rpc="scan",le="5"} 1
+replicache_rpc_duration_seconds_bucket{db="db\"1",rpc="scan",le="10"} 1
+replicache_rpc_duration_seconds_bucket{db="db\"1",rpc="scan",le="30"} 1
+replicache_rpc_duration_seconds_bucket{db="db\"1",rpc="scan",le="+Inf"} 2
+replicache_rpc_duration_seconds_sum{db="db\"1",rpc="scan"} 60.02
+replicache_rpc_duration_seconds_count{db="db\"1",rpc="scan"} 2
+# HELP replicache_rpc_errors_total Dispatch calls that returned an error.
+# TYPE replicache_rpc_errors_total counter
+replicache_rpc_errors_total{db="db\"1",rpc="scan"} 1
+# HELP replicache_rpc_request_bytes_total Size of Dispatch request bodies.
+# TYPE replicache_rpc_request_bytes_total counter
+replicache_rpc_request_bytes_total{db="db\"1",rpc="scan"} 20
+# HELP replicache_rpc_response_bytes_total Size of Dispatch response bodies.
+# TYPE replicache_rpc_response_bytes_total counter
+replicache_rpc_response_bytes_total{db="db\"1",rpc="scan"} 100
+`, string(formatPrometheus(snapshotMetrics(false))))
+}
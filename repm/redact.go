@@ -0,0 +1,57 @@
+package repm
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+const redactedValue = "<redacted>"
+
+// sensitiveFields lists the request fields of each rpc that hold credentials
+// or keys. Their values must never end up in logs.
+var sensitiveFields = map[string][]string{
+	"open":      {"encryptionKey"},
+	"rekey":     {"oldKey", "newKey"},
+	"copy":      {"encryptionKey"},
+	"beginSync": {"dataLayerAuth", "diffServerAuth"},
+}
+
+// redactRequest returns a copy of the request body of rpc that is safe to log.
+func redactRequest(rpc string, data []byte) []byte {
+	if len(data) == 0 {
+		return data
+	}
+	if rpc == "batch" {
+		return redactBatchRequest(data)
+	}
+	fields := sensitiveFields[rpc]
+	if len(fields) == 0 {
+		return data
+	}
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(data, &req); err != nil {
+		// We can't tell where the credentials are, eg because the body is CBOR.
+		return redactedJSON()
+	}
+	for _, f := range fields {
+		if _, ok := req[f]; ok {
+			req[f] = redactedJSON()
+		}
+	}
+	return mustMarshal(req)
+}
+
+func redactBatchRequest(data []byte) []byte {
+	var req batchRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return redactedJSON()
+	}
+	for i, op := range req.Ops {
+		req.Ops[i].Data = redactRequest(op.RPC, op.Data)
+	}
+	return mustMarshal(req)
+}
+
+func redactedJSON() json.RawMessage {
+	return json.RawMessage(strconv.Quote(redactedValue))
+}
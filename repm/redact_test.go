@@ -0,0 +1,53 @@
+package repm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	zl "github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	tc := []struct {
+		rpc      string
+		req      string
+		expected string
+	}{
+		{"get", `{"transactionId":1,"key":"foo"}`, `{"transactionId":1,"key":"foo"}`},
+		{"open", ``, ``},
+		{"open", `{"encryptionKey":"AQID","memory":false}`, `{"encryptionKey":"<redacted>","memory":false}`},
+		{"rekey", `{"oldKey":"AQID","newKey":"BAUG"}`, `{"newKey":"<redacted>","oldKey":"<redacted>"}`},
+		{"copy", `{"destination":"db2","encryptionKey":"AQID"}`, `{"destination":"db2","encryptionKey":"<redacted>"}`},
+		{"beginSync", `{"batchPushURL":"u1","diffServerURL":"u2","dataLayerAuth":"s1","diffServerAuth":"s2"}`,
+			`{"batchPushURL":"u1","dataLayerAuth":"<redacted>","diffServerAuth":"<redacted>","diffServerURL":"u2"}`},
+		{"beginSync", `{"batchPushURL":"u1"}`, `{"batchPushURL":"u1"}`},
+		{"beginSync", "\xa1\x6ddataLayerAuth\x62s1", `"<redacted>"`},
+		{"batch", `{"ops":[{"rpc":"beginSync","data":{"dataLayerAuth":"s1"}},{"rpc":"getRoot"}]}`,
+			`{"ops":[{"rpc":"beginSync","data":{"dataLayerAuth":"<redacted>"}},{"rpc":"getRoot"}]}`},
+		{"batch", `not json`, `"<redacted>"`},
+	}
+
+	for _, t := range tc {
+		assert.Equal(t.expected, string(redactRequest(t.rpc, []byte(t.req))), "test case %s: %s", t.rpc, t.req)
+	}
+}
+
+func TestDispatchLogIsRedacted(t *testing.T) {
+	defer deinit()
+
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	buf := &bytes.Buffer{}
+	Init(dir, "", buf)
+	defer zl.SetGlobalLevel(zl.GetGlobalLevel())
+	zl.SetGlobalLevel(zl.DebugLevel)
+
+	Dispatch("db1", "beginSync", []byte(`{"batchPushURL":"u1","dataLayerAuth":"verysecrettoken"}`))
+	assert.Contains(buf.String(), "batchPushURL")
+	assert.NotContains(buf.String(), "verysecrettoken")
+}
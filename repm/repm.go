@@ -1,5 +1,5 @@
 // Package repm implements an Android and iOS interface to Replicache via [Gomobile](https://github.com/golang/go/wiki/Mobile).
-// repm is not thread-safe. Callers must guarantee that it is not called concurrently on different threads/goroutines.
+// repm is safe for concurrent use: Dispatch may be called from multiple threads/goroutines at once.
 package repm
 
 import (
@@ -13,26 +13,36 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"path"
+	"path/filepath"
 	"runtime"
+	"sync"
 	"sync/atomic"
+	gotime "time"
 
 	"github.com/attic-labs/noms/go/spec"
 	zl "github.com/rs/zerolog"
 	zlog "github.com/rs/zerolog/log"
 
-	"roci.dev/diff-server/util/chk"
 	"roci.dev/diff-server/util/log"
 	"roci.dev/diff-server/util/time"
 	"roci.dev/diff-server/util/version"
 	"roci.dev/replicache-client/db"
-
-	// Log all http request/response pairs.
-	_ "roci.dev/diff-server/util/loghttp"
 )
 
 var (
-	connections = map[string]*connection{}
-	repDir      string
+	// connectionsMutex guards connections. Operations that add or remove
+	// connections (open, rekey, rename, copy) hold it exclusively. close and drop
+	// only hold it to remove the connection, not while waiting for it to drain.
+	connectionsMutex sync.RWMutex
+	connections      = map[string]*connection{}
+	repDir           string
+
+	// logOutput is where log messages go, see Init and setLogFormat.
+	logOutput   io.Writer = os.Stdout
+	logNoColor  bool
+	logDest     logWriter
+	logMutex    sync.RWMutex
+	logSamplers = map[string]*logSampler{}
 
 	// Unique rpc request ID
 	rid uint64
@@ -47,10 +57,12 @@ type Logger interface {
 // is created. Logger receives logging output from Replicache.
 func Init(storageDir, tempDir string, logger Logger) {
 	if logger == nil {
-		zlog.Logger = zlog.Output(zl.ConsoleWriter{Out: os.Stdout})
+		logOutput, logNoColor = os.Stdout, false
 	} else {
-		zlog.Logger = zlog.Output(zl.ConsoleWriter{Out: logger, NoColor: true})
+		logOutput, logNoColor = logger, true
 	}
+	setLogOutput("console")
+	zlog.Logger = zlog.Output(&logDest)
 
 	zl.SetGlobalLevel(zl.InfoLevel)
 	l := log.Default()
@@ -68,20 +80,33 @@ func Init(storageDir, tempDir string, logger Logger) {
 
 // for testing
 func deinit() {
+	defer lockConnections()()
 	connections = map[string]*connection{}
 	repDir = ""
+	logMutex.Lock()
+	logSamplers = map[string]*logSampler{}
+	logMutex.Unlock()
+	resetMetrics()
 }
 
 // Dispatch send an API request to Replicache, JSON-serialized parameters, and returns the response.
+// Errors are JSON-serialized too, with a stable "code" that callers can branch on, a
+// human-readable "message", and optionally "retryable" and "details". Connections opened
+// with another encoding use it for request, response and error bodies alike.
 func Dispatch(dbName, rpc string, data []byte) (ret []byte, err error) {
 	t0 := time.Now()
+	var enc encoding = jsonEncoding{}
 	l := log.Default().With().
 		Str("db", dbName).
 		Str("req", rpc).
 		Uint64("rid", atomic.AddUint64(&rid, 1)).
 		Logger()
+	if !sampleLog(rpc) {
+		// Requests that are not sampled only log problems.
+		l = l.Level(zl.WarnLevel)
+	}
 
-	l.Debug().Bytes("data", data).Msg("rpc -->")
+	l.Debug().Bytes("data", redactRequest(rpc, data)).Msg("rpc -->")
 
 	defer func() {
 		t1 := time.Now()
@@ -95,19 +120,34 @@ func Dispatch(dbName, rpc string, data []byte) (ret []byte, err error) {
 			}
 			l.Error().Stack().Msgf("Replicache panicked with: %s\n", msg)
 			ret = nil
-			err = fmt.Errorf("Replicache panicked with: %s - see stderr for more", msg)
+			err = newError(codeInternal, "Replicache panicked with: %s - see stderr for more", msg)
 		}
+		if err != nil {
+			ret = nil
+			err = toRPCError(err).in(enc)
+		}
+		recordMetrics(dbName, rpc, t1.Sub(t0), len(data), len(ret), err != nil)
 	}()
 
 	switch rpc {
 	case "list":
-		return list(l)
+		return list(data, l)
 	case "open":
-		return nil, open(dbName, l)
+		defer lockConnections()()
+		return nil, open(dbName, data, l)
 	case "close":
 		return nil, close(dbName)
 	case "drop":
 		return nil, drop(dbName)
+	case "rekey":
+		defer lockConnections()()
+		return nil, rekey(dbName, data, l)
+	case "rename":
+		defer lockConnections()()
+		return nil, rename(dbName, data, l)
+	case "copy":
+		defer lockConnections()()
+		return nil, copyDatabase(dbName, data)
 	case "version":
 		return []byte(version.Version()), nil
 	case "profile":
@@ -116,54 +156,63 @@ func Dispatch(dbName, rpc string, data []byte) (ret []byte, err error) {
 	case "setLogLevel":
 		// dbName param is ignored
 		return nil, setLogLevel(data)
+	case "setLogFormat":
+		// dbName param is ignored
+		return nil, setLogFormat(data)
+	case "metrics":
+		// dbName param is ignored, metrics of all databases are returned.
+		return dispatchMetrics(data)
 	}
 
-	conn := connections[dbName]
+	conn := getConnection(dbName)
 	if conn == nil {
-		return nil, errors.New("specified database is not open")
+		return nil, newError(codeDatabaseNotOpen, "specified database is not open")
 	}
 
 	l = l.With().Str("cid", conn.db.ClientID()).Logger()
+	enc = conn.encoding
 
-	switch rpc {
-	case "getRoot":
-		return conn.dispatchGetRoot(data)
-	case "has":
-		return conn.dispatchHas(data)
-	case "get":
-		return conn.dispatchGet(data)
-	case "scan":
-		return conn.dispatchScan(data)
-	case "put":
-		return conn.dispatchPut(data)
-	case "del":
-		return conn.dispatchDel(data)
-	case "beginSync":
-		return conn.dispatchBeginSync(data, l)
-	case "maybeEndSync":
-		return conn.dispatchMaybeEndSync(data)
-	case "openTransaction":
-		return conn.dispatchOpenTransaction(data)
-	case "closeTransaction":
-		return conn.dispatchCloseTransaction(data)
-	case "commitTransaction":
-		return conn.dispatchCommitTransaction(data, l)
-	}
-	chk.Fail("Unsupported rpc name: %s", rpc)
-	return nil, nil
+	return conn.dispatchRPC(rpc, data, l)
 }
 
 type DatabaseInfo struct {
 	Name string `json:"name"`
+	// DatabaseStats is only set if requested, see listRequest.
+	*DatabaseStats
+}
+
+// DatabaseStats describes the contents and storage of a database.
+type DatabaseStats struct {
+	// SizeBytes is the on-disk size of the database, zero for in-memory databases.
+	SizeBytes        int64  `json:"sizeBytes"`
+	Keys             uint64 `json:"keys"`
+	PendingMutations int    `json:"pendingMutations"`
+	// ServerStateID is the server state ID of the most recent snapshot.
+	ServerStateID string `json:"serverStateId"`
+	// LastSync is when a sync last completed, absent if the database was never synced.
+	LastSync *gotime.Time `json:"lastSync,omitempty"`
 }
 
 type ListResponse struct {
 	Databases []DatabaseInfo `json:"databases"`
 }
 
-func list(l zl.Logger) (resBytes []byte, err error) {
+type listRequest struct {
+	// Stats includes the DatabaseStats of each database. Databases that are not open
+	// are opened read-only to compute them. Stats are omitted for encrypted databases
+	// that are not open.
+	Stats bool `json:"stats,omitempty"`
+}
+
+func list(data []byte, l zl.Logger) (resBytes []byte, err error) {
 	if repDir == "" {
-		return nil, errors.New("must call init first")
+		return nil, newError(codeUninitialized, "must call init first")
+	}
+	var req listRequest
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
 	}
 
 	resp := ListResponse{
@@ -191,76 +240,491 @@ func list(l zl.Logger) (resBytes []byte, err error) {
 				l.Err(err).Msgf("Could not decode directory name: %s, skipping", entry.Name())
 				continue
 			}
-			resp.Databases = append(resp.Databases, DatabaseInfo{
+			info := DatabaseInfo{
 				Name: string(b),
-			})
+			}
+			if req.Stats {
+				info.DatabaseStats, err = listStats(info.Name)
+				if err != nil {
+					l.Err(err).Msgf("Could not get stats of database: %s, skipping", info.Name)
+				}
+			}
+			resp.Databases = append(resp.Databases, info)
 		}
 	}
 	return json.Marshal(resp)
 }
 
+// listStats returns the stats of the named database, opening it read-only if needed.
+func listStats(dbName string) (*DatabaseStats, error) {
+	if conn := getConnection(dbName); conn != nil {
+		release, err := conn.acquire(false)
+		if err == nil {
+			defer release()
+			s, _, err := conn.stats(false)
+			return s, err
+		}
+	}
+	p := dbPath(repDir, dbName)
+	sp, err := spec.ForDatabase(p)
+	if err != nil {
+		return nil, err
+	}
+	d, err := db.LoadWithOptions(sp, db.LoadOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	s, err := d.Stats(false)
+	if err != nil {
+		return nil, err
+	}
+	return newDatabaseStats(p, s)
+}
+
+func newDatabaseStats(dir string, s db.Stats) (*DatabaseStats, error) {
+	ds := &DatabaseStats{
+		Keys:             s.Keys,
+		PendingMutations: s.PendingMutations,
+		ServerStateID:    s.ServerStateID,
+	}
+	if !s.LastSync.IsZero() {
+		ds.LastSync = &s.LastSync
+	}
+	if dir != "" {
+		var err error
+		ds.SizeBytes, err = db.DirSize(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ds, nil
+}
+
+type openRequest struct {
+	// EncryptionKey is the base64-encoded AES key the database is encrypted with.
+	// If empty, the database is stored unencrypted.
+	EncryptionKey []byte `json:"encryptionKey,omitempty"`
+	// Memory opens a fresh database that lives only in memory and is never written
+	// to disk. Its contents are lost on close.
+	Memory bool `json:"memory,omitempty"`
+	// Encoding selects the encoding of request, response and error bodies for rpcs
+	// on this connection: "json" (the default) or "cbor". The open request itself
+	// is always JSON. Values are the same in either encoding: CBOR requests must
+	// use text strings for keys and strings, byte strings are rejected.
+	Encoding string `json:"encoding,omitempty"`
+	// TransactionIdleTimeoutMs is how long a transaction may go unused before it
+	// is closed automatically. Zero means the default of five minutes, negative
+	// disables the timeout.
+	TransactionIdleTimeoutMs int64 `json:"transactionIdleTimeoutMs,omitempty"`
+	// MaxOpenTransactions limits the number of simultaneously open transactions.
+	// Zero means the default of 1000, negative means unlimited.
+	MaxOpenTransactions int `json:"maxOpenTransactions,omitempty"`
+	// ReadOnly opens an existing database without any chance of writing to it.
+	// Writes and sync fail. The lock on the database directory is not taken, so
+	// the database can be opened while another process has it open.
+	ReadOnly bool `json:"readOnly,omitempty"`
+}
+
 // Open a Replicache database. If the named database doesn't exist it is created.
-func open(dbName string, l zl.Logger) error {
-	if repDir == "" {
-		return errors.New("Replicache is uninitialized - must call init first")
+func open(dbName string, data []byte, l zl.Logger) error {
+	var req openRequest
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &req); err != nil {
+			return err
+		}
+	}
+
+	if repDir == "" && !req.Memory {
+		return newError(codeUninitialized, "Replicache is uninitialized - must call init first")
 	}
 	if dbName == "" {
-		return errors.New("dbName must be non-empty")
+		return newError(codeInvalidRequest, "dbName must be non-empty")
 	}
 
 	if _, ok := connections[dbName]; ok {
 		return nil
 	}
 
+	enc := encodings["json"]
+	if req.Encoding != "" {
+		enc = encodings[req.Encoding]
+		if enc == nil {
+			return newError(codeInvalidRequest, "unsupported encoding: %s", req.Encoding)
+		}
+	}
+
+	limits := defaultTransactionLimits
+	if req.TransactionIdleTimeoutMs != 0 {
+		limits.idleTimeout = gotime.Duration(req.TransactionIdleTimeoutMs) * gotime.Millisecond
+	}
+	if req.MaxOpenTransactions != 0 {
+		limits.maxOpen = req.MaxOpenTransactions
+	}
+
+	if req.Memory {
+		if len(req.EncryptionKey) > 0 {
+			return newError(codeInvalidRequest, "in-memory databases cannot be encrypted")
+		}
+		if req.ReadOnly {
+			return newError(codeInvalidRequest, "in-memory databases cannot be opened read-only")
+		}
+		db, err := db.NewInMemory()
+		if err != nil {
+			return err
+		}
+		l.Info().Msgf("Opened in-memory Replicache instance with ClientID: %s", db.ClientID())
+		conn := newConnection(db, "", enc, limits)
+		conn.options = req
+		connections[dbName] = conn
+		return nil
+	}
+
 	p := dbPath(repDir, dbName)
 	sp, err := spec.ForDatabase(p)
 	if err != nil {
 		return err
 	}
-	db, err := db.Load(sp)
+	var dl *dirLock
+	if !req.ReadOnly {
+		dl, err = lockDir(p)
+		if err != nil {
+			return err
+		}
+	}
+	db, err := db.LoadWithOptions(sp, db.LoadOptions{EncryptionKey: req.EncryptionKey, ReadOnly: req.ReadOnly})
 	if err != nil {
+		if dl != nil {
+			dl.release()
+		}
 		return err
 	}
 
 	l.Info().Msgf("Opened Replicache instance at: %s with tempdir: %s and ClientID: %s", p, os.TempDir(), db.ClientID())
-	connections[dbName] = newConnection(db, p)
+	conn := newConnection(db, p, enc, limits)
+	conn.dirLock = dl
+	conn.options = req
+	connections[dbName] = conn
 	return nil
 }
 
-// Close releases the resources held by the specified open database.
+// Close releases the resources held by the specified open database. It waits for
+// in-flight operations on the database to finish, without holding connectionsMutex
+// so that other databases can be used in the meantime.
 func close(dbName string) error {
 	if dbName == "" {
-		return errors.New("dbName must be non-empty")
+		return newError(codeInvalidRequest, "dbName must be non-empty")
+	}
+	unlock := lockConnections()
+	conn := connections[dbName]
+	delete(connections, dbName)
+	unlock()
+	if conn == nil {
+		return nil
 	}
+	return conn.close()
+}
+
+// closeLocked is close for callers that hold connectionsMutex.
+func closeLocked(dbName string) error {
 	conn := connections[dbName]
 	if conn == nil {
 		return nil
 	}
 	delete(connections, dbName)
-	return nil
+	return conn.close()
 }
 
 // Drop closes and deletes the specified local database. Remote replicas in the group are not affected.
 func drop(dbName string) error {
+	conn := getConnection(dbName)
+	if conn != nil && conn.dir == "" {
+		// In-memory database, nothing on disk to remove.
+		return close(dbName)
+	}
 	if repDir == "" {
-		return errors.New("Replicache is uninitialized - must call init first")
+		return newError(codeUninitialized, "Replicache is uninitialized - must call init first")
 	}
 	if dbName == "" {
-		return errors.New("dbName must be non-empty")
+		return newError(codeInvalidRequest, "dbName must be non-empty")
 	}
 
-	conn := connections[dbName]
 	p := dbPath(repDir, dbName)
 	if conn != nil {
 		if conn.dir != p {
 			return fmt.Errorf("open database %s has directory %s, which is different than specified %s",
 				dbName, conn.dir, p)
 		}
-		close(dbName)
+		if err := close(dbName); err != nil {
+			return err
+		}
+	}
+	// Don't pull the database out from under another process.
+	dl, err := lockDir(p)
+	if err != nil {
+		return err
 	}
+	defer dl.release()
 	return os.RemoveAll(p)
 }
 
+type rekeyRequest struct {
+	OldKey []byte `json:"oldKey,omitempty"`
+	NewKey []byte `json:"newKey,omitempty"`
+}
+
+// Rekey re-encrypts the specified database with a new key. If the database is open
+// it is closed for the duration of the operation and then reopened with the new key
+// and otherwise the same options.
+func rekey(dbName string, data []byte, l zl.Logger) error {
+	if repDir == "" {
+		return newError(codeUninitialized, "Replicache is uninitialized - must call init first")
+	}
+	if dbName == "" {
+		return newError(codeInvalidRequest, "dbName must be non-empty")
+	}
+
+	var req rekeyRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return err
+	}
+
+	conn, wasOpen := connections[dbName]
+	if wasOpen && conn.dir == "" {
+		return newError(codeInvalidRequest, "in-memory databases cannot be encrypted")
+	}
+	if err := closeLocked(dbName); err != nil {
+		return err
+	}
+
+	p := dbPath(repDir, dbName)
+	sp, err := spec.ForDatabase(p)
+	if err != nil {
+		return err
+	}
+	// Make sure no other process has the database open while we rewrite it.
+	dl, err := lockDir(p)
+	if err != nil {
+		return err
+	}
+	key := req.NewKey
+	err = db.Rekey(sp, req.OldKey, req.NewKey)
+	dl.release()
+	if err != nil {
+		key = req.OldKey
+	}
+	if wasOpen {
+		opts := conn.options
+		opts.EncryptionKey = key
+		if oerr := open(dbName, mustMarshal(opts), l); err == nil {
+			err = oerr
+		}
+	}
+	return err
+}
+
+type renameRequest struct {
+	NewName string `json:"newName"`
+}
+
+// Rename gives the specified database a new name. If the database is open it is
+// closed for the duration of the operation and then reopened under the new name
+// with the same options. Transactions open on it are lost.
+func rename(dbName string, data []byte, l zl.Logger) error {
+	var req renameRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return err
+	}
+	if dbName == "" || req.NewName == "" {
+		return newError(codeInvalidRequest, "dbName and newName must be non-empty")
+	}
+	if dbName == req.NewName {
+		return nil
+	}
+	if _, ok := connections[req.NewName]; ok {
+		return newError(codeDatabaseExists, "database %s already exists", req.NewName).withDetail("name", req.NewName)
+	}
+
+	conn, wasOpen := connections[dbName]
+	if wasOpen && conn.dir == "" {
+		// In-memory database, there is only the connection to rename.
+		delete(connections, dbName)
+		connections[req.NewName] = conn
+		return nil
+	}
+	if repDir == "" {
+		return newError(codeUninitialized, "Replicache is uninitialized - must call init first")
+	}
+
+	src, dst := dbPath(repDir, dbName), dbPath(repDir, req.NewName)
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return db.ErrDatabaseNotFound
+	}
+	if _, err := os.Stat(dst); err == nil {
+		return newError(codeDatabaseExists, "database %s already exists", req.NewName).withDetail("name", req.NewName)
+	}
+
+	if wasOpen {
+		if err := closeLocked(dbName); err != nil {
+			return err
+		}
+	}
+	// Don't move the database out from under another process.
+	dl, err := lockDir(src)
+	if err == nil {
+		err = os.Rename(src, dst)
+		dl.release()
+	}
+	if wasOpen {
+		name := req.NewName
+		if err != nil {
+			name = dbName
+		}
+		if oerr := open(name, mustMarshal(conn.options), l); err == nil {
+			err = oerr
+		}
+	}
+	return err
+}
+
+type copyRequest struct {
+	// Destination is the name of the new database. It must not exist yet.
+	Destination string `json:"destination"`
+	// ResetClientID gives the copy a new client ID, so that it syncs as a distinct
+	// client. Otherwise the copy is indistinguishable from the original.
+	ResetClientID bool `json:"resetClientId,omitempty"`
+	// EncryptionKey is needed to reset the client ID of an encrypted database that
+	// is not open. The copy is encrypted with the same key as the original.
+	EncryptionKey []byte `json:"encryptionKey,omitempty"`
+}
+
+// copyDatabase copies the specified database, including its history and pending
+// mutations, to a new database. The source may be open, operations on it wait
+// for the copy to finish.
+func copyDatabase(dbName string, data []byte) error {
+	if repDir == "" {
+		return newError(codeUninitialized, "Replicache is uninitialized - must call init first")
+	}
+	var req copyRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return err
+	}
+	if dbName == "" || req.Destination == "" {
+		return newError(codeInvalidRequest, "dbName and destination must be non-empty")
+	}
+
+	src, dst := dbPath(repDir, dbName), dbPath(repDir, req.Destination)
+	key := req.EncryptionKey
+	if conn := connections[dbName]; conn != nil {
+		if conn.dir == "" {
+			return newError(codeInvalidRequest, "in-memory databases cannot be copied")
+		}
+		// Wait for in-flight operations so that we copy a consistent state.
+		release, err := conn.acquire(true)
+		if err != nil {
+			return err
+		}
+		defer release()
+		key = conn.options.EncryptionKey
+	} else {
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			return db.ErrDatabaseNotFound
+		}
+		dl, err := lockDir(src)
+		if err != nil {
+			return err
+		}
+		defer dl.release()
+	}
+
+	if _, ok := connections[req.Destination]; ok {
+		return newError(codeDatabaseExists, "database %s already exists", req.Destination).withDetail("name", req.Destination)
+	}
+	if _, err := os.Stat(dst); err == nil {
+		return newError(codeDatabaseExists, "database %s already exists", req.Destination).withDetail("name", req.Destination)
+	}
+	dl, err := lockDir(dst)
+	if err != nil {
+		return err
+	}
+	defer dl.release()
+
+	err = copyDir(src, dst)
+	if err == nil && req.ResetClientID {
+		err = resetClientID(dst, key)
+	}
+	if err != nil {
+		os.RemoveAll(dst)
+	}
+	return err
+}
+
+// copyDir copies the files of the database directory src to dst, except for the lock file.
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0777)
+		}
+		if rel == lockFileName {
+			return nil
+		}
+		return copyFile(p, filepath.Join(dst, rel))
+	})
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func resetClientID(dir string, key []byte) error {
+	sp, err := spec.ForDatabase(dir)
+	if err != nil {
+		return err
+	}
+	d, err := db.LoadWithOptions(sp, db.LoadOptions{EncryptionKey: key})
+	if err != nil {
+		return err
+	}
+	_, err = d.ResetClientID()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func lockConnections() func() {
+	connectionsMutex.Lock()
+	return func() {
+		connectionsMutex.Unlock()
+	}
+}
+
+func getConnection(dbName string) *connection {
+	connectionsMutex.RLock()
+	defer connectionsMutex.RUnlock()
+	return connections[dbName]
+}
+
 func dbPath(root, name string) string {
 	return path.Join(root, base64.RawURLEncoding.EncodeToString([]byte(name)))
 }
@@ -286,3 +750,85 @@ func setLogLevel(data []byte) error {
 
 	return nil
 }
+
+type setLogFormatRequest struct {
+	// Format is "console" (the default) for human-readable output or "json" for
+	// one zerolog JSON object per line. Empty leaves the format unchanged.
+	Format string `json:"format,omitempty"`
+	// SampleRates maps rpc names to N, meaning that only one in N requests of that
+	// rpc is logged. Warnings and errors are always logged. Replaces any previous
+	// sample rates.
+	SampleRates map[string]uint64 `json:"sampleRates,omitempty"`
+}
+
+func setLogFormat(data []byte) error {
+	var req setLogFormatRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return err
+	}
+	switch req.Format {
+	case "", "console", "json":
+	default:
+		return newError(codeInvalidRequest, "unsupported log format: %s", req.Format)
+	}
+
+	samplers := map[string]*logSampler{}
+	for rpc, n := range req.SampleRates {
+		if n > 1 {
+			samplers[rpc] = &logSampler{n: n}
+		}
+	}
+	logMutex.Lock()
+	logSamplers = samplers
+	logMutex.Unlock()
+
+	if req.Format != "" {
+		setLogOutput(req.Format)
+	}
+	return nil
+}
+
+func setLogOutput(format string) {
+	if format == "json" {
+		logDest.set(logOutput)
+	} else {
+		logDest.set(zl.ConsoleWriter{Out: logOutput, NoColor: logNoColor})
+	}
+}
+
+// logWriter is what the global logger writes to. setLogFormat switches its
+// destination instead of replacing the global logger, which Dispatch and the db
+// package read concurrently.
+type logWriter struct {
+	w atomic.Value // holds a logDestination
+}
+
+type logDestination struct {
+	io.Writer
+}
+
+func (lw *logWriter) set(w io.Writer) {
+	lw.w.Store(logDestination{w})
+}
+
+func (lw *logWriter) Write(p []byte) (int, error) {
+	return lw.w.Load().(logDestination).Write(p)
+}
+
+// logSampler lets through one in n requests.
+type logSampler struct {
+	n     uint64
+	count uint64
+}
+
+func (s *logSampler) sample() bool {
+	return (atomic.AddUint64(&s.count, 1)-1)%s.n == 0
+}
+
+// sampleLog returns true if the current request of rpc should be logged in full.
+func sampleLog(rpc string) bool {
+	logMutex.RLock()
+	s := logSamplers[rpc]
+	logMutex.RUnlock()
+	return s == nil || s.sample()
+}
@@ -3,11 +3,14 @@ package repm
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"testing"
+	gotime "time"
 
 	"github.com/attic-labs/noms/go/types"
 	zl "github.com/rs/zerolog"
@@ -16,6 +19,7 @@ import (
 	"roci.dev/diff-server/util/log"
 	"roci.dev/diff-server/util/time"
 	"roci.dev/diff-server/util/version"
+	"roci.dev/replicache-client/db"
 )
 
 func mm(assert *assert.Assertions, in interface{}) []byte {
@@ -38,6 +42,87 @@ func TestLog(t *testing.T) {
 	assert.Regexp(`Opened Replicache instance`, string(buf.Bytes()))
 }
 
+func TestLogFormat(t *testing.T) {
+	defer deinit()
+	defer time.SetFake()()
+	defer zl.SetGlobalLevel(zl.GetGlobalLevel())
+
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	buf := &bytes.Buffer{}
+	Init(dir, "", buf)
+	zl.SetGlobalLevel(zl.DebugLevel)
+
+	_, err = Dispatch("", "setLogFormat", []byte(`{"format":"xml"}`))
+	assert.EqualError(err, `{"code":"InvalidRequest","message":"unsupported log format: xml"}`)
+	_, err = Dispatch("", "setLogFormat", []byte(`{"format":"json","sampleRates":{"get":2}}`))
+	assert.NoError(err)
+	buf.Reset()
+
+	_, err = Dispatch("db1", "open", nil)
+	assert.NoError(err)
+	for i := 0; i < 4; i++ {
+		Dispatch("db1", "get", []byte(`{"transactionId":1,"key":"foo"}`))
+	}
+
+	reqs := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		assert.NoError(json.Unmarshal([]byte(line), &entry), line)
+		if entry["message"] == "rpc -->" {
+			assert.Equal("db1", entry["db"])
+			assert.NotNil(entry["rid"])
+			reqs[entry["req"].(string)]++
+		}
+	}
+	assert.Equal(map[string]int{"open": 1, "get": 2}, reqs)
+
+	_, err = Dispatch("", "setLogFormat", []byte(`{"format":"console"}`))
+	assert.NoError(err)
+	buf.Reset()
+	Dispatch("db1", "get", []byte(`{"transactionId":1,"key":"foo"}`))
+	assert.Error(json.Unmarshal(bytes.SplitN(buf.Bytes(), []byte("\n"), 2)[0], &map[string]interface{}{}))
+}
+
+// Run with -race.
+func TestSetLogFormatConcurrently(t *testing.T) {
+	defer deinit()
+	defer zl.SetGlobalLevel(zl.GetGlobalLevel())
+
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	Init(dir, "", ioutil.Discard)
+	zl.SetGlobalLevel(zl.DebugLevel)
+	_, err = Dispatch("db1", "open", nil)
+	assert.NoError(err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				_, err := Dispatch("db1", "getRoot", []byte(`{}`))
+				assert.NoError(err)
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				format := "json"
+				if (i+j)%2 == 0 {
+					format = "console"
+				}
+				_, err := Dispatch("", "setLogFormat", []byte(fmt.Sprintf(`{"format":%q}`, format)))
+				assert.NoError(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
 func s(b []byte) string {
 	return strings.TrimRight(string(b), "\n")
 }
@@ -105,7 +190,7 @@ func TestBasic(t *testing.T) {
 
 		resp, err = Dispatch("db2", "put", []byte(`{"transactionId": 4, "key": "foo", "value": "bar"}`))
 		assert.Nil(resp)
-		assert.EqualError(err, "specified database is not open")
+		assert.EqualError(err, `{"code":"DatabaseNotOpen","message":"specified database is not open"}`)
 	}
 
 	{
@@ -131,7 +216,7 @@ func TestBasic(t *testing.T) {
 
 	resp, err = Dispatch("db1", "openTransaction", []byte(`{}`))
 	assert.Nil(resp)
-	assert.EqualError(err, "specified database is not open")
+	assert.EqualError(err, `{"code":"DatabaseNotOpen","message":"specified database is not open"}`)
 
 	resp, err = Dispatch("db1", "drop", nil)
 	assert.Nil(resp)
@@ -151,7 +236,7 @@ func TestList(t *testing.T) {
 	repDir = ""
 
 	rb, err := Dispatch("", "list", nil)
-	assert.EqualError(err, "must call init first")
+	assert.EqualError(err, `{"code":"Uninitialized","message":"must call init first"}`)
 	assert.Nil(rb)
 
 	Init("/not/existent/dir", "", nil)
@@ -251,3 +336,421 @@ func TestLogLevel(t *testing.T) {
 	assert.Contains(buf.String(), "msg-error")
 	assert.NotContains(buf.String(), "msg-info")
 }
+
+func TestEncryption(t *testing.T) {
+	defer deinit()
+	defer time.SetFake()()
+
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	Init(dir, "", nil)
+
+	k1 := `{"encryptionKey":"AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="}`
+	k2 := `{"encryptionKey":"AgICAgICAgICAgICAgICAg=="}`
+
+	_, err = Dispatch("db1", "open", []byte(k1))
+	assert.NoError(err)
+	_, err = Dispatch("db1", "openTransaction", []byte(`{}`))
+	assert.NoError(err)
+	_, err = Dispatch("db1", "put", []byte(`{"transactionId": 1, "key": "foo", "value": "bar"}`))
+	assert.NoError(err)
+	_, err = Dispatch("db1", "commitTransaction", []byte(`{"transactionId": 1}`))
+	assert.NoError(err)
+	_, err = Dispatch("db1", "close", nil)
+	assert.NoError(err)
+
+	_, err = Dispatch("db1", "open", nil)
+	assert.EqualError(err, `{"code":"EncryptionKeyRequired","message":"database is encrypted: an encryption key is required"}`)
+	_, err = Dispatch("db1", "open", []byte(k2))
+	assert.EqualError(err, `{"code":"WrongEncryptionKey","message":"could not decrypt database: wrong encryption key or database is not encrypted"}`)
+
+	_, err = Dispatch("db1", "open", []byte(`{"encryptionKey":"AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=","maxOpenTransactions":5}`))
+	assert.NoError(err)
+	_, err = Dispatch("db1", "rekey", []byte(`{"oldKey":"AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=","newKey":"AgICAgICAgICAgICAgICAg=="}`))
+	assert.NoError(err)
+	// The database is reopened with the new key and its other options.
+	if assert.NotNil(connections["db1"]) {
+		assert.Equal(5, connections["db1"].options.MaxOpenTransactions)
+		assert.Equal(`"AgICAgICAgICAgICAgICAg=="`, string(mm(assert, connections["db1"].options.EncryptionKey)))
+	}
+
+	resp, err := Dispatch("db1", "openTransaction", []byte(`{}`))
+	assert.NoError(err)
+	assert.Equal(`{"transactionId":1}`, s(resp))
+	resp, err = Dispatch("db1", "get", []byte(`{"transactionId": 1, "key": "foo"}`))
+	assert.NoError(err)
+	assert.Equal(`{"has":true,"value":"bar"}`, s(resp))
+
+	_, err = Dispatch("db1", "close", nil)
+	assert.NoError(err)
+	_, err = Dispatch("db1", "open", []byte(k1))
+	assert.EqualError(err, `{"code":"WrongEncryptionKey","message":"could not decrypt database: wrong encryption key or database is not encrypted"}`)
+	_, err = Dispatch("db1", "open", []byte(k2))
+	assert.NoError(err)
+}
+
+func TestInMemory(t *testing.T) {
+	defer deinit()
+	defer time.SetFake()()
+
+	assert := assert.New(t)
+
+	// In-memory databases do not require a storage directory.
+	_, err := Dispatch("db1", "open", []byte(`{"memory":true}`))
+	assert.NoError(err)
+	assert.Equal("", connections["db1"].dir)
+
+	resp, err := Dispatch("db1", "openTransaction", []byte(`{}`))
+	assert.NoError(err)
+	assert.Equal(`{"transactionId":1}`, s(resp))
+	_, err = Dispatch("db1", "put", []byte(`{"transactionId": 1, "key": "foo", "value": "bar"}`))
+	assert.NoError(err)
+	resp, err = Dispatch("db1", "commitTransaction", []byte(`{"transactionId": 1}`))
+	assert.NoError(err)
+	assert.Equal(`{"ref":"hafgie633fm1pg70olfum414ossa6mt6"}`, s(resp))
+
+	_, err = Dispatch("db1", "close", nil)
+	assert.NoError(err)
+
+	// Reopening yields a fresh, empty database.
+	_, err = Dispatch("db1", "open", []byte(`{"memory":true}`))
+	assert.NoError(err)
+	resp, err = Dispatch("db1", "openTransaction", []byte(`{}`))
+	assert.NoError(err)
+	resp, err = Dispatch("db1", "has", []byte(`{"transactionId": 1, "key": "foo"}`))
+	assert.NoError(err)
+	assert.Equal(`{"has":false}`, s(resp))
+
+	_, err = Dispatch("db1", "drop", nil)
+	assert.NoError(err)
+	assert.Nil(connections["db1"])
+
+	_, err = Dispatch("db2", "open", []byte(`{"memory":true,"encryptionKey":"AgICAgICAgICAgICAgICAg=="}`))
+	assert.EqualError(err, `{"code":"InvalidRequest","message":"in-memory databases cannot be encrypted"}`)
+}
+
+// TestConcurrentDispatch is most useful when run with -race.
+func TestConcurrentDispatch(t *testing.T) {
+	defer deinit()
+
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	Init(dir, "", nil)
+	_, err = Dispatch("db1", "open", nil)
+	assert.NoError(err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				res, err := Dispatch("db1", "openTransaction", []byte(`{}`))
+				assert.NoError(err)
+				var otr openTransactionResponse
+				assert.NoError(json.Unmarshal(res, &otr))
+				tr := transactionRequest{TransactionID: otr.TransactionID}
+				key := fmt.Sprintf("k%d-%d", i, j)
+
+				_, err = Dispatch("db1", "put", mm(assert, putRequest{tr, key, []byte(`"v"`)}))
+				assert.NoError(err)
+				_, err = Dispatch("db1", "get", mm(assert, getRequest{tr, key}))
+				assert.NoError(err)
+				_, err = Dispatch("db1", "scan", mm(assert, scanRequest{transactionRequest: tr}))
+				assert.NoError(err)
+				_, err = Dispatch("db1", "getRoot", []byte(`{}`))
+				assert.NoError(err)
+				if j%2 == 0 {
+					// Commits may conflict, in which case retryCommit is set rather than an error returned.
+					_, err = Dispatch("db1", "commitTransaction", mm(assert, commitTransactionRequest(tr)))
+				} else {
+					_, err = Dispatch("db1", "closeTransaction", mm(assert, closeTransactionRequest(tr)))
+				}
+				assert.NoError(err)
+			}
+		}(i)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 10; j++ {
+			_, err := Dispatch("db2", "open", nil)
+			assert.NoError(err)
+			_, err = Dispatch("", "list", nil)
+			assert.NoError(err)
+			_, err = Dispatch("db2", "close", nil)
+			assert.NoError(err)
+		}
+	}()
+
+	wg.Wait()
+
+	res, err := Dispatch("db1", "openTransaction", []byte(`{}`))
+	assert.NoError(err)
+	var otr openTransactionResponse
+	assert.NoError(json.Unmarshal(res, &otr))
+	res, err = Dispatch("db1", "scan", mm(assert, scanRequest{transactionRequest: transactionRequest{otr.TransactionID}, ScanOptions: db.ScanOptions{Limit: 1000}}))
+	assert.NoError(err)
+	var items []json.RawMessage
+	assert.NoError(json.Unmarshal(res, &items))
+	assert.True(len(items) > 0)
+}
+
+func TestCloseDoesNotBlockOtherDatabases(t *testing.T) {
+	defer deinit()
+
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	Init(dir, "", nil)
+	_, err = Dispatch("db1", "open", nil)
+	assert.NoError(err)
+	_, err = Dispatch("db2", "open", nil)
+	assert.NoError(err)
+
+	// Simulate an in-flight operation on db1.
+	release, err := connections["db1"].acquire(false)
+	assert.NoError(err)
+	closed := make(chan error)
+	go func() {
+		_, err := Dispatch("db1", "close", nil)
+		closed <- err
+	}()
+
+	// db2 stays usable while the close of db1 waits.
+	for getConnection("db1") != nil {
+		gotime.Sleep(gotime.Millisecond)
+	}
+	_, err = Dispatch("db2", "getRoot", []byte(`{}`))
+	assert.NoError(err)
+	_, err = Dispatch("", "list", nil)
+	assert.NoError(err)
+	select {
+	case <-closed:
+		assert.Fail("close did not wait for the in-flight operation")
+	default:
+	}
+
+	release()
+	assert.NoError(<-closed)
+}
+
+func TestReadOnly(t *testing.T) {
+	defer deinit()
+	defer time.SetFake()()
+
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	Init(dir, "", nil)
+
+	_, err = Dispatch("db1", "open", []byte(`{"readOnly":true}`))
+	assert.EqualError(err, `{"code":"DatabaseNotFound","message":"database does not exist"}`)
+	_, err = Dispatch("db1", "open", []byte(`{"readOnly":true,"memory":true}`))
+	assert.EqualError(err, `{"code":"InvalidRequest","message":"in-memory databases cannot be opened read-only"}`)
+
+	_, err = Dispatch("db1", "open", nil)
+	assert.NoError(err)
+	_, err = Dispatch("db1", "openTransaction", []byte(`{}`))
+	assert.NoError(err)
+	_, err = Dispatch("db1", "put", []byte(`{"transactionId": 1, "key": "foo", "value": "bar"}`))
+	assert.NoError(err)
+	_, err = Dispatch("db1", "commitTransaction", []byte(`{"transactionId": 1}`))
+	assert.NoError(err)
+	_, err = Dispatch("db1", "close", nil)
+	assert.NoError(err)
+
+	_, err = Dispatch("db1", "open", []byte(`{"readOnly":true}`))
+	assert.NoError(err)
+	resp, err := Dispatch("db1", "openTransaction", []byte(`{}`))
+	assert.NoError(err)
+	assert.Equal(`{"transactionId":1}`, s(resp))
+	resp, err = Dispatch("db1", "get", []byte(`{"transactionId": 1, "key": "foo"}`))
+	assert.NoError(err)
+	assert.Equal(`{"has":true,"value":"bar"}`, s(resp))
+	_, err = Dispatch("db1", "put", []byte(`{"transactionId": 1, "key": "foo", "value": "baz"}`))
+	assert.EqualError(err, `{"code":"ReadOnly","message":"database is read-only"}`)
+	_, err = Dispatch("db1", "beginSync", []byte(`{"batchPushURL":"http://localhost:1/push","diffServerURL":"http://localhost:1/pull"}`))
+	assert.EqualError(err, `{"code":"ReadOnly","message":"database is read-only"}`)
+}
+
+func TestStats(t *testing.T) {
+	defer deinit()
+	defer time.SetFake()()
+
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	Init(dir, "", nil)
+
+	_, err = Dispatch("db1", "open", nil)
+	assert.NoError(err)
+	_, err = Dispatch("db1", "openTransaction", []byte(`{"name":"foo","args":[]}`))
+	assert.NoError(err)
+	_, err = Dispatch("db1", "put", []byte(`{"transactionId": 1, "key": "foo", "value": "bar"}`))
+	assert.NoError(err)
+	_, err = Dispatch("db1", "commitTransaction", []byte(`{"transactionId": 1}`))
+	assert.NoError(err)
+	_, err = Dispatch("db2", "open", nil)
+	assert.NoError(err)
+	_, err = Dispatch("db2", "close", nil)
+	assert.NoError(err)
+	_, err = Dispatch("db3", "open", []byte(`{"encryptionKey":"AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="}`))
+	assert.NoError(err)
+	_, err = Dispatch("db3", "close", nil)
+	assert.NoError(err)
+
+	res, err := Dispatch("", "list", []byte(`{"stats":true}`))
+	assert.NoError(err)
+	var lr ListResponse
+	assert.NoError(json.Unmarshal(res, &lr))
+	assert.Equal(3, len(lr.Databases))
+	infos := map[string]DatabaseInfo{}
+	for _, info := range lr.Databases {
+		infos[info.Name] = info
+	}
+	if assert.NotNil(infos["db1"].DatabaseStats) {
+		assert.Equal(uint64(1), infos["db1"].Keys)
+		assert.Equal(1, infos["db1"].PendingMutations)
+		assert.True(infos["db1"].SizeBytes > 0)
+		assert.Nil(infos["db1"].LastSync)
+	}
+	if assert.NotNil(infos["db2"].DatabaseStats) {
+		assert.Equal(uint64(0), infos["db2"].Keys)
+		assert.Equal(0, infos["db2"].PendingMutations)
+	}
+	// Encrypted and not open.
+	assert.Nil(infos["db3"].DatabaseStats)
+
+	res, err = Dispatch("", "list", nil)
+	assert.NoError(err)
+	assert.NotContains(string(res), "keys")
+
+	res, err = Dispatch("db1", "stats", []byte(`{}`))
+	assert.NoError(err)
+	var sr statsResponse
+	assert.NoError(json.Unmarshal(res, &sr))
+	assert.Equal(uint64(1), sr.Keys)
+	assert.Equal(1, sr.PendingMutations)
+	assert.Equal(2, sr.CommitChainLength)
+	assert.True(sr.Chunks > 0)
+	assert.True(sr.SizeBytes > 0)
+}
+
+func TestRename(t *testing.T) {
+	defer deinit()
+	defer time.SetFake()()
+
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	Init(dir, "", nil)
+
+	_, err = Dispatch("db1", "rename", []byte(`{"newName":"db2"}`))
+	assert.EqualError(err, `{"code":"DatabaseNotFound","message":"database does not exist"}`)
+
+	_, err = Dispatch("db1", "open", []byte(`{"maxOpenTransactions":1}`))
+	assert.NoError(err)
+	_, err = Dispatch("db1", "openTransaction", []byte(`{}`))
+	assert.NoError(err)
+	_, err = Dispatch("db1", "put", []byte(`{"transactionId": 1, "key": "foo", "value": "bar"}`))
+	assert.NoError(err)
+	_, err = Dispatch("db1", "commitTransaction", []byte(`{"transactionId": 1}`))
+	assert.NoError(err)
+	_, err = Dispatch("db3", "open", nil)
+	assert.NoError(err)
+
+	_, err = Dispatch("db1", "rename", []byte(`{"newName":""}`))
+	assert.EqualError(err, `{"code":"InvalidRequest","message":"dbName and newName must be non-empty"}`)
+	_, err = Dispatch("db1", "rename", []byte(`{"newName":"db3"}`))
+	assert.EqualError(err, `{"code":"DatabaseExists","message":"database db3 already exists","details":{"name":"db3"}}`)
+
+	// Open databases are reopened under the new name, with the same options.
+	_, err = Dispatch("db1", "rename", []byte(`{"newName":"db2"}`))
+	assert.NoError(err)
+	assert.Nil(connections["db1"])
+	if assert.NotNil(connections["db2"]) {
+		assert.Equal(dbPath(dir, "db2"), connections["db2"].dir)
+		assert.Equal(1, connections["db2"].limits.maxOpen)
+	}
+	_, err = Dispatch("db2", "openTransaction", []byte(`{}`))
+	assert.NoError(err)
+	resp, err := Dispatch("db2", "get", []byte(`{"transactionId": 1, "key": "foo"}`))
+	assert.NoError(err)
+	assert.Equal(`{"has":true,"value":"bar"}`, s(resp))
+
+	// Closed databases are just moved.
+	_, err = Dispatch("db2", "close", nil)
+	assert.NoError(err)
+	_, err = Dispatch("db2", "rename", []byte(`{"newName":"db1"}`))
+	assert.NoError(err)
+	assert.Nil(connections["db1"])
+	resp, err = Dispatch("", "list", nil)
+	assert.NoError(err)
+	assert.Equal(`{"databases":[{"name":"db1"},{"name":"db3"}]}`, s(resp))
+
+	_, err = Dispatch("mem1", "open", []byte(`{"memory":true}`))
+	assert.NoError(err)
+	_, err = Dispatch("mem1", "rename", []byte(`{"newName":"mem2"}`))
+	assert.NoError(err)
+	assert.Nil(connections["mem1"])
+	assert.NotNil(connections["mem2"])
+}
+
+func TestCopy(t *testing.T) {
+	defer deinit()
+	defer time.SetFake()()
+
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	Init(dir, "", nil)
+
+	_, err = Dispatch("db1", "copy", []byte(`{"destination":"db2"}`))
+	assert.EqualError(err, `{"code":"DatabaseNotFound","message":"database does not exist"}`)
+
+	_, err = Dispatch("db1", "open", []byte(`{"encryptionKey":"AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="}`))
+	assert.NoError(err)
+	_, err = Dispatch("db1", "openTransaction", []byte(`{}`))
+	assert.NoError(err)
+	_, err = Dispatch("db1", "put", []byte(`{"transactionId": 1, "key": "foo", "value": "bar"}`))
+	assert.NoError(err)
+	_, err = Dispatch("db1", "commitTransaction", []byte(`{"transactionId": 1}`))
+	assert.NoError(err)
+	cid := connections["db1"].db.ClientID()
+
+	// Copy an open database, resetting the client ID with the key it was opened with.
+	_, err = Dispatch("db1", "copy", []byte(`{"destination":"db2","resetClientId":true}`))
+	assert.NoError(err)
+	_, err = os.Stat(path.Join(dbPath(dir, "db2"), lockFileName))
+	assert.NoError(err)
+	_, err = Dispatch("db1", "copy", []byte(`{"destination":"db2"}`))
+	assert.EqualError(err, `{"code":"DatabaseExists","message":"database db2 already exists","details":{"name":"db2"}}`)
+
+	// Copy a closed database, keeping the client ID.
+	_, err = Dispatch("db1", "close", nil)
+	assert.NoError(err)
+	_, err = Dispatch("db1", "copy", []byte(`{"destination":"db3"}`))
+	assert.NoError(err)
+
+	for name, sameClient := range map[string]bool{"db2": false, "db3": true} {
+		_, err = Dispatch(name, "open", []byte(`{"encryptionKey":"AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="}`))
+		assert.NoError(err, name)
+		assert.Equal(sameClient, cid == connections[name].db.ClientID(), name)
+		_, err = Dispatch(name, "openTransaction", []byte(`{}`))
+		assert.NoError(err, name)
+		resp, err := Dispatch(name, "get", []byte(`{"transactionId": 1, "key": "foo"}`))
+		assert.NoError(err, name)
+		assert.Equal(`{"has":true,"value":"bar"}`, s(resp), name)
+	}
+
+	_, err = Dispatch("mem", "open", []byte(`{"memory":true}`))
+	assert.NoError(err)
+	_, err = Dispatch("mem", "copy", []byte(`{"destination":"db4"}`))
+	assert.EqualError(err, `{"code":"InvalidRequest","message":"in-memory databases cannot be copied"}`)
+	_, err = Dispatch("db1", "copy", []byte(`{"destination":"mem"}`))
+	assert.EqualError(err, `{"code":"DatabaseExists","message":"database mem already exists","details":{"name":"mem"}}`)
+}
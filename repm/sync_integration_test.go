@@ -4,161 +4,29 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	diffserve "roci.dev/diff-server/serve"
-	servetypes "roci.dev/diff-server/serve/types"
-	jsnoms "roci.dev/diff-server/util/noms/json"
-	"roci.dev/replicache-client/db"
+	"roci.dev/replicache-client/datalayer"
 )
 
-// dataLayer is a simple in-proceess data layer. It implements a single
-// mutation 'myPut' which sets a key to a value.
-// dataLayer is NOT safe for concurrent access.
-type dataLayer struct {
-	stores           map[string]*store // keyed by clientID
-	authTokens       map[string]string // keyed by clientID
-	batchServer      *httptest.Server
-	clientViewServer *httptest.Server
-}
-
-// store is the data for a single client.
-type store struct {
-	lastMutationID uint64
-	data           map[string]json.RawMessage
-}
-
-// newDataLayer returns a new dataLayer. Caller must call stop() to clean up.
-func newDataLayer() *dataLayer {
-	d := &dataLayer{stores: map[string]*store{}, authTokens: map[string]string{}}
-	d.batchServer = httptest.NewServer(http.HandlerFunc(d.push))
-	d.clientViewServer = httptest.NewServer(http.HandlerFunc(d.clientView))
-	return d
-}
-
-func (d *dataLayer) stop() {
-	d.batchServer.Close()
-	d.clientViewServer.Close()
-}
-
-func (d *dataLayer) getStore(clientID string) *store {
-	s := d.stores[clientID]
-	if s != nil {
-		return s
-	}
-	s = &store{0, make(map[string]json.RawMessage)}
-	d.stores[clientID] = s
-	return s
-}
-
-func (d *dataLayer) setAuthToken(clientID, authToken string) {
-	d.authTokens[clientID] = authToken
-}
-
-func (d dataLayer) auth(clientID, authToken string) bool {
-	return d.authTokens[clientID] == authToken
-}
-
-// push implements the batch push endpoint. It treats any error encountered while
-// processing a mutation as permanent.
-func (d *dataLayer) push(w http.ResponseWriter, r *http.Request) {
-	var req db.BatchPushRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil || req.ClientID == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	if !d.auth(req.ClientID, r.Header.Get("Authorization")) {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-	s := d.getStore(req.ClientID)
-
-	var resp db.BatchPushResponse
-	for _, m := range req.Mutations {
-		if m.ID <= s.lastMutationID {
-			resp.MutationInfos = append(resp.MutationInfos, db.MutationInfo{ID: m.ID, Error: fmt.Sprintf("skipping this mutation: ID is less than %d", s.lastMutationID)})
-			continue
-		}
-		s.lastMutationID = m.ID
-
-		switch m.Name {
-		case "myPut":
-			var args myPutArgs
-			err := json.Unmarshal(m.Args, &args)
-			if err != nil {
-				resp.MutationInfos = append(resp.MutationInfos, db.MutationInfo{ID: m.ID, Error: fmt.Sprintf("skipping this mutation: couldn't unmarshal putArgs: %s", err.Error())})
-				continue
-			}
-			if len(args.Value) == 0 {
-				resp.MutationInfos = append(resp.MutationInfos, db.MutationInfo{ID: m.ID, Error: fmt.Sprintf("skipping this mutation: value must be non-empty")})
-			} else {
-				s.data[args.Key] = args.Value
-			}
-		default:
-			resp.MutationInfos = append(resp.MutationInfos, db.MutationInfo{ID: m.ID, Error: fmt.Sprintf("skipping this mutation: mutation '%s' not supported", m.Name)})
-		}
-	}
-
-	b, err := json.Marshal(resp)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	w.Write(b)
-	return
-}
-
-// change is used by tests to change a client's data behind its back.
-func (d *dataLayer) change(clientID string, key string, value json.RawMessage) {
-	s := d.getStore(clientID)
-	s.data[key] = value
-}
+// dataLayerAuth is the auth token of the data layer of the test environment.
+const dataLayerAuth = "opensaysme"
 
+// myPutArgs are the args of the myPut mutation, which sets a key to a value.
 type myPutArgs struct {
 	Key   string          `json:"key"`
 	Value json.RawMessage `json:"value"`
 }
 
-func (d *dataLayer) clientView(w http.ResponseWriter, r *http.Request) {
-	var req servetypes.ClientViewRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil || req.ClientID == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	if !d.auth(req.ClientID, r.Header.Get("Authorization")) {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-	s := d.getStore(req.ClientID)
-
-	var resp servetypes.ClientViewResponse
-	resp.LastMutationID = s.lastMutationID
-	resp.ClientView = make(map[string]json.RawMessage)
-	for k, v := range s.data {
-		resp.ClientView[k] = v
-	}
-
-	b, err := json.Marshal(resp)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	w.Write(b)
-	return
-}
-
 // testEnv is an integration test environment. Careful: repm.connections[] is
 // a global resource so we need to be sure to call deinit() and not attempt to
 // run tests in parallel.
 type testEnv struct {
 	dbName         string
 	api            api
-	dataLayer      *dataLayer
 	batchPushURL   string
 	clientViewURL  string
 	account        diffserve.Account
@@ -176,6 +44,12 @@ func (t testEnv) teardown() {
 }
 
 func newTestEnv(assert *assert.Assertions) testEnv {
+	return newTestEnvWithData(assert, nil)
+}
+
+// newTestEnvWithData returns a test environment whose data layer starts out with
+// data for every client.
+func newTestEnvWithData(assert *assert.Assertions, data map[string]json.RawMessage) testEnv {
 	env := testEnv{dbName: "db1"}
 
 	// Client
@@ -187,10 +61,16 @@ func newTestEnv(assert *assert.Assertions) testEnv {
 	env.api = api{dbName: env.dbName, assert: assert}
 
 	// Data layer
-	env.dataLayer = newDataLayer()
-	env.teardowns = append(env.teardowns, env.dataLayer.stop)
-	env.batchPushURL = env.dataLayer.batchServer.URL
-	env.clientViewURL = env.dataLayer.clientViewServer.URL
+	dataLayer := httptest.NewServer(datalayer.New(datalayer.Config{
+		AuthToken: dataLayerAuth,
+		Data:      data,
+		Mutations: map[string]datalayer.MutationConfig{
+			"myPut": {Op: "put", Key: "key", Value: "value"},
+		},
+	}, ioutil.Discard))
+	env.teardowns = append(env.teardowns, dataLayer.Close)
+	env.batchPushURL = dataLayer.URL + "/batch-push"
+	env.clientViewURL = dataLayer.URL + "/client-view"
 
 	// Diff server
 	diffDir, _ := ioutil.TempDir("", "")
@@ -247,7 +127,7 @@ func (a api) get(key string) getResponse {
 }
 
 func (a api) openTransaction(name string, args json.RawMessage, rebaseOpts *rebaseOpts) openTransactionResponse {
-	req := openTransactionRequest{Name: name, Args: args}
+	req := openTransactionRequest{Name: name, Args: value(args)}
 	if rebaseOpts != nil {
 		req.RebaseOpts = *rebaseOpts
 	}
@@ -285,7 +165,7 @@ func (a api) beginSync(batchPushURL, dataLayerAuth, diffServerURL, diffServerAut
 	return res, nil
 }
 
-func (a api) maybeEndSync(syncHead *jsnoms.Hash) maybeEndSyncResponse {
+func (a api) maybeEndSync(syncHead *nomsHash) maybeEndSyncResponse {
 	req := maybeEndSyncRequest{syncHead}
 	b, err := Dispatch(a.dbName, "maybeEndSync", a.marshal(req))
 	a.assert.NoError(err)
@@ -297,7 +177,7 @@ func (a api) maybeEndSync(syncHead *jsnoms.Hash) maybeEndSyncResponse {
 
 // maybeReplayMutations is the "bindings" implementation of replay, called after maybeEndSync.
 // It returns the new sync head and how many mutations were replayed.
-func maybeReplayMutations(a api, syncHead *jsnoms.Hash, m maybeEndSyncResponse) (*jsnoms.Hash, int) {
+func maybeReplayMutations(a api, syncHead *nomsHash, m maybeEndSyncResponse) (*nomsHash, int) {
 	numReplayed := 0
 	for _, m := range m.ReplayMutations {
 		a.assert.Equal("myPut", m.Name)
@@ -322,17 +202,11 @@ func (a api) unmarshal(m []byte, v interface{}) {
 	return
 }
 
-func (a api) clientID() string {
-	return connections[a.dbName].db.ClientID()
-}
-
 func TestNopRoundTrip(t *testing.T) {
 	assert := assert.New(t)
 	env := newTestEnv(assert)
 	defer env.teardown()
 	api := env.api
-	dataLayerAuth := "opensaysme"
-	env.dataLayer.setAuthToken(api.clientID(), dataLayerAuth)
 
 	getRootResponse := api.getRoot()
 	head := getRootResponse.Root.Hash
@@ -360,8 +234,6 @@ func TestRoundTrip(t *testing.T) {
 	env := newTestEnv(assert)
 	defer env.teardown()
 	api := env.api
-	dataLayerAuth := "opensaysme"
-	env.dataLayer.setAuthToken(api.clientID(), dataLayerAuth)
 
 	myPut(api, "key", []byte("true"), nil)
 	getRootResponse := api.getRoot()
@@ -372,7 +244,7 @@ func TestRoundTrip(t *testing.T) {
 	assert.Equal(0, len(maybeEndSyncResponse.ReplayMutations))
 	getResponse := api.get("key")
 	assert.True(getResponse.Has)
-	assert.Equal(json.RawMessage([]byte("true")), getResponse.Value)
+	assert.Equal(value("true"), getResponse.Value)
 	getRootResponse = api.getRoot()
 	newHead := getRootResponse.Root.Hash
 	assert.NotEqual(head, newHead)
@@ -380,22 +252,19 @@ func TestRoundTrip(t *testing.T) {
 
 func TestPull(t *testing.T) {
 	assert := assert.New(t)
-	env := newTestEnv(assert)
+	env := newTestEnvWithData(assert, map[string]json.RawMessage{"key": json.RawMessage("true")})
 	defer env.teardown()
 	api := env.api
-	dataLayerAuth := "opensaysme"
-	env.dataLayer.setAuthToken(api.clientID(), dataLayerAuth)
 
 	getResponse := api.get("key")
 	assert.False(getResponse.Has)
-	env.dataLayer.change(api.clientID(), "key", []byte("true"))
 	beginSyncResponse, err := api.beginSync(env.batchPushURL, dataLayerAuth, env.diffServerURL, env.diffServerAuth)
 	assert.NoError(err)
 	maybeEndSyncResponse := api.maybeEndSync(&beginSyncResponse.SyncHead)
 	assert.Equal(0, len(maybeEndSyncResponse.ReplayMutations))
 	getResponse = api.get("key")
 	assert.True(getResponse.Has)
-	assert.Equal(json.RawMessage([]byte("true")), getResponse.Value)
+	assert.Equal(value("true"), getResponse.Value)
 }
 
 func TestReplay(t *testing.T) {
@@ -403,8 +272,6 @@ func TestReplay(t *testing.T) {
 	env := newTestEnv(assert)
 	defer env.teardown()
 	api := env.api
-	dataLayerAuth := "opensaysme"
-	env.dataLayer.setAuthToken(api.clientID(), dataLayerAuth)
 
 	myPut(api, "key1", []byte(`"expected"`), nil)
 	myPut(api, "key2", []byte(`"will be replaced"`), nil)
@@ -427,7 +294,7 @@ func TestReplay(t *testing.T) {
 	for _, k := range []string{"key1", "key2", "key3"} {
 		getResponse := api.get(k)
 		assert.True(getResponse.Has)
-		assert.Equal(json.RawMessage([]byte(`"expected"`)), getResponse.Value)
+		assert.Equal(value(`"expected"`), getResponse.Value)
 	}
 
 	// At this point there are three mutations pending, which now get pushed upstream.
@@ -438,7 +305,7 @@ func TestReplay(t *testing.T) {
 	for _, k := range []string{"key1", "key2", "key3"} {
 		getResponse := api.get(k)
 		assert.True(getResponse.Has)
-		assert.Equal(json.RawMessage([]byte(`"expected"`)), getResponse.Value)
+		assert.Equal(value(`"expected"`), getResponse.Value)
 	}
 
 	// Now there is nothing left to do.
@@ -4,18 +4,14 @@
 package repm
 
 import (
-	"encoding/json"
-
 	"roci.dev/replicache-client/db"
-
-	jsnoms "roci.dev/diff-server/util/noms/json"
 )
 
 type getRootRequest struct {
 }
 
 type getRootResponse struct {
-	Root jsnoms.Hash `json:"root"`
+	Root nomsHash `json:"root"`
 }
 
 type hasRequest struct {
@@ -33,8 +29,8 @@ type getRequest struct {
 }
 
 type getResponse struct {
-	Has   bool            `json:"has"`
-	Value json.RawMessage `json:"value,omitempty"`
+	Has   bool  `json:"has"`
+	Value value `json:"value,omitempty"`
 }
 
 type scanRequest struct {
@@ -43,8 +39,8 @@ type scanRequest struct {
 }
 
 type scanItem struct {
-	Key   string       `json:"key"`
-	Value jsnoms.Value `json:"value"`
+	Key   string    `json:"key"`
+	Value nomsValue `json:"value"`
 }
 
 type scanResponse struct {
@@ -54,8 +50,8 @@ type scanResponse struct {
 
 type putRequest struct {
 	transactionRequest
-	Key   string          `json:"key"`
-	Value json.RawMessage `json:"value"`
+	Key   string `json:"key"`
+	Value value  `json:"value"`
 }
 
 type putResponse struct{}
@@ -77,29 +73,37 @@ type beginSyncRequest struct {
 }
 
 type beginSyncResponse struct {
-	SyncHead jsnoms.Hash `json:"syncHead,omitempty"`
+	SyncHead nomsHash    `json:"syncHead,omitempty"`
 	SyncInfo db.SyncInfo `json:"syncInfo,omitempty"`
 }
 
 type maybeEndSyncRequest struct {
-	SyncHead *jsnoms.Hash `json:"syncHead,omitempty"`
+	SyncHead *nomsHash `json:"syncHead,omitempty"`
 }
 
 // Sync is complete when there are zero replay mutations and
 // no error (returned separately by the api).
 type maybeEndSyncResponse struct {
-	ReplayMutations []db.ReplayMutation `json:"replayMutations,omitempty"`
+	ReplayMutations []replayMutation `json:"replayMutations,omitempty"`
+}
+
+// replayMutation is a db.ReplayMutation in the encoding of the connection.
+type replayMutation struct {
+	ID       uint64    `json:"id"`
+	Name     string    `json:"name"`
+	Args     value     `json:"args"`
+	Original *nomsHash `json:"original,omitempty"`
 }
 
 type openTransactionRequest struct {
-	Name       string          `json:"name,omitempty"`
-	Args       json.RawMessage `json:"args,omitempty"`
-	RebaseOpts rebaseOpts      `json:"rebaseOpts,omitempty"`
+	Name       string     `json:"name,omitempty"`
+	Args       value      `json:"args,omitempty"`
+	RebaseOpts rebaseOpts `json:"rebaseOpts,omitempty"`
 }
 
 type rebaseOpts struct {
-	Basis    *jsnoms.Hash `json:"basis"`
-	Original *jsnoms.Hash `json:"original"`
+	Basis    *nomsHash `json:"basis"`
+	Original *nomsHash `json:"original"`
 }
 
 type openTransactionResponse struct {
@@ -118,6 +122,60 @@ type closeTransactionResponse struct {
 type commitTransactionRequest transactionRequest
 
 type commitTransactionResponse struct {
-	Ref         *jsnoms.Hash `json:"ref,omitempty"`
-	RetryCommit bool         `json:"retryCommit,omitempty"`
+	Ref         *nomsHash `json:"ref,omitempty"`
+	RetryCommit bool      `json:"retryCommit,omitempty"`
+}
+
+type listTransactionsRequest struct {
+}
+
+type transactionInfo struct {
+	TransactionID int      `json:"transactionId"`
+	Name          string   `json:"name,omitempty"`
+	Basis         nomsHash `json:"basis"`
+	AgeMs         int64    `json:"ageMs"`
+	IdleMs        int64    `json:"idleMs"`
+	// Expired transactions are closed the next time the connection touches them.
+	Expired bool `json:"expired,omitempty"`
+}
+
+type listTransactionsResponse struct {
+	Transactions []transactionInfo `json:"transactions"`
+}
+
+type schemaVersionRequest struct {
+}
+
+type schemaVersionResponse struct {
+	SchemaVersion uint64 `json:"schemaVersion"`
+}
+
+type statsRequest struct {
+}
+
+type statsResponse struct {
+	DatabaseStats
+	CommitChainLength int `json:"commitChainLength"`
+	Chunks            int `json:"chunks"`
+}
+
+type batchRequest struct {
+	Ops []batchOp `json:"ops"`
+	// AbortOnError stops the batch at the first failing op. The results then
+	// only include the ops up to and including the failed one.
+	AbortOnError bool `json:"abortOnError,omitempty"`
+}
+
+type batchOp struct {
+	RPC  string `json:"rpc"`
+	Data body   `json:"data,omitempty"`
+}
+
+type batchResult struct {
+	Result body      `json:"result,omitempty"`
+	Error  *rpcError `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Results []batchResult `json:"results"`
 }